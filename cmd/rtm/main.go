@@ -3,6 +3,10 @@ package main
 import (
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/brianaung/rtm/internal/auth"
 	"github.com/brianaung/rtm/internal/db"
@@ -23,31 +27,136 @@ func init() {
 func main() {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
-	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: false,
-		MaxAge:           300,
-	}))
+	// ALLOWED_ORIGINS is a comma separated list of the other origins, such as
+	// https://example.com, allowed to call the api and open the websockets.
+	// Without it only the pages of the server itself can.
+	origins := strings.FieldsFunc(os.Getenv("ALLOWED_ORIGINS"), func(r rune) bool { return r == ',' || r == ' ' })
+	if len(origins) > 0 {
+		// an empty list would allow every origin
+		r.Use(cors.Handler(cors.Options{
+			AllowedOrigins:   origins,
+			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+			AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", auth.CSRFHeader},
+			ExposedHeaders:   []string{"Link"},
+			AllowCredentials: false,
+			MaxAge:           300,
+		}))
+	}
 
-	fs := http.FileServer(http.Dir("dist"))
-	r.Handle("/dist/*", http.StripPrefix("/dist/", fs))
+	// setup stores, STORE=memory runs the server without a database
+	var (
+		dbpool       *db.Database
+		userStore    user.UserStore
+		sessionStore auth.SessionStore
+		roomStore    chat.RoomStore
+		msgStore     chat.MessageStore
+		noteStore    chat.NotificationStore
+	)
+	if os.Getenv("STORE") == "memory" {
+		log.Println("Using in-memory stores, data will not be persisted")
+		users := user.NewMemStore()
+		userStore, sessionStore = users, users
+		chatStore := chat.NewMemStore(users)
+		roomStore, msgStore, noteStore = chatStore, chatStore, chatStore
+	} else {
+		var err error
+		dbpool, err = db.Init()
+		if err != nil {
+			log.Fatal("Error initialising db")
+		}
+		defer dbpool.Close()
+		users := user.NewPgStore(dbpool.Get())
+		userStore, sessionStore = users, users
+		chatStore := chat.NewPgStore(dbpool.Get())
+		roomStore, msgStore, noteStore = chatStore, chatStore, chatStore
+	}
+
+	// setup chat backplane, BACKPLANE=postgres shares messages between nodes
+	var backplane chat.Backplane
+	if os.Getenv("BACKPLANE") == "postgres" {
+		if dbpool == nil {
+			log.Fatal("The postgres backplane requires the postgres store")
+		}
+		backplane = chat.NewPgBackplane(dbpool.Get())
+	} else {
+		backplane = chat.NewLocalBackplane()
+	}
+	defer backplane.Close()
 
-	// setup db
-	dbpool, err := db.Init()
+	// setup login rate limiting, LOGIN_LIMITER=postgres shares the limits
+	// between nodes
+	var limiter user.RateLimiter
+	if os.Getenv("LOGIN_LIMITER") == "postgres" {
+		if dbpool == nil {
+			log.Fatal("The postgres login limiter requires the postgres store")
+		}
+		limiter = user.NewPgRateLimiter(dbpool.Get())
+	} else {
+		limiter = user.NewMemRateLimiter()
+	}
+
+	// setup attachment storage, BLOB_DIR is where uploads are kept
+	blobDir := os.Getenv("BLOB_DIR")
+	if blobDir == "" {
+		blobDir = "uploads"
+	}
+	blobStore, err := chat.NewLocalBlobStore(blobDir)
 	if err != nil {
-		log.Fatal("Error initialising db")
+		log.Fatal("Error initialising blob storage: ", err)
 	}
-	defer dbpool.Close()
 
-	// setup auth
-	userauth := auth.Init()
+	// setup auth, every request changing state needs a csrf token
+	userauth := auth.Init(sessionStore)
+	r.Use(userauth.RealIP())
+	r.Use(userauth.CSRF())
+
+	fs := http.FileServer(http.Dir("dist"))
+	r.Handle("/dist/*", http.StripPrefix("/dist/", fs))
 
 	// inject dependencies to services
-	userService := user.NewService(r, dbpool.Get(), userauth)
-	chatService := chat.NewService(r, dbpool.Get(), userauth)
+	userService := user.NewService(r, userStore, limiter, userauth)
+	chatService := chat.NewService(r, roomStore, msgStore, noteStore, blobStore, userauth, backplane)
+
+	chatService.AllowOrigins(origins)
+
+	// LOGIN_IP_LIMIT is the login rate limit per client address, such as
+	// 20/30s, or off
+	if v := os.Getenv("LOGIN_IP_LIMIT"); v == "off" {
+		userService.LimitLoginsPerIP(user.Bucket{})
+	} else if v != "" {
+		b, err := user.ParseBucket(v)
+		if err != nil {
+			log.Fatalf("Invalid LOGIN_IP_LIMIT: %v", err)
+		}
+		userService.LimitLoginsPerIP(b)
+	}
+
+	// LOGIN_AUDIT_RETENTION is how long the failed logins are kept in the
+	// audit log, 2160h (90 days) by default
+	retention := 90 * 24 * time.Hour
+	if v := os.Getenv("LOGIN_AUDIT_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid LOGIN_AUDIT_RETENTION: %q", v)
+		}
+		retention = d
+	}
+	userService.PruneLogins(retention)
+
+	// PUBLIC_URL is the address of the server in the links users share, such
+	// as the invite links
+	if publicURL := os.Getenv("PUBLIC_URL"); publicURL != "" {
+		u, err := url.Parse(publicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Invalid PUBLIC_URL: %q", publicURL)
+		}
+		chatService.SetPublicURL(publicURL)
+	}
+
+	// LINK_PREVIEWS=off stops the server from fetching the links posted in messages
+	if os.Getenv("LINK_PREVIEWS") != "off" {
+		chatService.EnableLinkPreviews()
+	}
 
 	// start services
 	userService.Routes()
@@ -1,51 +1,141 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"log"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/go-chi/jwtauth/v5"
 	"github.com/gofrs/uuid/v5"
-	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultAccessTTL  = 15 * time.Minute
+	defaultRefreshTTL = 30 * 24 * time.Hour
 )
 
 type Auth struct {
-	ja *jwtauth.JWTAuth
+	ja       *jwtauth.JWTAuth
+	secret   []byte
+	sessions SessionStore
+	// lifetime of the jwt access tokens, and of the sessions since their
+	// last refresh
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	cookies    cookiePolicy
+	proxies    trustedProxies
+	// hasher hashes the new passwords, hashers check the stored ones
+	hasher  PasswordHasher
+	hashers []PasswordHasher
+	// hash of no one's password, see CheckNoPassword
+	dummyOnce sync.Once
+	dummy     string
 }
 
 type UserContext struct {
-	ID       uuid.UUID `json:"id"`
-	Username string    `json:"username"`
-	Email    string    `json:"email"`
+	ID        uuid.UUID `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	SessionID uuid.UUID `json:"sid"`
 }
 
-func Init() (a *Auth) {
-	jwtAuth := jwtauth.New("HS256", []byte(os.Getenv("JWT_SECRET")), nil)
-	a = &Auth{ja: jwtAuth}
+// Init reads the auth settings from the environment. ACCESS_TOKEN_TTL and
+// REFRESH_TOKEN_TTL are durations such as 15m or 720h, see cookiePolicy for
+// the cookie settings, newHasherFromEnv for the password hashing ones and
+// proxiesFromEnv for the reverse proxies.
+func Init(sessions SessionStore) (a *Auth) {
+	secret := []byte(os.Getenv("JWT_SECRET"))
+	jwtAuth := jwtauth.New("HS256", secret, nil)
+	a = &Auth{
+		ja:         jwtAuth,
+		secret:     secret,
+		sessions:   sessions,
+		accessTTL:  envDuration("ACCESS_TOKEN_TTL", defaultAccessTTL),
+		refreshTTL: envDuration("REFRESH_TOKEN_TTL", defaultRefreshTTL),
+		cookies:    cookiePolicyFromEnv(),
+		proxies:    proxiesFromEnv(),
+		hasher:     newHasherFromEnv(),
+	}
+	a.hashers = []PasswordHasher{a.hasher, &BcryptHasher{}, &Argon2idHasher{}}
 	return
 }
 
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid %s: %q", key, v)
+	}
+	return d
+}
+
 func (a *Auth) GetJA() *jwtauth.JWTAuth {
 	return a.ja
 }
 
 // helpers
+
+// Sign computes a HMAC-SHA256 of data with the server secret, for tokens
+// other than the JWT (e.g. room invites).
+func (a *Auth) Sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Verify reports whether sig is the signature of data, in constant time.
+func (a *Auth) Verify(data []byte, sig []byte) bool {
+	return hmac.Equal(a.Sign(data), sig)
+}
+
+// HashAndSalt hashes a password with the configured hasher.
 func (a *Auth) HashAndSalt(password string) (string, error) {
-	// GenerateFromPassword salt the password for us aside from hashing it
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
-	return string(hashedPassword), err
+	return a.hasher.Hash(password)
 }
 
+// CheckPassword checks a password against a hash of any of the supported
+// algorithms, whichever is configured for new passwords. It returns
+// ErrWrongPassword if they do not match.
 func (a *Auth) CheckPassword(hashed string, p string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(p))
+	for _, h := range a.hashers {
+		if h.Handles(hashed) {
+			return h.Verify(hashed, p)
+		}
+	}
+	return errUnknownHash
 }
 
+// CheckNoPassword checks a password against a hash that matches none, so a
+// login for an unknown user takes as long as one with a wrong password.
+func (a *Auth) CheckNoPassword(p string) {
+	a.dummyOnce.Do(func() {
+		var err error
+		if a.dummy, err = a.hasher.Hash("no one's password"); err != nil {
+			log.Printf("error: %v", err)
+		}
+	})
+	a.CheckPassword(a.dummy, p)
+}
+
+// NeedsRehash reports whether a hash was made with another algorithm or other
+// parameters than the ones configured, so the password should be hashed again
+// the next time it is known.
+func (a *Auth) NeedsRehash(hashed string) bool {
+	return !a.hasher.Handles(hashed) || a.hasher.Outdated(hashed)
+}
+
+// SetTokenCookie signs an access token with the claims, valid for accessTTL.
+// The cookie expires along with the token.
 func (a *Auth) SetTokenCookie(w http.ResponseWriter, claims map[string]interface{}) {
+	expires := time.Now().Add(a.accessTTL)
+	jwtauth.SetExpiry(claims, expires)
 	_, tokenString, _ := a.ja.Encode(claims)
-	cookie := http.Cookie{
-		Name:     "jwt",
-		Value:    tokenString,
-		HttpOnly: true, // Helps to mitigate XSS attacks
-	}
-	http.SetCookie(w, &cookie)
+	http.SetCookie(w, a.cookie("jwt", tokenString, expires))
 }
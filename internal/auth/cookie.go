@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// cookiePolicy holds the attributes of every cookie set by the server, so
+// that they can differ between environments. It is read from COOKIE_SECURE
+// (true by default, turn it off to serve over plain http in development),
+// COOKIE_SAMESITE (lax, strict or none, lax by default) and COOKIE_DOMAIN.
+type cookiePolicy struct {
+	secure   bool
+	sameSite http.SameSite
+	domain   string
+}
+
+func cookiePolicyFromEnv() cookiePolicy {
+	p := cookiePolicy{secure: os.Getenv("COOKIE_SECURE") != "false", sameSite: http.SameSiteLaxMode, domain: os.Getenv("COOKIE_DOMAIN")}
+	switch v := strings.ToLower(os.Getenv("COOKIE_SAMESITE")); v {
+	case "", "lax":
+	case "strict":
+		p.sameSite = http.SameSiteStrictMode
+	case "none":
+		if !p.secure {
+			log.Fatal("COOKIE_SAMESITE=none requires secure cookies")
+		}
+		p.sameSite = http.SameSiteNoneMode
+	default:
+		log.Fatalf("Invalid COOKIE_SAMESITE: %q", v)
+	}
+	return p
+}
+
+// cookie returns an http only cookie for the whole site, kept until expires.
+func (a *Auth) cookie(name string, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   a.cookies.domain,
+		Expires:  expires,
+		Secure:   a.cookies.secure,
+		HttpOnly: true, // Helps to mitigate XSS attacks
+		SameSite: a.cookies.sameSite,
+	}
+}
+
+// clearCookie removes a cookie set with cookie.
+func (a *Auth) clearCookie(w http.ResponseWriter, name string) {
+	c := a.cookie(name, "", time.Time{})
+	c.MaxAge = -1
+	http.SetCookie(w, c)
+}
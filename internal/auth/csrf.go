@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"time"
+)
+
+const (
+	csrfCookie = "csrf"
+	// CSRFHeader is the header carrying the token of CSRFToken.
+	CSRFHeader = "X-CSRF-Token"
+	// csrfTokenLen is the length of an encoded token.
+	csrfTokenLen = 43
+)
+
+type csrfContextKey struct{}
+
+// CSRF protects the requests that change state with the double submit
+// pattern: the browser gets a random token in the csrf cookie, and the pages
+// send it back in the X-CSRF-Token header (see view.layout). Another site can
+// make the browser send the cookie, but cannot read it to set the header.
+//
+// Only the header is checked, so that multipart bodies are left for the
+// handlers to read.
+func (a *Auth) CSRF() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			token := ""
+			if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) == csrfTokenLen {
+				token = c.Value
+			}
+			if token == "" {
+				b := make([]byte, 32)
+				if _, err := rand.Read(b); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					w.Write([]byte(err.Error()))
+					return
+				}
+				token = base64.RawURLEncoding.EncodeToString(b)
+				http.SetCookie(w, a.cookie(csrfCookie, token, time.Now().Add(a.refreshTTL)))
+			}
+
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			default:
+				if subtle.ConstantTimeCompare([]byte(r.Header.Get(CSRFHeader)), []byte(token)) != 1 {
+					w.WriteHeader(http.StatusForbidden)
+					w.Write([]byte("Invalid CSRF token, reload the page and try again."))
+					return
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), csrfContextKey{}, token)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// CSRFToken returns the token the page of a request must send back with the
+// requests changing state, see CSRF.
+func CSRFToken(ctx context.Context) string {
+	token, _ := ctx.Value(csrfContextKey{}).(string)
+	return token
+}
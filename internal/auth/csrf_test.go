@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+func TestCSRF(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test secret")
+	a := Init(&fakeSessions{sessions: make(map[uuid.UUID]*Session)})
+	h := a.CSRF()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(CSRFToken(r.Context())))
+	}))
+
+	// a page hands out the token
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	c := cookie(rec.Result().Cookies(), csrfCookie)
+	if rec.Code != http.StatusOK || c == nil || len(c.Value) != csrfTokenLen {
+		t.Fatalf("got %d with cookie %v, want a token", rec.Code, c)
+	}
+	if rec.Body.String() != c.Value {
+		t.Fatalf("got token %q in the page, want %q", rec.Body, c.Value)
+	}
+	token := c.Value
+	other := "A" + token[1:]
+	if other == token {
+		other = "B" + token[1:]
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		cookie string
+		header string
+		want   int
+	}{
+		{"get without header", http.MethodGet, token, "", http.StatusOK},
+		{"post", http.MethodPost, token, token, http.StatusOK},
+		{"delete", http.MethodDelete, token, token, http.StatusOK},
+		{"missing header", http.MethodPost, token, "", http.StatusForbidden},
+		{"mismatched header", http.MethodPut, token, other, http.StatusForbidden},
+		{"missing cookie", http.MethodPost, "", token, http.StatusForbidden},
+		{"short cookie", http.MethodPost, "short", "short", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: csrfCookie, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				r.Header.Set(CSRFHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Fatalf("got %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
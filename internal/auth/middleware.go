@@ -2,31 +2,46 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"net/http"
 
 	"github.com/go-chi/jwtauth/v5"
-	"github.com/gofrs/uuid/v5"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 )
 
 /* This is a modification of go-chi/jwtauth Authenticator middleware to handle redirection upon successful authentication.
  * See here: https://github.com/go-chi/jwtauth/blob/master/jwtauth.go#L171
+ *
+ * The access token must belong to an active session, so that revoked sessions are logged out right away. Expired access
+ * tokens are refreshed with the refresh token cookie, see refresh.
  */
 func (a *Auth) Authenticator() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		hfn := func(w http.ResponseWriter, r *http.Request) {
-			// validate jwt token
+			// validate jwt token, or refresh it
+			var s *Session
 			token, claims, err := jwtauth.FromContext(r.Context())
-			if err != nil || token == nil || jwt.Validate(token, a.ja.ValidateOptions()...) != nil {
+			if err == nil && token != nil && jwt.Validate(token, a.ja.ValidateOptions()...) == nil {
+				s, err = a.session(r, claims)
+			} else {
+				s, err = a.refresh(w, r)
+			}
+			if errors.Is(err, ErrNoSession) {
+				a.clearSessionCookies(w)
 				http.Redirect(w, r, "/", http.StatusSeeOther)
 				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
 			}
 
 			// set context with logged in user data so other handlers have access to it
 			res := UserContext{
-				ID:       uuid.Must(uuid.FromString(claims["id"].(string))),
-				Username: claims["username"].(string),
-				Email:    claims["email"].(string),
+				ID:        s.UserID,
+				Username:  s.Username,
+				Email:     s.Email,
+				SessionID: s.ID,
 			}
 			ctx := context.WithValue(r.Context(), "user", &res)
 
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrWrongPassword is returned by CheckPassword when the password does not
+	// match the hash.
+	ErrWrongPassword = errors.New("wrong password")
+	errUnknownHash   = errors.New("unknown password hash")
+)
+
+// PasswordHasher hashes passwords into encoded strings that record their
+// algorithm and parameters, so that hashes made with older settings can
+// still be checked, and told apart to be replaced.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Verify returns ErrWrongPassword if the password does not match an
+	// encoded hash of the algorithm.
+	Verify(encoded string, password string) error
+	// Handles reports whether an encoded hash was made with the algorithm.
+	Handles(encoded string) bool
+	// Outdated reports whether an encoded hash of the algorithm was made
+	// with other parameters than the hasher's.
+	Outdated(encoded string) bool
+}
+
+// newHasherFromEnv returns the hasher of new passwords set by PASSWORD_HASHER,
+// bcrypt by default or argon2id. BCRYPT_COST, ARGON2_MEMORY (in KiB),
+// ARGON2_TIME and ARGON2_THREADS tune them.
+func newHasherFromEnv() PasswordHasher {
+	switch v := os.Getenv("PASSWORD_HASHER"); v {
+	case "", "bcrypt":
+		cost := envInt("BCRYPT_COST", defaultBcryptCost)
+		if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			log.Fatalf("Invalid BCRYPT_COST: %d", cost)
+		}
+		return &BcryptHasher{Cost: cost}
+	case "argon2id":
+		h := &Argon2idHasher{
+			Memory:  uint32(envInt("ARGON2_MEMORY", defaultArgon2Memory)),
+			Time:    uint32(envInt("ARGON2_TIME", defaultArgon2Time)),
+			Threads: uint8(envInt("ARGON2_THREADS", defaultArgon2Threads)),
+		}
+		if h.Memory < 8*uint32(h.Threads) || h.Time < 1 || h.Threads < 1 {
+			log.Fatal("Invalid argon2 parameters")
+		}
+		return h
+	default:
+		log.Fatalf("Invalid PASSWORD_HASHER: %q", v)
+		return nil
+	}
+}
+
+func envInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %q", key, v)
+	}
+	return n
+}
+
+// =================================== bcrypt ===================================
+
+const defaultBcryptCost = 12
+
+// BcryptHasher hashes passwords with bcrypt, whose hashes record the cost.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	// GenerateFromPassword salt the password for us aside from hashing it
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hashed), err
+}
+
+func (h *BcryptHasher) Verify(encoded string, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrWrongPassword
+	}
+	return err
+}
+
+func (h *BcryptHasher) Handles(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h *BcryptHasher) Outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// =================================== argon2id ===================================
+
+const (
+	defaultArgon2Memory  = 64 * 1024
+	defaultArgon2Time    = 3
+	defaultArgon2Threads = 2
+	argon2SaltLen        = 16
+	argon2KeyLen         = 32
+)
+
+// Argon2idHasher hashes passwords with argon2id, encoded in the PHC string
+// format: $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>.
+type Argon2idHasher struct {
+	// Memory is in KiB.
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// argon2Hash is a decoded argon2id hash.
+type argon2Hash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) Verify(encoded string, password string) error {
+	d, err := decodeArgon2(encoded)
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey([]byte(password), d.salt, d.time, d.memory, d.threads, uint32(len(d.key)))
+	if subtle.ConstantTimeCompare(key, d.key) != 1 {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+func (h *Argon2idHasher) Handles(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h *Argon2idHasher) Outdated(encoded string) bool {
+	d, err := decodeArgon2(encoded)
+	return err != nil || d.memory != h.Memory || d.time != h.Time || d.threads != h.Threads || len(d.key) != argon2KeyLen
+}
+
+func decodeArgon2(encoded string) (*argon2Hash, error) {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=2", salt, key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errUnknownHash
+	}
+	d := &argon2Hash{}
+	// argon2 panics without a round or a thread
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &d.memory, &d.time, &d.threads); err != nil || d.time < 1 || d.threads < 1 {
+		return nil, errUnknownHash
+	}
+	var err error
+	if d.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errUnknownHash
+	}
+	if d.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(d.key) == 0 {
+		return nil, errUnknownHash
+	}
+	return d, nil
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestDecodeArgon2(t *testing.T) {
+	const (
+		salt = "c29tZXNhbHRzb21lc2FsdA"
+		key  = "a2V5a2V5a2V5a2V5"
+	)
+	tests := []struct {
+		name    string
+		encoded string
+		ok      bool
+	}{
+		{"valid", "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "$" + key, true},
+		{"empty", "", false},
+		{"bcrypt", "$2a$12$R9h/cIPz0gi.URNNX3kh2OPST9/PgBkqquzi.Ss7KIUgO2t0jWMUW", false},
+		{"argon2i", "$argon2i$v=19$m=65536,t=3,p=2$" + salt + "$" + key, false},
+		{"other version", "$argon2id$v=16$m=65536,t=3,p=2$" + salt + "$" + key, false},
+		{"missing part", "$argon2id$v=19$m=65536,t=3,p=2$" + salt, false},
+		{"bad parameters", "$argon2id$v=19$m=lots,t=3,p=2$" + salt + "$" + key, false},
+		{"no rounds", "$argon2id$v=19$m=65536,t=0,p=2$" + salt + "$" + key, false},
+		{"no threads", "$argon2id$v=19$m=65536,t=3,p=0$" + salt + "$" + key, false},
+		{"bad salt", "$argon2id$v=19$m=65536,t=3,p=2$!!$" + key, false},
+		{"padded key", "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "$" + key + "==", false},
+		{"empty key", "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "$", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := decodeArgon2(tt.encoded)
+			if !tt.ok {
+				if err != errUnknownHash {
+					t.Fatalf("got %v, want errUnknownHash", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.memory != 65536 || d.time != 3 || d.threads != 2 || string(d.salt) != "somesaltsomesalt" || string(d.key) != "keykeykeykey" {
+				t.Fatalf("got %+v", d)
+			}
+		})
+	}
+}
+
+func TestPasswordHashers(t *testing.T) {
+	fast := &Argon2idHasher{Memory: 64, Time: 1, Threads: 1}
+	tests := []struct {
+		name  string
+		h     PasswordHasher
+		tuned PasswordHasher
+	}{
+		{"bcrypt", &BcryptHasher{Cost: bcrypt.MinCost}, &BcryptHasher{Cost: bcrypt.MinCost + 1}},
+		{"argon2id", fast, &Argon2idHasher{Memory: 128, Time: 1, Threads: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := tt.h.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.h.Handles(encoded) {
+				t.Fatalf("hasher does not handle its own hash %q", encoded)
+			}
+			if err := tt.h.Verify(encoded, "correct horse"); err != nil {
+				t.Fatalf("verify the password: %v", err)
+			}
+			if err := tt.h.Verify(encoded, "battery staple"); err != ErrWrongPassword {
+				t.Fatalf("verify another password: got %v, want ErrWrongPassword", err)
+			}
+			if tt.h.Outdated(encoded) {
+				t.Fatal("fresh hash is outdated")
+			}
+			if !tt.tuned.Outdated(encoded) {
+				t.Fatal("hash is not outdated for other parameters")
+			}
+		})
+	}
+	// each hasher only handles its own hashes
+	bcrypted, _ := (&BcryptHasher{Cost: bcrypt.MinCost}).Hash("pw")
+	if fast.Handles(bcrypted) {
+		t.Fatal("argon2id handles a bcrypt hash")
+	}
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// trustedProxies are the addresses of the reverse proxies in front of the
+// server, whose X-Forwarded-For and X-Real-IP headers are believed.
+type trustedProxies []netip.Prefix
+
+// proxiesFromEnv reads TRUSTED_PROXIES, a comma separated list of addresses
+// or networks such as 10.0.0.0/8. It is empty by default, so that clients
+// cannot pick the address they are rate limited and audited by.
+func proxiesFromEnv() trustedProxies {
+	var proxies trustedProxies
+	for _, v := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(v)
+			if aerr != nil {
+				log.Fatalf("Invalid TRUSTED_PROXIES: %q", v)
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		proxies = append(proxies, p.Masked())
+	}
+	return proxies
+}
+
+func (t trustedProxies) trusts(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range t {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of a request sent through the
+// proxies. X-Forwarded-For is read from the right, the first address that is
+// not a proxy is the one the closest proxy got the request from, the ones on
+// its left may be made up by the client.
+func (t trustedProxies) clientIP(r *http.Request) string {
+	ip := ClientIP(r)
+	if !t.trusts(ip) {
+		return ip
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if _, err := netip.ParseAddr(hop); err != nil {
+				// a malformed entry, the ones before it cannot be trusted
+				return ip
+			}
+			ip = hop
+			if !t.trusts(hop) {
+				return ip
+			}
+		}
+		return ip
+	}
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); xri != "" {
+		if _, err := netip.ParseAddr(xri); err == nil {
+			return xri
+		}
+	}
+	return ip
+}
+
+// RealIP replaces the remote address of the requests sent through the trusted
+// proxies by the address of their client, see ClientIP. Requests from other
+// addresses are left as they are, whatever their headers.
+func (a *Auth) RealIP() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			if ip := a.proxies.clientIP(r); ip != ClientIP(r) {
+				r.RemoteAddr = net.JoinHostPort(ip, "0")
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
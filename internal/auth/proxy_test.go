@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test secret")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.1")
+	a := Init(nil)
+	h := a.RealIP()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(ClientIP(r)))
+	}))
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		xri    string
+		want   string
+	}{
+		{"direct", "203.0.113.7:1234", "", "", "203.0.113.7"},
+		{"untrusted proxy", "203.0.113.7:1234", "198.51.100.1", "198.51.100.2", "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"single trusted address", "192.0.2.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"chain of proxies", "10.1.2.3:1234", "198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{"spoofed by the client", "10.1.2.3:1234", "1.1.1.1, 198.51.100.1", "", "198.51.100.1"},
+		{"only proxies", "10.1.2.3:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"malformed", "10.1.2.3:1234", "nonsense", "", "10.1.2.3"},
+		{"real ip", "10.1.2.3:1234", "", "198.51.100.1", "198.51.100.1"},
+		{"no header", "10.1.2.3:1234", "", "", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.xri != "" {
+				r.Header.Set("X-Real-IP", tt.xri)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if got := rec.Body.String(); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
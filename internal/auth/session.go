@@ -0,0 +1,277 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+// ErrNoSession is returned by a SessionStore when a session does not exist,
+// or is not in the expected state anymore.
+var ErrNoSession = errors.New("session not found")
+
+const (
+	// refreshCookie holds the refresh token of the session, as its id and
+	// secret separated by a dot.
+	refreshCookie = "refresh"
+	// refreshGrace is how long the previous refresh token of a session is
+	// still accepted after a rotation, for the requests that were sent with
+	// it at the same time.
+	refreshGrace = 30 * time.Second
+	// touchInterval is how often the last seen time of a session is updated.
+	touchInterval = time.Minute
+	// maxUserAgent bounds the user agent kept to describe the device of a session.
+	maxUserAgent = 255
+)
+
+// Session is the login of a user on a device. The browser keeps the refresh
+// token of the session in a cookie, while the session only keeps its hash.
+type Session struct {
+	ID     uuid.UUID `json:"id"`
+	UserID uuid.UUID `json:"user_id"`
+	// Username and Email are filled in by GetSession, to sign new access tokens.
+	Username    string `json:"username"`
+	Email       string `json:"email"`
+	RefreshHash []byte `json:"-"`
+	// PrevHash is the refresh token replaced at RotatedAt, see refreshGrace.
+	PrevHash   []byte     `json:"-"`
+	RotatedAt  time.Time  `json:"rotated_at"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// active reports whether the session can still be used at now.
+func (s *Session) active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+func (s *Session) claims() map[string]interface{} {
+	return map[string]interface{}{"id": s.UserID, "username": s.Username, "email": s.Email, "sid": s.ID}
+}
+
+// SessionStore persists the sessions of users.
+type SessionStore interface {
+	AddSession(ctx context.Context, s *Session) error
+	// GetSession returns nil if there is no such session, revoked and
+	// expired ones included.
+	GetSession(ctx context.Context, sid uuid.UUID) (*Session, error)
+	// RotateSession replaces the refresh token of a session if it still is
+	// prev, and returns ErrNoSession otherwise.
+	RotateSession(ctx context.Context, sid uuid.UUID, prev []byte, next []byte, ip string, at time.Time, expires time.Time) error
+	TouchSession(ctx context.Context, sid uuid.UUID, ip string, at time.Time) error
+	// RevokeSession returns ErrNoSession if the session is not an active
+	// session of the user.
+	RevokeSession(ctx context.Context, uid uuid.UUID, sid uuid.UUID, at time.Time) error
+	RevokeSessions(ctx context.Context, uid uuid.UUID, at time.Time) error
+	// GetSessions returns the active sessions of a user, last seen first.
+	GetSessions(ctx context.Context, uid uuid.UUID, now time.Time) ([]*Session, error)
+}
+
+// StartSession opens a session for a user who just logged in, and sets the
+// cookies of its access and refresh tokens.
+func (a *Auth) StartSession(w http.ResponseWriter, r *http.Request, u *UserContext) error {
+	secret, hash, err := newRefreshToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	s := &Session{
+		ID:          uuid.Must(uuid.NewV4()),
+		UserID:      u.ID,
+		Username:    u.Username,
+		Email:       u.Email,
+		RefreshHash: hash,
+		RotatedAt:   now,
+		UserAgent:   UserAgent(r),
+		IP:          ClientIP(r),
+		CreatedAt:   now,
+		LastSeenAt:  now,
+		ExpiresAt:   now.Add(a.refreshTTL),
+	}
+	if err := a.sessions.AddSession(r.Context(), s); err != nil {
+		return err
+	}
+	a.setSessionCookies(w, s, secret)
+	return nil
+}
+
+// EndSession revokes the session of the request and clears its cookies.
+func (a *Auth) EndSession(w http.ResponseWriter, r *http.Request) error {
+	a.clearSessionCookies(w)
+	u, ok := r.Context().Value("user").(*UserContext)
+	if !ok {
+		return nil
+	}
+	if err := a.sessions.RevokeSession(r.Context(), u.ID, u.SessionID, time.Now()); err != nil && !errors.Is(err, ErrNoSession) {
+		return err
+	}
+	return nil
+}
+
+// EndAllSessions revokes every session of the user of the request, on all
+// their devices, and clears the cookies of the current one.
+func (a *Auth) EndAllSessions(w http.ResponseWriter, r *http.Request) error {
+	a.clearSessionCookies(w)
+	u, ok := r.Context().Value("user").(*UserContext)
+	if !ok {
+		return nil
+	}
+	return a.sessions.RevokeSessions(r.Context(), u.ID, time.Now())
+}
+
+// RevokeSession ends a session of a user, from any of their devices.
+func (a *Auth) RevokeSession(ctx context.Context, uid uuid.UUID, sid uuid.UUID) error {
+	return a.sessions.RevokeSession(ctx, uid, sid, time.Now())
+}
+
+// Sessions returns the active sessions of a user, last seen first.
+func (a *Auth) Sessions(ctx context.Context, uid uuid.UUID) ([]*Session, error) {
+	return a.sessions.GetSessions(ctx, uid, time.Now())
+}
+
+// SessionActive reports whether a session can still be used, for the
+// connections that stay open long after the request that opened them was
+// authenticated.
+func (a *Auth) SessionActive(ctx context.Context, sid uuid.UUID) (bool, error) {
+	s, err := a.sessions.GetSession(ctx, sid)
+	if err != nil {
+		return false, err
+	}
+	return s != nil && s.active(time.Now()), nil
+}
+
+// session returns the active session an access token was issued for, and
+// keeps its last seen time up to date.
+func (a *Auth) session(r *http.Request, claims map[string]interface{}) (*Session, error) {
+	sid, ok := claims["sid"].(string)
+	if !ok {
+		// tokens issued before sessions existed are not trusted anymore
+		return nil, ErrNoSession
+	}
+	id, err := uuid.FromString(sid)
+	if err != nil {
+		return nil, ErrNoSession
+	}
+	s, err := a.sessions.GetSession(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if s == nil || !s.active(now) {
+		return nil, ErrNoSession
+	}
+	if now.Sub(s.LastSeenAt) > touchInterval {
+		if err := a.sessions.TouchSession(r.Context(), s.ID, ClientIP(r), now); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// refresh exchanges the refresh token of the request for a new access token,
+// and rotates the refresh token. A refresh token used once it was rotated,
+// past refreshGrace, was likely stolen, so its session is revoked.
+func (a *Auth) refresh(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	c, err := r.Cookie(refreshCookie)
+	if err != nil {
+		return nil, ErrNoSession
+	}
+	sid, secret, _ := strings.Cut(c.Value, ".")
+	id, err := uuid.FromString(sid)
+	if err != nil {
+		return nil, ErrNoSession
+	}
+	s, err := a.sessions.GetSession(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if s == nil || !s.active(now) {
+		return nil, ErrNoSession
+	}
+	hash := hashToken(secret)
+	switch {
+	case subtle.ConstantTimeCompare(hash, s.RefreshHash) == 1:
+		next, nextHash, err := newRefreshToken()
+		if err != nil {
+			return nil, err
+		}
+		expires := now.Add(a.refreshTTL)
+		if err := a.sessions.RotateSession(r.Context(), s.ID, s.RefreshHash, nextHash, ClientIP(r), now, expires); errors.Is(err, ErrNoSession) {
+			// a concurrent request rotated it first, and set the new cookie
+			a.SetTokenCookie(w, s.claims())
+			return s, nil
+		} else if err != nil {
+			return nil, err
+		}
+		s.ExpiresAt = expires
+		a.setSessionCookies(w, s, next)
+	case s.PrevHash != nil && subtle.ConstantTimeCompare(hash, s.PrevHash) == 1 && now.Sub(s.RotatedAt) < refreshGrace:
+		a.SetTokenCookie(w, s.claims())
+	default:
+		if err := a.sessions.RevokeSession(r.Context(), s.UserID, s.ID, now); err != nil && !errors.Is(err, ErrNoSession) {
+			return nil, err
+		}
+		return nil, ErrNoSession
+	}
+	return s, nil
+}
+
+func (a *Auth) setSessionCookies(w http.ResponseWriter, s *Session, secret string) {
+	a.SetTokenCookie(w, s.claims())
+	http.SetCookie(w, a.cookie(refreshCookie, s.ID.String()+"."+secret, s.ExpiresAt))
+}
+
+func (a *Auth) clearSessionCookies(w http.ResponseWriter) {
+	a.clearCookie(w, "jwt")
+	a.clearCookie(w, refreshCookie)
+}
+
+// newRefreshToken returns a random refresh token and its hash.
+func newRefreshToken() (string, []byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	return secret, hashToken(secret), nil
+}
+
+// hashToken hashes a refresh token before it is stored or compared. The token
+// is random, so a fast hash is enough.
+func hashToken(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// ClientIP returns the address of the client of a request, without the port.
+// It is the address of the client of a trusted proxy once RealIP is mounted.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// UserAgent returns the user agent of a request, cut to fit the session store.
+func UserAgent(r *http.Request) string {
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgent {
+		ua = ua[:maxUserAgent]
+	}
+	return ua
+}
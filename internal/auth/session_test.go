@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/gofrs/uuid/v5"
+)
+
+// fakeSessions is a SessionStore kept in memory.
+type fakeSessions struct {
+	mu       sync.Mutex
+	sessions map[uuid.UUID]*Session
+}
+
+func (f *fakeSessions) AddSession(ctx context.Context, s *Session) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := *s
+	f.sessions[s.ID] = &c
+	return nil
+}
+
+func (f *fakeSessions) GetSession(ctx context.Context, sid uuid.UUID) (*Session, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.sessions[sid]
+	if !ok {
+		return nil, nil
+	}
+	c := *s
+	return &c, nil
+}
+
+func (f *fakeSessions) RotateSession(ctx context.Context, sid uuid.UUID, prev []byte, next []byte, ip string, at time.Time, expires time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.sessions[sid]
+	if !ok || s.RevokedAt != nil || !bytes.Equal(s.RefreshHash, prev) {
+		return ErrNoSession
+	}
+	s.PrevHash, s.RefreshHash = s.RefreshHash, next
+	s.RotatedAt, s.LastSeenAt, s.IP, s.ExpiresAt = at, at, ip, expires
+	return nil
+}
+
+func (f *fakeSessions) TouchSession(ctx context.Context, sid uuid.UUID, ip string, at time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.sessions[sid]; ok {
+		s.LastSeenAt, s.IP = at, ip
+	}
+	return nil
+}
+
+func (f *fakeSessions) RevokeSession(ctx context.Context, uid uuid.UUID, sid uuid.UUID, at time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.sessions[sid]
+	if !ok || s.UserID != uid || s.RevokedAt != nil {
+		return ErrNoSession
+	}
+	s.RevokedAt = &at
+	return nil
+}
+
+func (f *fakeSessions) RevokeSessions(ctx context.Context, uid uuid.UUID, at time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.sessions {
+		if s.UserID == uid && s.RevokedAt == nil {
+			s.RevokedAt = &at
+		}
+	}
+	return nil
+}
+
+func (f *fakeSessions) GetSessions(ctx context.Context, uid uuid.UUID, now time.Time) ([]*Session, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ss []*Session
+	for _, s := range f.sessions {
+		if s.UserID == uid && s.active(now) {
+			c := *s
+			ss = append(ss, &c)
+		}
+	}
+	return ss, nil
+}
+
+// newTestAuth returns an Auth and a user logged in to it, along with the
+// cookies of their session.
+func newTestAuth(t *testing.T) (*Auth, *fakeSessions, *UserContext, []*http.Cookie) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test secret")
+	store := &fakeSessions{sessions: make(map[uuid.UUID]*Session)}
+	a := Init(store)
+	u := &UserContext{ID: uuid.Must(uuid.NewV4()), Username: "alice", Email: "alice@example.com"}
+	rec := httptest.NewRecorder()
+	if err := a.StartSession(rec, httptest.NewRequest(http.MethodPost, "/login", nil), u); err != nil {
+		t.Fatal(err)
+	}
+	return a, store, u, rec.Result().Cookies()
+}
+
+// cookie returns the cookie called name, or nil.
+func cookie(cookies []*http.Cookie, name string) *http.Cookie {
+	for _, c := range cookies {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// refreshWith calls refresh with a refresh token cookie, and returns the
+// cookies it set.
+func refreshWith(a *Auth, token *http.Cookie) (*Session, []*http.Cookie, error) {
+	r := httptest.NewRequest(http.MethodGet, "/dashboard", nil)
+	r.AddCookie(token)
+	rec := httptest.NewRecorder()
+	s, err := a.refresh(rec, r)
+	return s, rec.Result().Cookies(), err
+}
+
+// onlySession returns the session of the store, which holds a single one.
+func (f *fakeSessions) onlySession(t *testing.T) *Session {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(f.sessions))
+	}
+	for _, s := range f.sessions {
+		return s
+	}
+	return nil
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	a, store, u, cookies := newTestAuth(t)
+	first := cookie(cookies, refreshCookie)
+
+	s, cookies, err := refreshWith(a, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.UserID != u.ID {
+		t.Fatalf("got user %v, want %v", s.UserID, u.ID)
+	}
+	second := cookie(cookies, refreshCookie)
+	if second == nil || second.Value == first.Value {
+		t.Fatalf("got refresh cookie %v, want a new token", second)
+	}
+	if cookie(cookies, "jwt") == nil {
+		t.Fatal("no access token was set")
+	}
+	// the new token is the one rotated the next time
+	if _, cookies, err = refreshWith(a, second); err != nil {
+		t.Fatal(err)
+	}
+	if third := cookie(cookies, refreshCookie); third == nil || third.Value == second.Value {
+		t.Fatalf("got refresh cookie %v, want a new token", third)
+	}
+	if store.onlySession(t).RevokedAt != nil {
+		t.Fatal("rotation revoked the session")
+	}
+}
+
+func TestRefreshGrace(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     time.Duration
+		revoked bool
+	}{
+		{"concurrent request", 0, false},
+		{"within grace", refreshGrace - time.Second, false},
+		{"reused", refreshGrace + time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, store, _, cookies := newTestAuth(t)
+			first := cookie(cookies, refreshCookie)
+			if _, _, err := refreshWith(a, first); err != nil {
+				t.Fatal(err)
+			}
+			store.mu.Lock()
+			for _, s := range store.sessions {
+				s.RotatedAt = time.Now().Add(-tt.age)
+			}
+			store.mu.Unlock()
+
+			_, cookies, err := refreshWith(a, first)
+			if tt.revoked {
+				if !errors.Is(err, ErrNoSession) {
+					t.Fatalf("got %v, want ErrNoSession", err)
+				}
+				if store.onlySession(t).RevokedAt == nil {
+					t.Fatal("reused refresh token did not revoke the session")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cookie(cookies, "jwt") == nil {
+				t.Fatal("no access token was set")
+			}
+			// the previous token does not rotate the session again
+			if c := cookie(cookies, refreshCookie); c != nil {
+				t.Fatalf("got refresh cookie %v, want none", c)
+			}
+			if store.onlySession(t).RevokedAt != nil {
+				t.Fatal("session was revoked")
+			}
+		})
+	}
+}
+
+func TestRevokedSessionIsRefused(t *testing.T) {
+	a, store, u, cookies := newTestAuth(t)
+	r := chi.NewRouter()
+	r.Use(jwtauth.Verifier(a.GetJA()))
+	r.Use(a.Authenticator())
+	r.Get("/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Context().Value("user").(*UserContext).Username))
+	})
+	get := func(cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/dashboard", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	token := cookie(cookies, "jwt")
+
+	if rec := get(token); rec.Code != http.StatusOK || rec.Body.String() != u.Username {
+		t.Fatalf("got %d %q, want the dashboard", rec.Code, rec.Body)
+	}
+	if err := a.RevokeSession(context.Background(), u.ID, store.onlySession(t).ID); err != nil {
+		t.Fatal(err)
+	}
+	// the access token has not expired, but its session is gone
+	rec := get(token)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("got %d, want a redirect", rec.Code)
+	}
+	if c := cookie(rec.Result().Cookies(), "jwt"); c == nil || c.MaxAge >= 0 {
+		t.Fatalf("got jwt cookie %v, want it cleared", c)
+	}
+	// nor can it be refreshed
+	if rec := get(cookie(cookies, refreshCookie)); rec.Code != http.StatusSeeOther {
+		t.Fatalf("got %d, want a redirect", rec.Code)
+	}
+}
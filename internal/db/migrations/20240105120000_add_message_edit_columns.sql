@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+ALTER TABLE message ADD COLUMN edited_at timestamptz;
+ALTER TABLE message ADD COLUMN deleted_at timestamptz;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+ALTER TABLE message DROP COLUMN IF EXISTS edited_at;
+ALTER TABLE message DROP COLUMN IF EXISTS deleted_at;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+ALTER TABLE room_user ADD COLUMN last_read_at timestamptz;
+CREATE INDEX message_room_id_time_idx ON message(room_id, time);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+DROP INDEX IF EXISTS message_room_id_time_idx;
+ALTER TABLE room_user DROP COLUMN IF EXISTS last_read_at;
+-- +goose StatementEnd
@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+ALTER TABLE room_user ADD COLUMN role varchar NOT NULL DEFAULT 'member';
+UPDATE room_user SET role = 'owner'
+  FROM room
+  WHERE room.id = room_user.room_id AND room.creator_id = room_user.user_id;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+ALTER TABLE room_user DROP COLUMN IF EXISTS role;
+-- +goose StatementEnd
@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+ALTER TABLE room ADD COLUMN visibility varchar NOT NULL DEFAULT 'public';
+CREATE TABLE room_invite (
+    id uuid PRIMARY KEY,
+    room_id uuid NOT NULL,
+    created_by uuid NOT NULL,
+    expires_at timestamptz NOT NULL,
+    single_use boolean NOT NULL DEFAULT false,
+    used_at timestamptz,
+    CONSTRAINT fk_room FOREIGN KEY(room_id) REFERENCES room(id) ON DELETE CASCADE,
+    CONSTRAINT fk_user FOREIGN KEY(created_by) REFERENCES "user"(id)
+);
+CREATE TABLE room_join_request (
+    room_id uuid,
+    user_id uuid,
+    time timestamptz NOT NULL,
+    PRIMARY KEY(room_id, user_id),
+    CONSTRAINT fk_room FOREIGN KEY(room_id) REFERENCES room(id) ON DELETE CASCADE,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES "user"(id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+DROP TABLE IF EXISTS room_join_request;
+DROP TABLE IF EXISTS room_invite;
+ALTER TABLE room DROP COLUMN IF EXISTS visibility;
+-- +goose StatementEnd
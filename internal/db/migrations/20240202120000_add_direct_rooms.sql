@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+ALTER TABLE room ADD COLUMN kind varchar NOT NULL DEFAULT 'group';
+ALTER TABLE room ADD COLUMN dm_key varchar UNIQUE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+ALTER TABLE room DROP COLUMN IF EXISTS dm_key;
+ALTER TABLE room DROP COLUMN IF EXISTS kind;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+ALTER TABLE message ADD COLUMN parent_id uuid REFERENCES message(id);
+CREATE INDEX message_parent_id_idx ON message(parent_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+DROP INDEX IF EXISTS message_parent_id_idx;
+ALTER TABLE message DROP COLUMN IF EXISTS parent_id;
+-- +goose StatementEnd
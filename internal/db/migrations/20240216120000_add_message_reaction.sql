@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+CREATE TABLE message_reaction (
+    message_id uuid,
+    user_id uuid,
+    emoji varchar(32),
+    time timestamptz NOT NULL,
+    PRIMARY KEY(message_id, user_id, emoji),
+    CONSTRAINT fk_message FOREIGN KEY(message_id) REFERENCES message(id) ON DELETE CASCADE,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES "user"(id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+DROP TABLE IF EXISTS message_reaction;
+-- +goose StatementEnd
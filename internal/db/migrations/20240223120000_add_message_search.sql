@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+ALTER TABLE message ADD COLUMN search tsvector GENERATED ALWAYS AS (to_tsvector('english', msg)) STORED;
+CREATE INDEX message_search_idx ON message USING GIN(search);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+DROP INDEX IF EXISTS message_search_idx;
+ALTER TABLE message DROP COLUMN IF EXISTS search;
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+CREATE TABLE attachment (
+    id uuid PRIMARY KEY,
+    room_id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    message_id uuid UNIQUE,
+    filename varchar NOT NULL,
+    content_type varchar NOT NULL,
+    size bigint NOT NULL,
+    time timestamptz NOT NULL,
+    CONSTRAINT fk_room FOREIGN KEY(room_id) REFERENCES room(id) ON DELETE CASCADE,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES "user"(id),
+    CONSTRAINT fk_message FOREIGN KEY(message_id) REFERENCES message(id) ON DELETE CASCADE
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+DROP TABLE IF EXISTS attachment;
+-- +goose StatementEnd
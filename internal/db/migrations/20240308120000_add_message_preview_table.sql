@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+CREATE TABLE message_preview (
+    message_id uuid PRIMARY KEY,
+    url varchar NOT NULL,
+    title varchar NOT NULL,
+    description varchar NOT NULL DEFAULT '',
+    site_name varchar NOT NULL DEFAULT '',
+    CONSTRAINT fk_message FOREIGN KEY(message_id) REFERENCES message(id) ON DELETE CASCADE
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+DROP TABLE IF EXISTS message_preview;
+-- +goose StatementEnd
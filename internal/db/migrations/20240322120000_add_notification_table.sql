@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+CREATE TABLE notification (
+    id uuid PRIMARY KEY,
+    user_id uuid NOT NULL,
+    kind varchar NOT NULL,
+    room_id uuid NOT NULL,
+    room_name varchar NOT NULL DEFAULT '',
+    actor varchar NOT NULL DEFAULT '',
+    message_id uuid,
+    body varchar NOT NULL DEFAULT '',
+    time timestamptz NOT NULL,
+    read_at timestamptz,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES "user"(id)
+);
+CREATE INDEX notification_user_id_time_idx ON notification(user_id, time);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+DROP TABLE IF EXISTS notification;
+-- +goose StatementEnd
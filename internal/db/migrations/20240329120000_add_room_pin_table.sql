@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+CREATE TABLE room_pin (
+    room_id uuid,
+    message_id uuid,
+    pinned_by uuid NOT NULL,
+    time timestamptz NOT NULL,
+    PRIMARY KEY(room_id, message_id),
+    CONSTRAINT fk_room FOREIGN KEY(room_id) REFERENCES room(id) ON DELETE CASCADE,
+    CONSTRAINT fk_message FOREIGN KEY(message_id) REFERENCES message(id) ON DELETE CASCADE,
+    CONSTRAINT fk_user FOREIGN KEY(pinned_by) REFERENCES "user"(id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+DROP TABLE IF EXISTS room_pin;
+-- +goose StatementEnd
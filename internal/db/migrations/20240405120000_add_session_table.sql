@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+CREATE TABLE session (
+    id uuid PRIMARY KEY,
+    user_id uuid NOT NULL,
+    refresh_hash bytea NOT NULL,
+    prev_hash bytea,
+    rotated_at timestamptz NOT NULL,
+    user_agent varchar NOT NULL,
+    ip varchar NOT NULL,
+    created_at timestamptz NOT NULL,
+    last_seen_at timestamptz NOT NULL,
+    expires_at timestamptz NOT NULL,
+    revoked_at timestamptz,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES "user"(id) ON DELETE CASCADE
+);
+CREATE INDEX session_user_id_idx ON session(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+DROP TABLE IF EXISTS session;
+-- +goose StatementEnd
@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+-- signup lowercases emails, older rows are brought in line first
+UPDATE "user" SET email = lower(trim(email)) WHERE email <> lower(trim(email));
+-- the first row (by id) keeps a username taken more than once whatever its
+-- case, the others are renamed after their id, which is unique and fits the
+-- 32 characters of a username
+UPDATE "user" u SET username = replace(u.id::text, '-', '')
+FROM (SELECT id, row_number() OVER (PARTITION BY lower(username) ORDER BY id) AS n FROM "user") d
+WHERE u.id = d.id AND d.n > 1;
+-- and the duplicated emails are replaced by undeliverable addresses
+UPDATE "user" u SET email = u.id::text || '@duplicate.invalid'
+FROM (SELECT id, row_number() OVER (PARTITION BY email ORDER BY id) AS n FROM "user") d
+WHERE u.id = d.id AND d.n > 1;
+-- usernames keep the case they were signed up with, but "Alice" and "alice"
+-- are the same user
+CREATE UNIQUE INDEX user_username_key ON "user" (lower(username));
+ALTER TABLE "user" ADD CONSTRAINT user_email_key UNIQUE (email);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+ALTER TABLE "user" DROP CONSTRAINT IF EXISTS user_email_key;
+DROP INDEX IF EXISTS user_username_key;
+-- +goose StatementEnd
@@ -0,0 +1,36 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+CREATE TABLE login_failure (
+    username varchar PRIMARY KEY,
+    failures integer NOT NULL,
+    locked_until timestamptz,
+    updated_at timestamptz NOT NULL
+);
+CREATE TABLE login_attempt (
+    id uuid PRIMARY KEY,
+    username varchar NOT NULL,
+    user_id uuid,
+    ip varchar NOT NULL,
+    user_agent varchar NOT NULL,
+    reason varchar NOT NULL,
+    time timestamptz NOT NULL,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES "user"(id) ON DELETE SET NULL
+);
+CREATE INDEX login_attempt_username_time_idx ON login_attempt(username, time);
+CREATE INDEX login_attempt_time_idx ON login_attempt(time);
+CREATE TABLE login_bucket (
+    key varchar PRIMARY KEY,
+    tokens double precision NOT NULL,
+    updated_at timestamptz NOT NULL
+);
+CREATE INDEX login_bucket_updated_at_idx ON login_bucket(updated_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+DROP TABLE IF EXISTS login_bucket;
+DROP TABLE IF EXISTS login_attempt;
+DROP TABLE IF EXISTS login_failure;
+-- +goose StatementEnd
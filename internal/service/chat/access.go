@@ -0,0 +1,155 @@
+package chat
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/brianaung/rtm/internal/auth"
+	"github.com/gofrs/uuid/v5"
+)
+
+// Visibility decides how users get into a room.
+type Visibility string
+
+const (
+	// VisibilityPublic rooms can be joined by anyone who knows their id.
+	VisibilityPublic Visibility = "public"
+	// VisibilityInvite rooms can only be joined with an invite link.
+	VisibilityInvite Visibility = "invite"
+	// VisibilityApproval rooms queue join requests until the owner approves
+	// them. Invite links still let users in directly.
+	VisibilityApproval Visibility = "approval"
+)
+
+func (v Visibility) valid() bool {
+	return v == VisibilityPublic || v == VisibilityInvite || v == VisibilityApproval
+}
+
+// inviteTTLs are the lifetimes an invite link can be created with.
+var inviteTTLs = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+}
+
+var (
+	errInvalidVisibility = errors.New("Invalid visibility.")
+	errInvalidInvite     = errors.New("This invite is invalid or has expired.")
+	errInviteOnly        = errors.New("This room is invite only.")
+	errAlreadyMember     = errors.New("You are already in the room.")
+	errAlreadyRequested  = errors.New("You already asked to join the room.")
+	errNoJoinRequest     = errors.New("There is no such join request.")
+)
+
+// =================================== Invite tokens ===================================
+// An invite token carries the invite id, its room and its expiry, signed with
+// the server secret. Forged or expired tokens are rejected without a lookup,
+// the store still has the last word as invites can be used up.
+
+// inviteToken encodes an invite into an opaque url safe token.
+func inviteToken(a *auth.Auth, inv *Invite) string {
+	payload := make([]byte, 0, 40)
+	payload = append(payload, inv.ID[:]...)
+	payload = append(payload, inv.RoomID[:]...)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(inv.ExpiresAt.Unix()))
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(a.Sign(payload))
+}
+
+// parseInviteToken checks the signature and expiry of a token created by
+// inviteToken, and returns the invite id and room id it carries.
+func parseInviteToken(a *auth.Auth, token string, now time.Time) (uuid.UUID, uuid.UUID, error) {
+	p, s, ok := strings.Cut(token, ".")
+	if !ok {
+		return uuid.Nil, uuid.Nil, errInvalidInvite
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil || len(payload) != 40 {
+		return uuid.Nil, uuid.Nil, errInvalidInvite
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || !a.Verify(payload, sig) {
+		return uuid.Nil, uuid.Nil, errInvalidInvite
+	}
+	if now.Unix() >= int64(binary.BigEndian.Uint64(payload[32:])) {
+		return uuid.Nil, uuid.Nil, errInvalidInvite
+	}
+	return uuid.Must(uuid.FromBytes(payload[:16])), uuid.Must(uuid.FromBytes(payload[16:32])), nil
+}
+
+// =================================== Joining rooms ===================================
+
+// setVisibility changes how users get into a room.
+func setVisibility(ctx context.Context, rooms RoomStore, uid uuid.UUID, rid uuid.UUID, v Visibility) error {
+	if !v.valid() {
+		return errInvalidVisibility
+	}
+	if _, err := authorize(ctx, rooms, rid, uid, permManageAccess); err != nil {
+		return err
+	}
+	return rooms.SetVisibility(ctx, rid, v)
+}
+
+// createInvite creates an invite to a room, valid for ttl and optionally
+// usable only once.
+func createInvite(ctx context.Context, rooms RoomStore, uid uuid.UUID, rid uuid.UUID, ttl time.Duration, singleUse bool) (*Invite, error) {
+	if _, err := authorize(ctx, rooms, rid, uid, permManageAccess); err != nil {
+		return nil, err
+	}
+	inv := &Invite{
+		ID:        uuid.Must(uuid.NewV4()),
+		RoomID:    rid,
+		CreatedBy: uid,
+		ExpiresAt: time.Now().Add(ttl).Truncate(time.Second),
+		SingleUse: singleUse,
+	}
+	return inv, rooms.CreateInvite(ctx, inv)
+}
+
+// redeemInvite adds uid to the room of an invite, and returns the invite.
+// Members following an invite to their own room are let through without
+// using it up, the invite is nil then.
+func redeemInvite(ctx context.Context, rooms RoomStore, uid uuid.UUID, id uuid.UUID, rid uuid.UUID) (*Invite, error) {
+	if isMember, err := rooms.IsAMember(ctx, &RoomUser{RoomID: rid, UserID: uid}); err != nil || isMember {
+		return nil, err
+	}
+	inv, err := rooms.RedeemInvite(ctx, id, &RoomUser{RoomID: rid, UserID: uid}, time.Now())
+	if errors.Is(err, errNotFound) {
+		return nil, errInvalidInvite
+	} else if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// requestJoin queues a request from a user to join an approval-required room,
+// and shows it to the clients of the room who can approve it.
+func requestJoin(ctx context.Context, rooms RoomStore, h *hub, uid uuid.UUID, username string, rid uuid.UUID) error {
+	jr := &JoinRequest{RoomID: rid, UserID: uid, Username: username, Time: time.Now()}
+	if err := rooms.AddJoinRequest(ctx, jr); errors.Is(err, errDuplicate) {
+		return errAlreadyRequested
+	} else if err != nil {
+		return err
+	}
+	return h.publish(ctx, &message{kind: messageJoinRequested, roomID: rid, userID: uid, username: username, time: jr.Time})
+}
+
+// resolveJoin approves or rejects the request of target to join a room.
+func resolveJoin(ctx context.Context, rooms RoomStore, h *hub, uid uuid.UUID, rid uuid.UUID, target uuid.UUID, approve bool) error {
+	if _, err := authorize(ctx, rooms, rid, uid, permManageAccess); err != nil {
+		return err
+	}
+	resolve := rooms.RejectJoinRequest
+	if approve {
+		resolve = rooms.ApproveJoinRequest
+	}
+	if err := resolve(ctx, &RoomUser{RoomID: rid, UserID: target}); errors.Is(err, errNotFound) {
+		return errNoJoinRequest
+	} else if err != nil {
+		return err
+	}
+	return h.publish(ctx, &message{kind: messageJoinResolved, roomID: rid, userID: target})
+}
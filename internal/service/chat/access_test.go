@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianaung/rtm/internal/auth"
+	"github.com/gofrs/uuid/v5"
+)
+
+func TestParseInviteToken(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test secret")
+	a := auth.Init(nil)
+	t.Setenv("JWT_SECRET", "another secret")
+	other := auth.Init(nil)
+
+	now := time.Now()
+	inv := &Invite{ID: uuid.Must(uuid.NewV4()), RoomID: uuid.Must(uuid.NewV4()), ExpiresAt: now.Add(time.Hour)}
+	token := inviteToken(a, inv)
+	p, sig, _ := strings.Cut(token, ".")
+	// the room of another invite, with the signature of this one
+	forged := &Invite{ID: inv.ID, RoomID: uuid.Must(uuid.NewV4()), ExpiresAt: inv.ExpiresAt}
+	fp, _, _ := strings.Cut(inviteToken(a, forged), ".")
+
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+		ok    bool
+	}{
+		{"valid", token, now, true},
+		{"expired", token, inv.ExpiresAt, false},
+		{"empty", "", now, false},
+		{"no signature", p, now, false},
+		{"bad base64", "!!." + sig, now, false},
+		{"short payload", base64.RawURLEncoding.EncodeToString([]byte("short")) + "." + sig, now, false},
+		{"swapped room", fp + "." + sig, now, false},
+		{"other secret", inviteToken(other, inv), now, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, rid, err := parseInviteToken(a, tt.token, tt.now)
+			if !tt.ok {
+				if err != errInvalidInvite {
+					t.Fatalf("got %v, want errInvalidInvite", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != inv.ID || rid != inv.RoomID {
+				t.Fatalf("got invite %v of room %v, want %v of %v", id, rid, inv.ID, inv.RoomID)
+			}
+		})
+	}
+}
+
+func TestJoinInviteOnlyRoom(t *testing.T) {
+	e := newTestEnv(t)
+	alice, bob := e.login("alice"), e.login("bob")
+	rid := e.createRoom(alice, "secret")
+	if rec := e.do(alice, http.MethodPut, "/room/"+rid.String()+"/visibility", url.Values{"visibility": {"invite"}}); rec.Code != http.StatusOK {
+		t.Fatalf("set visibility: got %d %q", rec.Code, rec.Body)
+	}
+	if rec := e.do(bob, http.MethodPut, "/join", url.Values{"rid": {rid.String()}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("join without an invite: got %d, want 403", rec.Code)
+	}
+}
+
+func TestInviteLinkIgnoresHost(t *testing.T) {
+	e := newTestEnv(t)
+	alice := e.login("alice")
+	rid := e.createRoom(alice, "general")
+	path := "/room/" + rid.String() + "/invites"
+
+	// the test requests are sent to the host example.com
+	rec := e.do(alice, http.MethodPost, path, url.Values{})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `value="/invite/`) || strings.Contains(rec.Body.String(), "example.com") {
+		t.Fatalf("got %d %q, want a relative link", rec.Code, rec.Body)
+	}
+	e.s.SetPublicURL("https://chat.example.org/")
+	rec = e.do(alice, http.MethodPost, path, url.Values{})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `value="https://chat.example.org/invite/`) {
+		t.Fatalf("got %d %q, want a link to the public url", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,179 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/brianaung/rtm/view"
+	"github.com/gofrs/uuid/v5"
+)
+
+// maxAttachmentSize is the largest file that can be uploaded, in bytes.
+const maxAttachmentSize = 10 << 20
+
+var (
+	errNoFile             = errors.New("No file was uploaded.")
+	errAttachmentTooLarge = errors.New("Attachments cannot be larger than 10MB.")
+	errInvalidAttachment  = errors.New("Invalid attachment.")
+)
+
+// previewTypes are the images shown inline in the chat log. SVG is left out as
+// it can carry scripts.
+var previewTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+func (a *Attachment) image() bool {
+	return previewTypes[a.ContentType]
+}
+
+// saveAttachment stores a file uploaded by uid to the room rid. The attachment
+// is not part of any message until one is sent with its id.
+//
+// The content type is sniffed from the content rather than trusted from the
+// client, as it decides whether the file is shown inline.
+func saveAttachment(ctx context.Context, messages MessageStore, blobs BlobStore, uid uuid.UUID, rid uuid.UUID, filename string, r io.Reader) (*Attachment, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errNoFile
+	}
+	a := &Attachment{
+		ID:          uuid.Must(uuid.NewV4()),
+		RoomID:      rid,
+		UserID:      uid,
+		Filename:    cleanFilename(filename),
+		ContentType: http.DetectContentType(head[:n]),
+		Time:        time.Now(),
+	}
+	// read one byte past the limit to tell a file of exactly the limit from
+	// a larger one
+	cr := &countingReader{r: io.MultiReader(bytes.NewReader(head[:n]), io.LimitReader(r, maxAttachmentSize+1-int64(n)))}
+	if err := blobs.Put(ctx, a.ID.String(), cr); err != nil {
+		return nil, err
+	}
+	if cr.n > maxAttachmentSize {
+		blobs.Delete(ctx, a.ID.String())
+		return nil, errAttachmentTooLarge
+	}
+	a.Size = cr.n
+	if err := messages.AddAttachment(ctx, a); err != nil {
+		blobs.Delete(ctx, a.ID.String())
+		return nil, err
+	}
+	return a, nil
+}
+
+// roomAttachment fetches an attachment of the room rid that uid may download:
+// one of a live message, or one they uploaded and did not send yet.
+func roomAttachment(ctx context.Context, messages MessageStore, rooms RoomStore, uid uuid.UUID, rid uuid.UUID, aid uuid.UUID) (*Attachment, error) {
+	if isMember, err := rooms.IsAMember(ctx, &RoomUser{RoomID: rid, UserID: uid}); err != nil {
+		return nil, err
+	} else if !isMember {
+		return nil, errNoAccess
+	}
+	a, err := messages.GetAttachment(ctx, aid)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil || a.RoomID != rid {
+		return nil, errNotFound
+	}
+	if a.MessageID == nil {
+		if a.UserID != uid {
+			return nil, errNotFound
+		}
+		return a, nil
+	}
+	if _, err := roomMessage(ctx, messages, rid, *a.MessageID); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// cleanFilename keeps the base name of an uploaded file, without control
+// characters, for display and for the Content-Disposition of downloads.
+func cleanFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filepath.Base(strings.ReplaceAll(name, `\`, "/")))
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == "/" {
+		return "attachment"
+	}
+	if len(name) > 255 {
+		name = strings.ToValidUTF8(name[:255], "")
+	}
+	return name
+}
+
+// attachmentDisplay formats an attachment for the html templates, it returns
+// nil if there is none.
+func attachmentDisplay(a *Attachment) *view.AttachmentDisplayData {
+	if a == nil {
+		return nil
+	}
+	return &view.AttachmentDisplayData{
+		ID:       a.ID,
+		Filename: a.Filename,
+		Size:     formatSize(a.Size),
+		Image:    a.image(),
+	}
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n < 1<<10:
+		return fmt.Sprintf("%d B", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// deleteRoom deletes a room with everything in it, the blobs of its
+// attachments included. The room is gone once the store deleted it, the blobs
+// that fail to be deleted are only logged.
+func deleteRoom(ctx context.Context, rooms RoomStore, blobs BlobStore, rid uuid.UUID) error {
+	attachments, err := rooms.DeleteRoom(ctx, rid)
+	if err != nil {
+		return err
+	}
+	for _, aid := range attachments {
+		if err := blobs.Delete(ctx, aid.String()); err != nil {
+			log.Printf("error: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Backplane fans out broadcasts to the hubs of every rtm node.
+//
+// A hub publishes every message it accepts from its clients to the backplane,
+// and delivers whatever it receives from Subscribe to its own clients. This way
+// clients connected to different nodes behind a load balancer see each other.
+type Backplane interface {
+	Publish(ctx context.Context, payload []byte) error
+	Subscribe() <-chan []byte
+	Close() error
+}
+
+// wireMessage is the serialised form of a message sent through the backplane.
+// Reactions are left out, the receiving hubs load them, see hub.receive.
+type wireMessage struct {
+	Kind         messageKind   `json:"kind"`
+	ID           uuid.UUID     `json:"id"`
+	RoomID       uuid.UUID     `json:"room_id"`
+	UserID       uuid.UUID     `json:"user_id"`
+	Username     string        `json:"username"`
+	Body         string        `json:"body"`
+	Time         time.Time     `json:"time"`
+	Node         uuid.UUID     `json:"node,omitempty"`
+	Members      []Member      `json:"members,omitempty"`
+	Parent       uuid.UUID     `json:"parent"`
+	Replies      int           `json:"replies,omitempty"`
+	Attachment   *Attachment   `json:"attachment,omitempty"`
+	Preview      *LinkPreview  `json:"preview,omitempty"`
+	Notification *Notification `json:"notification,omitempty"`
+	Unread       int           `json:"unread,omitempty"`
+	Pins         []*Pin        `json:"pins,omitempty"`
+}
+
+func encodeMessage(m *message) ([]byte, error) {
+	return json.Marshal(&wireMessage{
+		Kind:         m.kind,
+		ID:           m.id,
+		RoomID:       m.roomID,
+		UserID:       m.userID,
+		Username:     m.username,
+		Body:         m.body,
+		Time:         m.time,
+		Node:         m.node,
+		Members:      m.members,
+		Parent:       m.parent,
+		Replies:      m.replies,
+		Attachment:   m.attachment,
+		Preview:      m.preview,
+		Notification: m.notification,
+		Unread:       m.unread,
+		Pins:         m.pins,
+	})
+}
+
+func decodeMessage(payload []byte) (*message, error) {
+	w := &wireMessage{}
+	if err := json.Unmarshal(payload, w); err != nil {
+		return nil, err
+	}
+	return &message{
+		kind:         w.Kind,
+		id:           w.ID,
+		roomID:       w.RoomID,
+		userID:       w.UserID,
+		username:     w.Username,
+		body:         w.Body,
+		time:         w.Time,
+		node:         w.Node,
+		members:      w.Members,
+		parent:       w.Parent,
+		replies:      w.Replies,
+		attachment:   w.Attachment,
+		preview:      w.Preview,
+		notification: w.Notification,
+		unread:       w.Unread,
+		pins:         w.Pins,
+	}, nil
+}
+
+// =================================== In-process backplane ===================================
+// localBackplane only delivers to the hub of the current process. It is the
+// default for a single node deployment.
+type localBackplane struct {
+	ch        chan []byte
+	closeOnce sync.Once
+}
+
+func NewLocalBackplane() *localBackplane {
+	return &localBackplane{ch: make(chan []byte, 256)}
+}
+
+func (b *localBackplane) Publish(ctx context.Context, payload []byte) error {
+	select {
+	case b.ch <- payload:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *localBackplane) Subscribe() <-chan []byte {
+	return b.ch
+}
+
+func (b *localBackplane) Close() error {
+	b.closeOnce.Do(func() { close(b.ch) })
+	return nil
+}
+
+// =================================== Postgres LISTEN/NOTIFY backplane ===================================
+// pgChannel is the postgres notification channel shared by every node.
+const pgChannel = "rtm_chat"
+
+const (
+	// maxNotifyPayload is the largest payload postgres accepts in a
+	// notification, which must be shorter than 8000 bytes.
+	maxNotifyPayload = 7999
+	// spilledPrefix starts the notifications of payloads too large to be
+	// notified, followed by the id of the row holding the payload. Encoded
+	// messages are json objects, so they never start with it.
+	spilledPrefix = "@"
+	// spilledTTL is how long spilled payloads are kept for the nodes to
+	// fetch them.
+	spilledTTL = time.Minute
+)
+
+// pgBackplane uses postgres LISTEN/NOTIFY to fan out broadcasts.
+//
+// Publishing is a pg_notify on any connection of the pool. A single connection
+// is taken out of the pool for the lifetime of the backplane to LISTEN on the
+// channel, and it is re-acquired if the connection is lost. Postgres also
+// notifies the publishing session, so a node receives its own messages the
+// same way as those from other nodes.
+//
+// Payloads too large for a notification are spilled to the backplane_payload
+// table, and only the id of their row is notified. The listening nodes fetch
+// the payload back, see pgNotify and pgResolve.
+type pgBackplane struct {
+	db     *pgxpool.Pool
+	ch     chan []byte
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewPgBackplane(db *pgxpool.Pool) *pgBackplane {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &pgBackplane{db: db, ch: make(chan []byte, 256), cancel: cancel, done: make(chan struct{})}
+	go b.listen(ctx)
+	return b
+}
+
+func (b *pgBackplane) Publish(ctx context.Context, payload []byte) error {
+	return pgNotify(ctx, b.db, payload)
+}
+
+func (b *pgBackplane) Subscribe() <-chan []byte {
+	return b.ch
+}
+
+func (b *pgBackplane) Close() error {
+	b.cancel()
+	<-b.done
+	return nil
+}
+
+// listen keeps a LISTEN session open until the backplane is closed, retrying
+// with a capped backoff when the connection fails.
+func (b *pgBackplane) listen(ctx context.Context) {
+	defer func() {
+		close(b.ch)
+		close(b.done)
+	}()
+	backoff := time.Second
+	for {
+		err := b.listenOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("backplane: listen failed, retrying in %v: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (b *pgBackplane) listenOnce(ctx context.Context) error {
+	pc, err := b.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// the listening session is never handed back to the pool
+	conn := pc.Hijack()
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, `listen `+pgChannel); err != nil {
+		return err
+	}
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		payload, err := pgResolve(ctx, conn, n.Payload)
+		if errors.Is(err, pgx.ErrNoRows) {
+			// expired before we got to it, only this message is lost
+			log.Printf("backplane: spilled payload %s is gone", n.Payload)
+			continue
+		} else if err != nil {
+			return err
+		}
+		select {
+		case b.ch <- payload:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// pgQuerier is the part of a postgres pool or connection used to notify and
+// resolve payloads.
+type pgQuerier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// pgNotify sends a payload on the channel, spilling it to the backplane_payload
+// table when it is too large for a notification. Spilled payloads older than
+// spilledTTL are cleaned up along the way.
+func pgNotify(ctx context.Context, db pgQuerier, payload []byte) error {
+	if len(payload) <= maxNotifyPayload {
+		_, err := db.Exec(ctx, `select pg_notify($1, $2)`, pgChannel, string(payload))
+		return err
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(ctx, `delete from backplane_payload where created_at < now() - make_interval(secs => $1)`, spilledTTL.Seconds()); err != nil {
+		return err
+	}
+	if _, err := db.Exec(ctx, `insert into backplane_payload(id, payload) values($1, $2)`, id, string(payload)); err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, `select pg_notify($1, $2)`, pgChannel, spilledPrefix+id.String())
+	return err
+}
+
+// pgResolve returns the payload of a notification, fetching it back from the
+// backplane_payload table if it was spilled.
+func pgResolve(ctx context.Context, db pgQuerier, notification string) ([]byte, error) {
+	ref, spilled := strings.CutPrefix(notification, spilledPrefix)
+	if !spilled {
+		return []byte(notification), nil
+	}
+	id, err := uuid.FromString(ref)
+	if err != nil {
+		return nil, err
+	}
+	var payload string
+	if err := db.QueryRow(ctx, `select payload from backplane_payload where id = $1`, id).Scan(&payload); err != nil {
+		return nil, err
+	}
+	return []byte(payload), nil
+}
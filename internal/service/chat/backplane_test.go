@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// fakePg records the notifications and keeps the spilled payloads of a
+// pgBackplane, like postgres would.
+type fakePg struct {
+	notified []string
+	spilled  map[uuid.UUID]string
+}
+
+func (db *fakePg) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	switch {
+	case strings.Contains(sql, "pg_notify"):
+		payload := args[1].(string)
+		if len(payload) >= 8000 {
+			return pgconn.CommandTag{}, &pgconn.PgError{Code: "22023", Message: "payload string too long"}
+		}
+		db.notified = append(db.notified, payload)
+	case strings.HasPrefix(sql, "insert into backplane_payload"):
+		db.spilled[args[0].(uuid.UUID)] = args[1].(string)
+	}
+	return pgconn.CommandTag{}, nil
+}
+
+func (db *fakePg) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	payload, ok := db.spilled[args[0].(uuid.UUID)]
+	return fakeRow{payload, ok}
+}
+
+type fakeRow struct {
+	payload string
+	ok      bool
+}
+
+func (r fakeRow) Scan(dest ...any) error {
+	if !r.ok {
+		return pgx.ErrNoRows
+	}
+	*dest[0].(*string) = r.payload
+	return nil
+}
+
+func TestPgBackplaneLargePayload(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		body    string
+		spilled bool
+	}{
+		{"small", "hi", false},
+		{"just fits", strings.Repeat("a", maxNotifyPayload-500), false},
+		{"over the limit", strings.Repeat("a", 8000), true},
+		{"far over the limit", strings.Repeat("é", 50000), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &fakePg{spilled: make(map[uuid.UUID]string)}
+			m := &message{kind: messageNew, id: uuid.Must(uuid.NewV4()), roomID: uuid.Must(uuid.NewV4()), body: tt.body}
+			payload, err := encodeMessage(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := pgNotify(ctx, db, payload); err != nil {
+				t.Fatalf("publish %d bytes: %v", len(payload), err)
+			}
+			if len(db.notified) != 1 {
+				t.Fatalf("got %d notifications, want 1", len(db.notified))
+			}
+			if spilled := len(db.spilled) == 1; spilled != tt.spilled {
+				t.Fatalf("spilled = %v, want %v", spilled, tt.spilled)
+			}
+
+			resolved, err := pgResolve(ctx, db, db.notified[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeMessage(resolved)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.id != m.id || got.body != m.body {
+				t.Fatalf("got message %v with a %d byte body, want %v with %d bytes", got.id, len(got.body), m.id, len(m.body))
+			}
+		})
+	}
+}
+
+func TestPgResolveExpiredPayload(t *testing.T) {
+	db := &fakePg{spilled: make(map[uuid.UUID]string)}
+	if _, err := pgResolve(context.Background(), db, spilledPrefix+uuid.Must(uuid.NewV4()).String()); err != pgx.ErrNoRows {
+		t.Fatalf("got %v, want pgx.ErrNoRows", err)
+	}
+}
@@ -0,0 +1,94 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobStore keeps the content of attachments, while their metadata lives in
+// the MessageStore.
+//
+// Blobs are addressed by opaque keys chosen by the caller. The local
+// filesystem is the only implementation for now, an S3 compatible store only
+// has to map the keys to objects of a bucket.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns errNotFound if there is no blob with this key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var errInvalidBlobKey = errors.New("invalid blob key")
+
+// =================================== Local filesystem ===================================
+// localBlobStore keeps every blob in a file named after its key, in a single
+// directory. It is only suitable for a single node deployment, or with the
+// directory on a shared volume.
+type localBlobStore struct {
+	dir string
+}
+
+func NewLocalBlobStore(dir string) (*localBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &localBlobStore{dir: dir}, nil
+}
+
+// path maps a key to its file, refusing keys that would escape the directory.
+func (b *localBlobStore) path(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", errInvalidBlobKey
+	}
+	return filepath.Join(b.dir, key), nil
+}
+
+// Put writes the blob to a temporary file first, so that a failed upload
+// never leaves a partial blob behind.
+func (b *localBlobStore) Put(ctx context.Context, key string, r io.Reader) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(b.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (b *localBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errNotFound
+	}
+	return f, err
+}
+
+func (b *localBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -4,15 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/brianaung/rtm/view"
 	"github.com/gofrs/uuid/v5"
 	"github.com/gorilla/websocket"
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 const (
@@ -22,18 +23,41 @@ const (
 	pongWait = 60 * time.Second
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Maximum message size allowed from peer, room for a message of
+	// maxMessageLen characters in its event envelope.
+	maxMessageSize = 4*maxMessageLen + 512
+	// Check the session of a connection with this period, the connection is
+	// closed once the session is revoked.
+	sessionCheckPeriod = time.Minute
 )
 
-var (
-	newline = []byte{'\n'}
-	space   = []byte{' '}
-)
+func newUpgrader(origins []string) websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     checkOrigin(origins),
+	}
+}
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// checkOrigin accepts the websocket handshakes from the pages of the server
+// itself, or of the origins allowed. Clients that are not browsers may leave
+// the Origin header out.
+func checkOrigin(origins []string) func(r *http.Request) bool {
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		allowed[strings.ToLower(o)] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if allowed[strings.ToLower(origin)] {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
 }
 
 // client is a middleman between the websocket connection and the hub.
@@ -42,10 +66,26 @@ type client struct {
 	roomID   uuid.UUID
 	userID   uuid.UUID
 	username string
+	// Role of the user in the room, used to show the actions they may take.
+	// It is only touched by writePump once the client runs, the permissions
+	// are always checked against the store.
+	role Role
 	// The websocket connection.
 	conn *websocket.Conn
 	// Buffered channel of outbound messages.
 	send chan *message
+	// Buffered channel of outbound protocol frames addressed to this client only.
+	frames chan []byte
+	// Rooms shown by a dashboard client, which is not connected to a room.
+	watching []uuid.UUID
+	// Unread counts of the rooms shown by a dashboard client, only touched
+	// by writePump.
+	unread map[uuid.UUID]int
+	// sessionActive reports whether the session of the user is still
+	// active, it is checked every sessionCheck and the socket is closed once
+	// it is not. Nil skips the check.
+	sessionActive func() bool
+	sessionCheck  time.Duration
 }
 
 func newClient(hub *hub, rid uuid.UUID, uid uuid.UUID, uname string, conn *websocket.Conn) *client {
@@ -54,17 +94,37 @@ func newClient(hub *hub, rid uuid.UUID, uid uuid.UUID, uname string, conn *webso
 		roomID:   rid,
 		userID:   uid,
 		username: uname,
-		send:     make(chan *message),
+		send:     make(chan *message, 256),
+		frames:   make(chan []byte, 16),
 		conn:     conn,
 	}
 }
 
+// newDashboardClient creates a client for the dashboard of a user, which is
+// kept up to date with the unread counts of their rooms.
+func newDashboardClient(hub *hub, uid uuid.UUID, uname string, rooms []*Room, conn *websocket.Conn) *client {
+	c := newClient(hub, uuid.Nil, uid, uname, conn)
+	c.watching = make([]uuid.UUID, 0, len(rooms))
+	c.unread = make(map[uuid.UUID]int, len(rooms))
+	for _, r := range rooms {
+		c.watching = append(c.watching, r.ID)
+		c.unread[r.ID] = r.Unread
+	}
+	return c
+}
+
+// dashboard reports whether the client is a dashboard rather than a room.
+func (c *client) dashboard() bool {
+	return c.roomID == uuid.Nil
+}
+
 // readPump pumps messages from the websocket connection to the hub.
 //
 // The application runs readPump in a per-connection goroutine. The application
 // ensures that there is at most one reader on a connection by executing all
-// reads from this goroutine.
-func (c *client) readPump(r *http.Request, db *pgxpool.Pool) {
+// reads from this goroutine. Every frame is an event envelope which is
+// dispatched to the handler registered for its type.
+func (c *client) readPump(r *http.Request, ev *events) {
 	defer func() {
 		c.conn.Close()
 		c.hub.unregister <- c
@@ -80,25 +140,31 @@ func (c *client) readPump(r *http.Request, db *pgxpool.Pool) {
 			}
 			break
 		}
+		ev.dispatch(context.Background(), c, m)
+	}
+}
 
-		mid := uuid.Must(uuid.NewV4())
-
-		data := &struct {
-			Msg     string            `json:"msg"`
-			Headers map[string]string `json:"HEADERS"`
-		}{}
-		json.Unmarshal(m, data)
-		err = addMessageEntry(context.Background(), db, &Message{ID: mid, Msg: data.Msg, Time: time.Now(), RoomID: c.roomID, UserID: c.userID})
-		if err != nil {
-			log.Printf("error: %v", err)
-			break
-		}
-
-		m = bytes.TrimSpace(bytes.Replace(m, newline, space, -1))
-		c.hub.broadcast <- &message{body: data.Msg, roomID: c.roomID, userID: c.userID, username: c.username, time: time.Now()}
+// sendFrame queues a protocol frame for this client only. The frame is
+// dropped if the client is not keeping up.
+func (c *client) sendFrame(e *envelope) {
+	e.V = protocolVersion
+	frame, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return
+	}
+	select {
+	case c.frames <- frame:
+	default:
 	}
 }
 
+// reply sends an error frame in response to the request req.
+func (c *client) reply(req *envelope, err *eventError) {
+	payload, _ := json.Marshal(err)
+	c.sendFrame(&envelope{Type: "error", ID: req.ID, Payload: payload})
+}
+
 // writePump pumps messages from the hub to the websocket connection.
 //
 // A goroutine running writePump is started for each connection. The
@@ -110,6 +176,12 @@ func (c *client) writePump() {
 		ticker.Stop()
 		c.conn.Close()
 	}()
+	var check <-chan time.Time
+	if c.sessionActive != nil {
+		t := time.NewTicker(c.sessionCheck)
+		defer t.Stop()
+		check = t.C
+	}
 	for {
 		select {
 		case message, ok := <-c.send:
@@ -120,33 +192,20 @@ func (c *client) writePump() {
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
+			var buf bytes.Buffer
+			c.render(&buf, message)
+			if buf.Len() == 0 {
+				// nothing for this client, e.g. a join request it cannot approve
+				continue
 			}
 
-			time := message.time
-			formatted := fmt.Sprintf("%d/%02d/%02d %02d:%02d:%02d",
-				time.Year(), time.Month(), time.Day(),
-				time.Hour(), time.Minute(), time.Second())
-			view.MessageLog(view.MsgDisplayData{
-				RoomID:   message.roomID,
-				Username: message.username,
-				Msg:      message.body,
-				Time:     formatted,
-				Mine:     c.userID == message.userID,
-			}).Render(context.Background(), w)
-
-			// Add queued chat messages to the current websocket message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				// w.Write(newline)
-				// w.Write(<-c.send)
-				// t.Execute(w, newline)
-				// t.Execute(w, data.Msg)
+			if err := c.conn.WriteMessage(websocket.TextMessage, buf.Bytes()); err != nil {
+				return
 			}
 
-			if err := w.Close(); err != nil {
+		case frame := <-c.frames:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
 				return
 			}
 
@@ -155,6 +214,118 @@ func (c *client) writePump() {
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+
+		case <-check:
+			if !c.sessionActive() {
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session ended"))
+				return
+			}
+		}
+	}
+}
+
+// render writes the html fragment of a message from the hub, as seen by this client.
+func (c *client) render(w io.Writer, m *message) {
+	ctx := context.Background()
+	if c.dashboard() {
+		switch m.kind {
+		case messageRoomRenamed:
+			view.RoomName(m.roomID, m.body).Render(ctx, w)
+			return
+		case messageMention:
+			view.MentionNotice(mentionNotice(m), m.unread).Render(ctx, w)
+			return
+		case messageNew:
+			c.unread[m.roomID]++
+		case messageRead:
+			c.unread[m.roomID] = 0
+		}
+		view.UnreadBadge(m.roomID, c.unread[m.roomID]).Render(ctx, w)
+		return
+	}
+	switch m.kind {
+	case messageNew:
+		view.MessageLog(c.displayData(m)).Render(ctx, w)
+	case messageEdited, messageDeleted:
+		// replace the existing message element in place
+		view.MessageUpdate(c.displayData(m)).Render(ctx, w)
+		if m.kind == messageDeleted && m.parent != uuid.Nil {
+			view.ReplyCount(m.roomID, m.parent, m.replies).Render(ctx, w)
+		}
+	case messageReply:
+		view.ThreadReply(c.displayData(m)).Render(ctx, w)
+		view.ReplyCount(m.roomID, m.parent, m.replies).Render(ctx, w)
+	case messageReplyCount:
+		view.ReplyCount(m.roomID, m.id, m.replies).Render(ctx, w)
+	case messageMention:
+		view.MentionNotice(mentionNotice(m), m.unread).Render(ctx, w)
+	case messagePreview:
+		view.MessagePreview(m.id, previewDisplay(m.preview)).Render(ctx, w)
+	case messagePins:
+		view.PinnedMessages(m.roomID, pinsDisplay(m.pins), c.role.can(permPinMessage)).Render(ctx, w)
+	case messageReactions:
+		view.MessageReactions(m.roomID, m.id, summarizeReactions(m.reactions, c.userID)).Render(ctx, w)
+	case messageTyping:
+		// everyone typing but ourselves
+		names := make([]string, 0, len(m.typists))
+		for _, t := range m.typists {
+			if t.userID != c.userID {
+				names = append(names, t.username)
+			}
+		}
+		view.TypingStatus(names).Render(ctx, w)
+	case messageMemberLeft:
+		if m.userID == c.userID {
+			view.SystemMessage("You left the room.").Render(ctx, w)
+			return
+		}
+		view.SystemMessage(m.username+" left the room.").Render(ctx, w)
+		view.MemberRemoved(m.userID).Render(ctx, w)
+	case messageMemberKicked:
+		if m.userID == c.userID {
+			view.SystemMessage("You were removed from the room.").Render(ctx, w)
+			return
 		}
+		view.SystemMessage(m.username+" was removed from the room.").Render(ctx, w)
+		view.MemberRemoved(m.userID).Render(ctx, w)
+	case messageRoomDeleted:
+		view.SystemMessage("The room was deleted.").Render(ctx, w)
+	case messageRoomRenamed:
+		view.RoomName(m.roomID, m.body).Render(ctx, w)
+	case messageRoleChanged:
+		if m.userID == c.userID {
+			c.role = Role(m.body)
+		}
+		view.MemberRole(m.userID, m.body).Render(ctx, w)
+	case messageJoinRequested:
+		// only the ones who can approve it see the request
+		if c.role.can(permManageAccess) {
+			view.JoinRequestAdded(view.MemberDisplayData{UserID: m.userID, RoomID: m.roomID, Username: m.username}).Render(ctx, w)
+		}
+	case messageJoinResolved:
+		view.JoinRequestRemoved(m.userID).Render(ctx, w)
+	case messagePresence:
+		view.MemberPresence(view.MemberDisplayData{UserID: m.userID, Username: m.username, Online: m.online}).Render(ctx, w)
+	}
+}
+
+func (c *client) displayData(m *message) view.MsgDisplayData {
+	return view.MsgDisplayData{
+		ID:         m.id,
+		RoomID:     m.roomID,
+		Username:   m.username,
+		Msg:        m.body,
+		Time:       formatTime(m.time),
+		Mine:       c.userID == m.userID,
+		Edited:     m.kind == messageEdited,
+		Deleted:    m.kind == messageDeleted,
+		Moderate:   c.role.can(permModerate),
+		CanPin:     c.role.can(permPinMessage),
+		Reply:      m.parent != uuid.Nil,
+		Mentioned:  c.userID != m.userID && mentions(m.body, c.username),
+		Reactions:  summarizeReactions(m.reactions, c.userID),
+		Attachment: attachmentDisplay(m.attachment),
+		Preview:    previewDisplay(m.preview),
 	}
 }
@@ -0,0 +1,140 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/gorilla/websocket"
+)
+
+func TestReadPumpDispatchesEvents(t *testing.T) {
+	e := newTestEnv(t)
+	alice, bob := e.login("alice"), e.login("bob")
+	rid := e.createRoom(alice, "general")
+	if rec := e.do(bob, http.MethodPut, "/join", url.Values{"rid": {rid.String()}}); rec.Code != http.StatusOK {
+		t.Fatalf("join: got %d", rec.Code)
+	}
+	aconn := e.dial(alice, "/ws/chat/"+rid.String())
+	bconn := e.dial(bob, "/ws/chat/"+rid.String())
+
+	sendEvent(t, aconn, "ping", "1", nil)
+	readUntil(t, aconn, `"type":"pong","id":"1"`)
+
+	sendEvent(t, aconn, "message.send", "2", map[string]string{"msg": "hello bob"})
+	readUntil(t, bconn, "hello bob")
+	readUntil(t, aconn, "hello bob")
+
+	// the longest message fits in the read limit
+	long := strings.Repeat("é", maxMessageLen)
+	sendEvent(t, aconn, "message.send", "3", map[string]string{"msg": long})
+	readUntil(t, bconn, long)
+}
+
+func TestReadPumpRejectsBadFrames(t *testing.T) {
+	e := newTestEnv(t)
+	alice := e.login("alice")
+	rid := e.createRoom(alice, "general")
+	conn := e.dial(alice, "/ws/chat/"+rid.String())
+
+	tests := []struct {
+		name  string
+		frame string
+		code  string
+	}{
+		{"malformed", `{"v":`, "bad_request"},
+		{"wrong version", `{"v":2,"type":"ping","id":"v"}`, "unsupported_version"},
+		{"unknown type", `{"v":1,"type":"nope","id":"u"}`, "unknown_event"},
+		{"missing payload", `{"v":1,"type":"message.send","id":"p"}`, "bad_request"},
+		{"empty message", `{"v":1,"type":"message.send","id":"m","payload":{"msg":"  "}}`, "bad_request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(tt.frame)); err != nil {
+				t.Fatal(err)
+			}
+			frame := readUntil(t, conn, `"type":"error"`)
+			env := &envelope{}
+			if err := json.Unmarshal([]byte(frame), env); err != nil {
+				t.Fatal(err)
+			}
+			ee := &eventError{}
+			if err := json.Unmarshal(env.Payload, ee); err != nil {
+				t.Fatal(err)
+			}
+			if ee.Code != tt.code {
+				t.Fatalf("got %q, want %q", ee.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestServeWsNeedsMembership(t *testing.T) {
+	e := newTestEnv(t)
+	alice, bob := e.login("alice"), e.login("bob")
+	rid := e.createRoom(alice, "general")
+
+	conn, res, err := e.tryDial(bob, "/ws/chat/"+rid.String())
+	if err == nil {
+		conn.Close()
+		t.Fatal("outsider opened the room socket")
+	}
+	if res == nil || res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %v, want 400", res)
+	}
+}
+
+func TestDepartedMemberIsShutOut(t *testing.T) {
+	e := newTestEnv(t)
+	alice, bob := e.login("alice"), e.login("bob")
+	rid := e.createRoom(alice, "general")
+	if rec := e.do(bob, http.MethodPut, "/join", url.Values{"rid": {rid.String()}}); rec.Code != http.StatusOK {
+		t.Fatalf("join: got %d", rec.Code)
+	}
+	conn := e.dial(bob, "/ws/chat/"+rid.String())
+
+	if rec := e.do(bob, http.MethodPost, "/room/"+rid.String()+"/leave", nil); rec.Code != http.StatusOK {
+		t.Fatalf("leave: got %d", rec.Code)
+	}
+	readUntil(t, conn, "You left the room.")
+
+	if conn, _, err := e.tryDial(bob, "/ws/chat/"+rid.String()); err == nil {
+		conn.Close()
+		t.Fatal("departed member reconnected to the room")
+	}
+	// a client still connected, e.g. on a node that missed the leave
+	if _, err := sendMessage(context.Background(), e.store, e.store, e.s.hub, bob.ID, bob.Username, rid, "still here", uuid.Nil); !errors.Is(err, errNoAccess) {
+		t.Fatalf("got %v, want errNoAccess", err)
+	}
+}
+
+func TestRevokedSessionClosesSocket(t *testing.T) {
+	e := newTestEnv(t)
+	e.s.sessionCheck = 10 * time.Millisecond
+	alice := e.login("alice")
+	rid := e.createRoom(alice, "general")
+	conn := e.dial(alice, "/ws/chat/"+rid.String())
+
+	sessions, err := e.auth.Sessions(context.Background(), alice.ID)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("got %v %v, want a session", sessions, err)
+	}
+	if err := e.auth.RevokeSession(context.Background(), alice.ID, sessions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Fatalf("got %v, want the socket closed", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+// messagePageSize is the number of messages served per page of history.
+const messagePageSize = 50
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks a position in the message history of a room.
+//
+// Messages are paginated by keyset on (time, id), newest first, so a cursor
+// points at the last message of a page and the next page holds everything
+// strictly older than it.
+type Cursor struct {
+	Time time.Time
+	ID   uuid.UUID
+}
+
+// String encodes the cursor into an opaque url safe token.
+func (c *Cursor) String() string {
+	raw := strconv.FormatInt(c.Time.UnixNano(), 10) + "_" + c.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// cursorString encodes c, or returns an empty string if there is no cursor.
+func cursorString(c *Cursor) string {
+	if c == nil {
+		return ""
+	}
+	return c.String()
+}
+
+// parseCursor decodes a token created by Cursor.String.
+func parseCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	ts, id, ok := strings.Cut(string(raw), "_")
+	if !ok {
+		return nil, errInvalidCursor
+	}
+	nsec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	uid, err := uuid.FromString(id)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	return &Cursor{Time: time.Unix(0, nsec), ID: uid}, nil
+}
+
+// before reports whether the message at (t, id) comes after the cursor
+// in newest first order, i.e. it belongs to the next page.
+func (c *Cursor) before(t time.Time, id uuid.UUID) bool {
+	if c == nil {
+		return true
+	}
+	if !t.Equal(c.Time) {
+		return t.Before(c.Time)
+	}
+	return bytes.Compare(id[:], c.ID[:]) < 0
+}
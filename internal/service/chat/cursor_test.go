@@ -0,0 +1,110 @@
+package chat
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	c := &Cursor{Time: time.Unix(1700000000, 123456789), ID: uuid.Must(uuid.NewV4())}
+	got, err := parseCursor(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Time.Equal(c.Time) || got.ID != c.ID {
+		t.Fatalf("got %+v, want %+v", got, c)
+	}
+	if cursorString(nil) != "" {
+		t.Fatal("nil cursor is not empty")
+	}
+}
+
+func TestParseCursorRejectsGarbage(t *testing.T) {
+	enc := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"not base64", "!!!"},
+		{"no separator", enc("1700000000")},
+		{"bad time", enc("soon_" + uuid.Must(uuid.NewV4()).String())},
+		{"bad id", enc("1700000000_nope")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseCursor(tt.token); err != errInvalidCursor {
+				t.Fatalf("got %v, want errInvalidCursor", err)
+			}
+		})
+	}
+}
+
+func TestCursorBefore(t *testing.T) {
+	now := time.Now()
+	low, high := uuid.UUID{1}, uuid.UUID{2}
+	c := &Cursor{Time: now, ID: high}
+	tests := []struct {
+		name string
+		c    *Cursor
+		t    time.Time
+		id   uuid.UUID
+		want bool
+	}{
+		{"no cursor", nil, now, high, true},
+		{"older", c, now.Add(-time.Second), high, true},
+		{"newer", c, now.Add(time.Second), low, false},
+		{"same time lower id", c, now, low, true},
+		{"the cursor itself", c, now, high, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.before(tt.t, tt.id); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessagePagesDoNotOverlap(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemStore(nil)
+	rid, uid := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	if err := s.CreateRoomWithCreator(ctx, &Room{ID: rid, Name: "general", CreatorID: uid}); err != nil {
+		t.Fatal(err)
+	}
+	// messages sharing a timestamp are told apart by their id
+	at := time.Now()
+	for i := 0; i < 7; i++ {
+		m := &Message{ID: uuid.Must(uuid.NewV4()), RoomID: rid, UserID: uid, Msg: "hi", Time: at.Add(time.Duration(i/2) * time.Second)}
+		if err := s.AddMessageEntry(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[uuid.UUID]bool)
+	var next *Cursor
+	for page := 0; ; page++ {
+		ms, cur, err := s.GetMessagesFromRoom(ctx, rid, uid, next, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range ms {
+			if seen[m.ID] {
+				t.Fatalf("page %d repeats message %v", page, m.ID)
+			}
+			seen[m.ID] = true
+		}
+		if cur == nil {
+			break
+		}
+		next = cur
+	}
+	if len(seen) != 7 {
+		t.Fatalf("got %d messages, want 7", len(seen))
+	}
+}
@@ -0,0 +1,57 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+// RoomKind tells group rooms apart from direct conversations.
+type RoomKind string
+
+const (
+	RoomGroup RoomKind = "group"
+	// RoomDirect rooms are the one-to-one conversation of two users. They
+	// have no owner, so nobody can rename, delete or invite to them.
+	RoomDirect RoomKind = "direct"
+)
+
+var (
+	errDirectSelf  = errors.New("You cannot message yourself.")
+	errNoSuchUser  = errors.New("User does not exists.")
+	errLeaveDirect = errors.New("You cannot leave a direct conversation.")
+)
+
+// directKey identifies the conversation of a pair of users, no matter which
+// one of them starts it.
+func directKey(a uuid.UUID, b uuid.UUID) string {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	return a.String() + ":" + b.String()
+}
+
+// openDirectRoom returns the direct conversation between uid and the user
+// named username, creating it the first time.
+func openDirectRoom(ctx context.Context, rooms RoomStore, uid uuid.UUID, username string) (*Room, error) {
+	peer, err := rooms.GetUserByName(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if peer == nil {
+		return nil, errNoSuchUser
+	}
+	if peer.UserID == uid {
+		return nil, errDirectSelf
+	}
+	r := &Room{
+		ID:         uuid.Must(uuid.NewV4()),
+		CreatorID:  uid,
+		Visibility: VisibilityInvite,
+		Kind:       RoomDirect,
+		DirectKey:  directKey(uid, peer.UserID),
+	}
+	return rooms.CreateDirectRoom(ctx, r, uid, peer.UserID)
+}
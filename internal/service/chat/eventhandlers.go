@@ -0,0 +1,295 @@
+package chat
+
+import (
+	"context"
+	"log"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+// registerEvents sets up the handlers of the events clients can send over
+// the room websocket.
+func (s *service) registerEvents() {
+	s.events.on("ping", s.onPing)
+	s.events.on("message.send", s.onMessageSend)
+	s.events.on("message.edit", s.onMessageEdit)
+	s.events.on("message.delete", s.onMessageDelete)
+	s.events.on("message.react", s.onMessageReact)
+	s.events.on("message.unreact", s.onMessageUnreact)
+	s.events.on("message.pin", s.onMessagePin)
+	s.events.on("message.unpin", s.onMessageUnpin)
+	s.events.on("typing.start", s.onTyping(messageTypingStarted))
+	s.events.on("typing.stop", s.onTyping(messageTypingStopped))
+	s.events.on("read.ack", s.onReadAck)
+	s.events.on("thread.open", s.onThreadOpen)
+	s.events.on("thread.close", s.onThreadClose)
+	s.events.on("room.rename", s.onRoomRename)
+	s.events.on("member.kick", s.onMemberKick)
+	s.events.on("member.role", s.onMemberRole)
+
+	// dashboards are not connected to a room, so room events make no sense there
+	s.dashboardEvents.on("ping", s.onPing)
+}
+
+// onPing answers with a pong carrying the same id, so clients can measure
+// latency or check that the connection is alive.
+func (s *service) onPing(ctx context.Context, c *client, e *envelope) error {
+	c.sendFrame(&envelope{Type: "pong", ID: e.ID})
+	return nil
+}
+
+// onMessageSend posts a message to the room, or to the thread of the message
+// parent_id when it is set. Messages to the room can carry the attachment_id
+// of a file uploaded beforehand. The members mentioned in the message are
+// notified once it is sent.
+func (s *service) onMessageSend(ctx context.Context, c *client, e *envelope) error {
+	p := &struct {
+		Msg          string `json:"msg"`
+		ParentID     string `json:"parent_id"`
+		AttachmentID string `json:"attachment_id"`
+	}{}
+	if err := decodePayload(e.Payload, p); err != nil {
+		return err
+	}
+	if p.ParentID == "" {
+		aid := uuid.Nil
+		if p.AttachmentID != "" {
+			id, err := uuid.FromString(p.AttachmentID)
+			if err != nil {
+				return badRequest("Invalid attachment id.")
+			}
+			aid = id
+		}
+		m, err := sendMessage(ctx, s.messages, s.rooms, s.hub, c.userID, c.username, c.roomID, p.Msg, aid)
+		if err != nil {
+			return err
+		}
+		s.sent(ctx, m)
+		return nil
+	}
+	parent, err := uuid.FromString(p.ParentID)
+	if err != nil {
+		return badRequest("Invalid message id.")
+	}
+	m, err := sendReply(ctx, s.messages, s.rooms, s.hub, c.userID, c.username, c.roomID, parent, p.Msg)
+	if err != nil {
+		return err
+	}
+	s.sent(ctx, m)
+	return nil
+}
+
+// sent does the work following a message once it is delivered. The message
+// went through, so failures are only logged rather than reported to the
+// author.
+func (s *service) sent(ctx context.Context, m *Message) {
+	s.previews.enqueue(m)
+	mentioned, err := notifyMentions(ctx, s.rooms, s.messages, s.hub, m)
+	if err != nil {
+		log.Printf("error: %v", err)
+	}
+	if err := notifyMessage(ctx, s.rooms, s.notifications, s.hub, m, mentioned); err != nil {
+		log.Printf("error: %v", err)
+	}
+}
+
+func (s *service) onMessageEdit(ctx context.Context, c *client, e *envelope) error {
+	p := &struct {
+		ID  string `json:"id"`
+		Msg string `json:"msg"`
+	}{}
+	if err := decodePayload(e.Payload, p); err != nil {
+		return err
+	}
+	mid, err := uuid.FromString(p.ID)
+	if err != nil {
+		return badRequest("Invalid message id.")
+	}
+	_, err = editMessage(ctx, s.messages, s.rooms, s.hub, c.userID, c.roomID, mid, p.Msg)
+	return err
+}
+
+func (s *service) onMessageDelete(ctx context.Context, c *client, e *envelope) error {
+	p := &struct {
+		ID string `json:"id"`
+	}{}
+	if err := decodePayload(e.Payload, p); err != nil {
+		return err
+	}
+	mid, err := uuid.FromString(p.ID)
+	if err != nil {
+		return badRequest("Invalid message id.")
+	}
+	_, err = deleteMessage(ctx, s.messages, s.rooms, s.hub, c.userID, c.roomID, mid)
+	return err
+}
+
+// reactionPayload is the payload of the message.react and message.unreact events.
+type reactionPayload struct {
+	ID    string `json:"id"`
+	Emoji string `json:"emoji"`
+}
+
+func (s *service) onMessageReact(ctx context.Context, c *client, e *envelope) error {
+	p := &reactionPayload{}
+	if err := decodePayload(e.Payload, p); err != nil {
+		return err
+	}
+	mid, err := uuid.FromString(p.ID)
+	if err != nil {
+		return badRequest("Invalid message id.")
+	}
+	return react(ctx, s.rooms, s.messages, s.hub, c.userID, c.roomID, mid, p.Emoji)
+}
+
+func (s *service) onMessageUnreact(ctx context.Context, c *client, e *envelope) error {
+	p := &reactionPayload{}
+	if err := decodePayload(e.Payload, p); err != nil {
+		return err
+	}
+	mid, err := uuid.FromString(p.ID)
+	if err != nil {
+		return badRequest("Invalid message id.")
+	}
+	return unreact(ctx, s.rooms, s.messages, s.hub, c.userID, c.roomID, mid, p.Emoji)
+}
+
+func (s *service) onMessagePin(ctx context.Context, c *client, e *envelope) error {
+	p := &struct {
+		ID string `json:"id"`
+	}{}
+	if err := decodePayload(e.Payload, p); err != nil {
+		return err
+	}
+	mid, err := uuid.FromString(p.ID)
+	if err != nil {
+		return badRequest("Invalid message id.")
+	}
+	_, err = pinMessage(ctx, s.rooms, s.messages, s.hub, c.userID, c.roomID, mid)
+	return err
+}
+
+func (s *service) onMessageUnpin(ctx context.Context, c *client, e *envelope) error {
+	p := &struct {
+		ID string `json:"id"`
+	}{}
+	if err := decodePayload(e.Payload, p); err != nil {
+		return err
+	}
+	mid, err := uuid.FromString(p.ID)
+	if err != nil {
+		return badRequest("Invalid message id.")
+	}
+	_, err = unpinMessage(ctx, s.rooms, s.messages, s.hub, c.userID, c.roomID, mid)
+	return err
+}
+
+// onTyping broadcasts that the user started or stopped typing. Clients are
+// expected to throttle typing.start, the hub forgets about typists that stay
+// quiet for longer than typingTimeout.
+func (s *service) onTyping(kind messageKind) eventHandler {
+	return func(ctx context.Context, c *client, e *envelope) error {
+		return s.hub.publish(ctx, &message{kind: kind, roomID: c.roomID, userID: c.userID, username: c.username})
+	}
+}
+
+// onReadAck moves the read marker of the user up to the acked message, and
+// resets the unread count shown on their dashboards.
+func (s *service) onReadAck(ctx context.Context, c *client, e *envelope) error {
+	p := &struct {
+		ID string `json:"id"`
+	}{}
+	if err := decodePayload(e.Payload, p); err != nil {
+		return err
+	}
+	mid, err := uuid.FromString(p.ID)
+	if err != nil {
+		return badRequest("Invalid message id.")
+	}
+	m, err := s.messages.GetMessageByID(ctx, mid)
+	if err != nil {
+		return err
+	}
+	if m == nil || m.RoomID != c.roomID {
+		return errNotFound
+	}
+	advanced, err := s.rooms.MarkRead(ctx, &RoomUser{RoomID: c.roomID, UserID: c.userID}, m.Time)
+	if err != nil || !advanced {
+		return err
+	}
+	return s.hub.publish(ctx, &message{kind: messageRead, roomID: c.roomID, userID: c.userID})
+}
+
+func (s *service) onRoomRename(ctx context.Context, c *client, e *envelope) error {
+	p := &struct {
+		Name string `json:"name"`
+	}{}
+	if err := decodePayload(e.Payload, p); err != nil {
+		return err
+	}
+	_, err := renameRoom(ctx, s.rooms, s.hub, c.userID, c.roomID, p.Name)
+	return err
+}
+
+func (s *service) onMemberKick(ctx context.Context, c *client, e *envelope) error {
+	p := &struct {
+		ID string `json:"id"`
+	}{}
+	if err := decodePayload(e.Payload, p); err != nil {
+		return err
+	}
+	uid, err := uuid.FromString(p.ID)
+	if err != nil {
+		return badRequest("Invalid user id.")
+	}
+	_, err = kickMember(ctx, s.rooms, s.hub, c.userID, c.roomID, uid)
+	return err
+}
+
+func (s *service) onMemberRole(ctx context.Context, c *client, e *envelope) error {
+	p := &struct {
+		ID   string `json:"id"`
+		Role Role   `json:"role"`
+	}{}
+	if err := decodePayload(e.Payload, p); err != nil {
+		return err
+	}
+	uid, err := uuid.FromString(p.ID)
+	if err != nil {
+		return badRequest("Invalid user id.")
+	}
+	_, err = setMemberRole(ctx, s.rooms, s.hub, c.userID, c.roomID, uid, p.Role)
+	return err
+}
+
+// onThreadOpen subscribes the client to the replies of the thread it opened
+// in its thread panel, instead of the previous one.
+func (s *service) onThreadOpen(ctx context.Context, c *client, e *envelope) error {
+	p := &struct {
+		ID string `json:"id"`
+	}{}
+	if err := decodePayload(e.Payload, p); err != nil {
+		return err
+	}
+	mid, err := uuid.FromString(p.ID)
+	if err != nil {
+		return badRequest("Invalid message id.")
+	}
+	if err := member(ctx, s.rooms, c.roomID, c.userID); err != nil {
+		return err
+	}
+	m, err := s.messages.GetMessageByID(ctx, mid)
+	if err != nil {
+		return err
+	}
+	if m == nil || m.RoomID != c.roomID || m.ParentID != nil {
+		return errNotFound
+	}
+	s.hub.threadView <- &threadView{client: c, parent: mid}
+	return nil
+}
+
+func (s *service) onThreadClose(ctx context.Context, c *client, e *envelope) error {
+	s.hub.threadView <- &threadView{client: c}
+	return nil
+}
@@ -0,0 +1,111 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+// protocolVersion is the version of the websocket event protocol. Frames with
+// any other version are rejected.
+const protocolVersion = 1
+
+// envelope is the frame exchanged over the room websocket in both directions.
+//
+// The id is chosen by the sender of a request and is echoed back in the
+// replies to it (pong, error), so that clients can match them.
+type envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// eventError is an error that is reported back to the client in an error frame.
+type eventError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *eventError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func badRequest(msg string) *eventError {
+	return &eventError{Code: "bad_request", Message: msg}
+}
+
+// toEventError maps the errors of the chat service to the codes of error frames.
+func toEventError(err error) *eventError {
+	var ee *eventError
+	switch {
+	case errors.As(err, &ee):
+		return ee
+	case errors.Is(err, errNotFound):
+		return &eventError{Code: "not_found", Message: "Message does not exists."}
+	case errors.Is(err, errNotAMember):
+		return &eventError{Code: "not_found", Message: err.Error()}
+	case errors.Is(err, errForbidden), errors.Is(err, errNoAccess), errors.Is(err, errNoPermission):
+		return &eventError{Code: "forbidden", Message: err.Error()}
+	case errors.Is(err, errEmptyMessage), errors.Is(err, errMessageTooLong), errors.Is(err, errEmptyRoomName), errors.Is(err, errInvalidRole), errors.Is(err, errNestedReply),
+		errors.Is(err, errInvalidEmoji), errors.Is(err, errTooManyReactions), errors.Is(err, errAlreadyReacted), errors.Is(err, errNoReaction), errors.Is(err, errInvalidAttachment),
+		errors.Is(err, errTooManyPins), errors.Is(err, errAlreadyPinned), errors.Is(err, errNotPinned), errors.Is(err, errPinReply):
+		return badRequest(err.Error())
+	default:
+		log.Printf("error: %v", err)
+		return &eventError{Code: "internal", Message: "Something went wrong."}
+	}
+}
+
+// eventHandler handles one type of event sent by a client.
+type eventHandler func(ctx context.Context, c *client, e *envelope) error
+
+// events is the registry of handlers for the events clients can send.
+type events struct {
+	handlers map[string]eventHandler
+}
+
+func newEvents() *events {
+	return &events{handlers: make(map[string]eventHandler)}
+}
+
+// on registers the handler of an event type, replacing any previous one.
+func (ev *events) on(t string, h eventHandler) {
+	ev.handlers[t] = h
+}
+
+// dispatch decodes a frame read from the client and runs the handler of its
+// event type. Failures are sent back to the client as error frames, they never
+// close the connection.
+func (ev *events) dispatch(ctx context.Context, c *client, frame []byte) {
+	e := &envelope{}
+	if err := json.Unmarshal(frame, e); err != nil {
+		c.reply(&envelope{Type: "error"}, badRequest("Malformed frame."))
+		return
+	}
+	if e.V != protocolVersion {
+		c.reply(e, &eventError{Code: "unsupported_version", Message: "Unsupported protocol version."})
+		return
+	}
+	h, ok := ev.handlers[e.Type]
+	if !ok {
+		c.reply(e, &eventError{Code: "unknown_event", Message: "Unknown event type " + e.Type + "."})
+		return
+	}
+	if err := h(ctx, c, e); err != nil {
+		c.reply(e, toEventError(err))
+	}
+}
+
+// decodePayload unmarshals the payload of an event, reporting malformed ones
+// as bad requests.
+func decodePayload(payload json.RawMessage, v any) error {
+	if len(payload) == 0 {
+		return badRequest("Missing payload.")
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return badRequest("Malformed payload.")
+	}
+	return nil
+}
@@ -1,7 +1,16 @@
 package chat
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/brianaung/rtm/internal/auth"
 	"github.com/brianaung/rtm/view"
@@ -13,52 +22,94 @@ import (
 // handleDashboard serve the dashboard html with relevant information.
 //
 // Get the rooms that the current authorized user is apart of. The
-// html for dashboard is then served using this information.
+// html for dashboard is then served using this information, with the
+// direct conversations listed apart from the group rooms and the latest
+// notifications.
 func (s *service) handleDashboard(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(*auth.UserContext)
-	rooms, err := getRoomsFromUser(r.Context(), s.db, user.ID)
+	rooms, err := s.rooms.GetRoomsFromUser(r.Context(), user.ID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
 	roomsData := make([]view.RoomDisplayData, 0)
+	directsData := make([]view.RoomDisplayData, 0)
 	for _, r := range rooms {
-		roomsData = append(roomsData, view.RoomDisplayData{RoomID: r.ID, RoomName: r.Name})
+		if r.Kind == RoomDirect {
+			directsData = append(directsData, view.RoomDisplayData{RoomID: r.ID, RoomName: r.Peer, Unread: r.Unread, Direct: true})
+			continue
+		}
+		roomsData = append(roomsData, view.RoomDisplayData{RoomID: r.ID, RoomName: r.Name, Unread: r.Unread, CanDelete: r.Role.can(permDeleteRoom)})
+	}
+	notifications, err := s.notifications.GetNotifications(r.Context(), user.ID, dashboardNotifications)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
 	}
 	w.WriteHeader(http.StatusOK)
-	view.Dashboard(user, roomsData).Render(r.Context(), w)
+	view.Dashboard(user, roomsData, directsData, notificationsDisplay(notifications)).Render(r.Context(), w)
 }
 
 // handleCreateRoom creates a new room with the current user added.
 //
-// It stores the room information and its member details in the database. Then
-// to store the client connection informations, in-memory space is allocated.
+// It stores the room information and its member details in the database. The
+// hub allocates in-memory space for the client connections once the first one
+// is registered. Rooms are public unless the `visibility` form value says
+// otherwise.
 func (s *service) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(*auth.UserContext)
 	rname := r.FormValue("rname")
+	visibility := VisibilityPublic
+	if v := Visibility(r.FormValue("visibility")); v != "" {
+		if !v.valid() {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(errInvalidVisibility.Error()))
+			return
+		}
+		visibility = v
+	}
 	rid := uuid.Must(uuid.NewV4())
-	if err := createRoomWithCreator(r.Context(), s.db, &Room{ID: rid, Name: rname, CreatorID: user.ID}); err != nil {
+	if err := s.rooms.CreateRoomWithCreator(r.Context(), &Room{ID: rid, Name: rname, CreatorID: user.ID, Visibility: visibility}); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	// to store client connections in-memory
-	s.hub.rooms[rid] = make(map[*client]bool)
 	w.Header().Set("HX-Redirect", "/room/"+rid.String())
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleOpenDirect opens the direct conversation with the user named by the
+// `username` form value, creating it the first time.
+func (s *service) handleOpenDirect(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	room, err := openDirectRoom(r.Context(), s.rooms, user.ID, r.FormValue("username"))
+	if errors.Is(err, errNoSuchUser) || errors.Is(err, errDirectSelf) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("HX-Redirect", "/room/"+room.ID.String())
+	w.WriteHeader(http.StatusOK)
+}
+
 // handleJoinRoom allows a user to gain access to a room.
 //
 // If the room exists and the user is not already in the room,
 // the user is added to the room in the database, but the client
-// connections are not yet created.
+// connections are not yet created. Invite-only rooms cannot be joined
+// this way, and approval-required rooms get a join request instead.
 func (s *service) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(*auth.UserContext)
 	rid := uuid.Must(uuid.FromString(r.FormValue("rid")))
 	// check for room
-	if room, err := getRoomByID(r.Context(), s.db, rid); err != nil {
+	room, err := s.rooms.GetRoomByID(r.Context(), rid)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
@@ -68,16 +119,35 @@ func (s *service) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// check if already a member
-	if isMember, err := isAMember(r.Context(), s.db, &RoomUser{RoomID: rid, UserID: user.ID}); err != nil {
+	if isMember, err := s.rooms.IsAMember(r.Context(), &RoomUser{RoomID: rid, UserID: user.ID}); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	} else if isMember {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("You are already in the room."))
+		w.Write([]byte(errAlreadyMember.Error()))
+		return
+	}
+	switch room.Visibility {
+	case VisibilityInvite:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(errInviteOnly.Error()))
+		return
+	case VisibilityApproval:
+		if err := requestJoin(r.Context(), s.rooms, s.hub, user.ID, user.Username, rid); errors.Is(err, errAlreadyRequested) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("Your request to join the room was sent."))
 		return
 	}
-	if err := addUserToRoom(r.Context(), s.db, &RoomUser{RoomID: rid, UserID: user.ID}); err != nil {
+	if err := s.rooms.AddUserToRoom(r.Context(), &RoomUser{RoomID: rid, UserID: user.ID}); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
@@ -94,17 +164,275 @@ func (s *service) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 func (s *service) handleGotoRoom(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(*auth.UserContext)
 	rid := uuid.Must(uuid.FromString(chi.URLParam(r, "rid")))
-	room, err := getRoomByID(r.Context(), s.db, rid)
+	room, err := s.rooms.GetRoomByID(r.Context(), rid)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	} else if room == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Room does not exists."))
+		return
+	}
+	ru, err := s.rooms.GetRoomUser(r.Context(), rid, user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	} else if ru == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("You do not have access to the room."))
+		return
+	}
+	// get the latest page of message history, older pages are fetched on scroll,
+	// or the page starting at the message linked to with ?at=
+	var at *Cursor
+	if mid := r.URL.Query().Get("at"); mid != "" {
+		if at, err = s.anchor(r.Context(), rid, mid); err != nil {
+			writeMessageError(w, err)
+			return
+		}
+	}
+	msgData, next, err := s.messages.GetMessagesFromRoom(r.Context(), rid, user.ID, at, messagePageSize)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	for i := range msgData {
+		msgData[i].Moderate = ru.Role.can(permModerate)
+		msgData[i].CanPin = ru.Role.can(permPinMessage)
+	}
+	members, err := s.roomPresence(r.Context(), rid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	pins, err := s.messages.GetPins(r.Context(), rid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	membersData := make([]view.MemberDisplayData, 0, len(members))
+	for _, m := range members {
+		membersData = append(membersData, view.MemberDisplayData{
+			UserID:       m.UserID,
+			RoomID:       rid,
+			Username:     m.Username,
+			Online:       m.Online,
+			Role:         string(m.Role),
+			Kickable:     ru.Role.can(permKickMember) && ru.Role.outranks(m.Role),
+			RoleEditable: ru.Role.can(permManageRoles) && ru.Role.outranks(m.Role),
+		})
+	}
+	requestsData := make([]view.MemberDisplayData, 0)
+	if ru.Role.can(permManageAccess) {
+		requests, err := s.rooms.GetJoinRequests(r.Context(), rid)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		for _, jr := range requests {
+			requestsData = append(requestsData, view.MemberDisplayData{UserID: jr.UserID, RoomID: rid, Username: jr.Username})
+		}
+	}
+	roomData := view.RoomDisplayData{
+		RoomID:          room.ID,
+		RoomName:        room.Name,
+		Visibility:      string(room.Visibility),
+		Direct:          room.Kind == RoomDirect,
+		CanDelete:       ru.Role.can(permDeleteRoom),
+		CanRename:       ru.Role.can(permRenameRoom),
+		CanManageAccess: ru.Role.can(permManageAccess),
+		CanPin:          ru.Role.can(permPinMessage),
+		Anchored:        at != nil,
+	}
+	if roomData.Direct {
+		// a direct conversation is named after the other user
+		for _, m := range members {
+			if m.UserID != user.ID {
+				roomData.RoomName = m.Username
+			}
+		}
+	}
+	view.Chatroom(user, roomData, msgData, cursorString(next), membersData, requestsData, pinsDisplay(pins)).Render(r.Context(), w)
+}
+
+// anchor returns a cursor just after the message mid of the room, so that
+// the page it starts holds the message as its newest entry. Replies are shown
+// next to their parent.
+func (s *service) anchor(ctx context.Context, rid uuid.UUID, mid string) (*Cursor, error) {
+	id, err := uuid.FromString(mid)
+	if err != nil {
+		return nil, errNotFound
+	}
+	m, err := s.messages.GetMessageByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil && m.ParentID != nil {
+		if m, err = s.messages.GetMessageByID(ctx, *m.ParentID); err != nil {
+			return nil, err
+		}
+	}
+	if m == nil || m.RoomID != rid {
+		return nil, errNotFound
+	}
+	// timestamps are stored to the microsecond
+	return &Cursor{Time: m.Time.Add(time.Microsecond)}, nil
+}
+
+// handleSearch searches the messages of the rooms the user is a member of.
+// Without a query it only shows the search form.
+func (s *service) handleSearch(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	v := r.URL.Query()
+	form := view.SearchFormData{Q: v.Get("q"), RoomID: v.Get("room"), Author: v.Get("author"), From: v.Get("from"), To: v.Get("to")}
+	rooms, err := s.rooms.GetRoomsFromUser(r.Context(), user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	roomsData := make([]view.RoomDisplayData, 0, len(rooms))
+	for _, room := range rooms {
+		name := room.Name
+		if room.Kind == RoomDirect {
+			name = room.Peer
+		}
+		roomsData = append(roomsData, view.RoomDisplayData{RoomID: room.ID, RoomName: name})
+	}
+	q, err := parseSearchQuery(user.ID, v)
+	if errors.Is(err, errEmptySearch) {
+		view.Search(user, form, roomsData, nil, "").Render(r.Context(), w)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		view.Search(user, form, roomsData, nil, err.Error()).Render(r.Context(), w)
+		return
+	}
+	results, err := s.messages.SearchMessages(r.Context(), q)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	view.Search(user, form, roomsData, results, "").Render(r.Context(), w)
+}
+
+// handleMentions shows the messages mentioning the user, and marks them read.
+func (s *service) handleMentions(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	mentions, err := s.messages.GetMentions(r.Context(), user.ID, mentionsLimit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := s.messages.MarkMentionsRead(r.Context(), user.ID, time.Now()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	view.Mentions(user, mentions).Render(r.Context(), w)
+}
+
+// handleMentionCount serves the badge of unread mentions shown in the header.
+func (s *service) handleMentionCount(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	n, err := s.messages.CountUnreadMentions(r.Context(), user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	view.MentionCountBadge(n).Render(r.Context(), w)
+}
+
+// handleNotifications lists the latest notifications of the user.
+func (s *service) handleNotifications(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	ns, err := s.notifications.GetNotifications(r.Context(), user.ID, notificationsLimit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	view.Notifications(user, notificationsDisplay(ns)).Render(r.Context(), w)
+}
+
+// handleNotificationCount serves the badge of unread notifications shown in
+// the header.
+func (s *service) handleNotificationCount(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	n, err := s.notifications.CountUnreadNotifications(r.Context(), user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	view.NotificationCountBadge(n).Render(r.Context(), w)
+}
+
+// handleReadNotification marks a notification as read, and serves it again
+// with the new number of unread notifications.
+func (s *service) handleReadNotification(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	nid, err := uuid.FromString(chi.URLParam(r, "nid"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid notification id."))
+		return
+	}
+	n, err := s.notifications.MarkNotificationRead(r.Context(), user.ID, nid, time.Now())
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Notification does not exists."))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	unread, err := s.notifications.CountUnreadNotifications(r.Context(), user.ID)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	if isMember, err := isAMember(r.Context(), s.db, &RoomUser{RoomID: rid, UserID: user.ID}); err != nil {
+	view.NotificationUpdate(notificationDisplay(n), unread).Render(r.Context(), w)
+}
+
+// handleReadNotifications marks every notification of the user as read, and
+// serves the list of notifications again.
+func (s *service) handleReadNotifications(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	if err := s.notifications.MarkNotificationsRead(r.Context(), user.ID, time.Now()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	ns, err := s.notifications.GetNotifications(r.Context(), user.ID, notificationsLimit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	view.NotificationsRead(notificationsDisplay(ns)).Render(r.Context(), w)
+}
+
+// handleGetPresence serves the members of the room as json, with whether
+// they are currently connected to the room.
+func (s *service) handleGetPresence(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	if isMember, err := s.rooms.IsAMember(r.Context(), &RoomUser{RoomID: rid, UserID: user.ID}); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
@@ -113,53 +441,264 @@ func (s *service) handleGotoRoom(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("You do not have access to the room."))
 		return
 	}
-	// get message history
-	msgData, err := getMessagesFromRoom(r.Context(), s.db, rid, user.ID)
+	members, err := s.roomPresence(r.Context(), rid)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
+		return
 	}
-	view.Chatroom(user, view.RoomDisplayData{RoomID: room.ID, RoomName: room.Name}, msgData).Render(r.Context(), w)
+	writeJSON(w, http.StatusOK, members)
 }
 
-// handleDeleteRoom allows user to delete the entire room.
+// memberPresence is a member of a room with their online state.
+type memberPresence struct {
+	*Member
+	Online bool `json:"online"`
+}
+
+// roomPresence combines the members of a room from the store with the online
+// users known by the hub.
+func (s *service) roomPresence(ctx context.Context, rid uuid.UUID) ([]*memberPresence, error) {
+	members, err := s.rooms.GetRoomMembers(ctx, rid)
+	if err != nil {
+		return nil, err
+	}
+	online, err := s.hub.online(ctx, rid)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*memberPresence, 0, len(members))
+	for _, m := range members {
+		res = append(res, &memberPresence{Member: m, Online: online[m.UserID]})
+	}
+	return res, nil
+}
+
+// handleGetMessages serves a page of older messages from the room history.
 //
-// If the user have the permission to delete the room (i.e. is the creator of the room),
-// then the in-memory client connections will be first cleaned. Then, related entries
-// in the database will be removed.
-func (s *service) handleDeleteRoom(w http.ResponseWriter, r *http.Request) {
+// The `before` query parameter is the cursor of the last message the client
+// already has. The response is a html fragment with the page of messages
+// followed by a trigger to fetch the next one, if there is any.
+func (s *service) handleGetMessages(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(*auth.UserContext)
-	rid := uuid.Must(uuid.FromString(chi.URLParam(r, "rid")))
-	// check for room
-	room, err := getRoomByID(r.Context(), s.db, rid)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	ru, err := s.rooms.GetRoomUser(r.Context(), rid, user.ID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
-	} else if room == nil {
+	} else if ru == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("You do not have access to the room."))
+		return
+	}
+	var before *Cursor
+	if b := r.URL.Query().Get("before"); b != "" {
+		c, err := parseCursor(b)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		before = c
+	}
+	msgData, next, err := s.messages.GetMessagesFromRoom(r.Context(), rid, user.ID, before, messagePageSize)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Room does not exists."))
+		w.Write([]byte(err.Error()))
 		return
 	}
-	// check for permission
-	if room.CreatorID != user.ID {
+	for i := range msgData {
+		msgData[i].Moderate = ru.Role.can(permModerate)
+		msgData[i].CanPin = ru.Role.can(permPinMessage)
+	}
+	w.WriteHeader(http.StatusOK)
+	view.MessagePage(rid, msgData, cursorString(next)).Render(r.Context(), w)
+}
+
+// handleGetThread serves the thread panel of a message, with its replies.
+//
+// Once the panel is shown, the page tells the room socket about it with a
+// thread.open event so that the replies are pushed as they come.
+func (s *service) handleGetThread(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	mid, ok := idParam(w, r, "mid")
+	if !ok {
+		return
+	}
+	ru, err := s.rooms.GetRoomUser(r.Context(), rid, user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	} else if ru == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("You do not have access to the room."))
+		return
+	}
+	m, err := s.messages.GetMessageByID(r.Context(), mid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	} else if m == nil || m.RoomID != rid || m.ParentID != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Message does not exists."))
+		return
+	}
+	replies, err := s.messages.GetThread(r.Context(), mid, user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	count := 0
+	for i := range replies {
+		replies[i].Moderate = ru.Role.can(permModerate)
+		if !replies[i].Deleted {
+			count++
+		}
+	}
+	parent := view.MsgDisplayData{
+		ID:       m.ID,
+		RoomID:   m.RoomID,
+		Username: m.Username,
+		Msg:      m.Msg,
+		Time:     formatTime(m.Time),
+		Mine:     m.UserID == user.ID,
+		Edited:   m.EditedAt != nil,
+		Deleted:  m.DeletedAt != nil,
+		Moderate: ru.Role.can(permModerate),
+		CanPin:   ru.Role.can(permPinMessage),
+		Replies:  count,
+	}
+	if parent.Deleted {
+		parent.Msg = ""
+	}
+	w.WriteHeader(http.StatusOK)
+	view.ThreadPanel(parent, replies).Render(r.Context(), w)
+}
+
+// handleLeaveRoom removes the current user from a room.
+//
+// The membership is deleted and the clients of the user connected to the
+// room are disconnected, while the other members are told about it. The
+// owner cannot leave a room that has other members, they have to delete it
+// instead, and an owner leaving a room they are alone in deletes it. Direct
+// conversations cannot be left.
+func (s *service) handleLeaveRoom(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	if room, err := s.rooms.GetRoomByID(r.Context(), rid); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	} else if room != nil && room.Kind == RoomDirect {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("You do not have permission to delete this room."))
+		w.Write([]byte(errLeaveDirect.Error()))
+		return
+	}
+	ru, err := s.rooms.GetRoomUser(r.Context(), rid, user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	} else if ru == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("You are not in the room."))
+		return
+	}
+	if ru.Role == RoleOwner {
+		members, err := s.rooms.GetRoomMembers(r.Context(), rid)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if len(members) > 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("The owner cannot leave while other members remain, delete the room instead."))
+			return
+		}
+		if err := deleteRoom(r.Context(), s.rooms, s.blobs, rid); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err := s.hub.publish(r.Context(), &message{kind: messageRoomDeleted, roomID: rid}); err != nil {
+			log.Printf("error: %v", err)
+		}
+		w.Header().Set("HX-Redirect", "/dashboard")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := s.rooms.RemoveUserFromRoom(r.Context(), &RoomUser{RoomID: rid, UserID: user.ID}); errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("You are not in the room."))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	// disconnect the user from the room on every node
+	if err := s.hub.publish(r.Context(), &message{kind: messageMemberLeft, roomID: rid, userID: user.ID, username: user.Username}); err != nil {
+		log.Printf("error: %v", err)
+	}
+	w.Header().Set("HX-Redirect", "/dashboard")
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleDeleteRoom allows user to delete the entire room.
+//
+// If the user have the permission to delete the room (i.e. is the owner of the room),
+// then related entries in the database will be removed. Then, the in-memory client
+// connections will be cleaned, and the other members notified.
+func (s *service) handleDeleteRoom(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid := uuid.Must(uuid.FromString(chi.URLParam(r, "rid")))
+	// check for permission
+	if _, err := authorize(r.Context(), s.rooms, rid, user.ID, permDeleteRoom); err != nil {
+		writeRoomError(w, err)
+		return
+	}
+	// the members are gone with the room
+	room, err := s.rooms.GetRoomByID(r.Context(), rid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	members, err := s.rooms.GetRoomMembers(r.Context(), rid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
 		return
 	}
 	// clean db
-	if err := deleteRoom(r.Context(), s.db, rid); err != nil {
+	if err := deleteRoom(r.Context(), s.rooms, s.blobs, rid); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	// clean in-memory client connections
-	if s.hub.rooms != nil && s.hub.rooms[rid] != nil {
-		for c := range s.hub.rooms[rid] {
-			s.hub.unregister <- c
-			c.conn.Close()
+	// clean in-memory client connections on every node
+	if err := s.hub.publish(r.Context(), &message{kind: messageRoomDeleted, roomID: rid}); err != nil {
+		log.Printf("error: %v", err)
+	}
+	if room != nil {
+		if err := notifyRoomDeleted(r.Context(), s.notifications, s.hub, room, members, user.ID, user.Username); err != nil {
+			log.Printf("error: %v", err)
 		}
-		delete(s.hub.rooms, rid)
 	}
 	w.Header().Set("HX-Redirect", "/dashboard")
 	w.WriteHeader(http.StatusOK)
@@ -173,21 +712,528 @@ func (s *service) handleDeleteRoom(w http.ResponseWriter, r *http.Request) {
 func (s *service) serveWs(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(*auth.UserContext)
 	rid := uuid.Must(uuid.FromString(chi.URLParam(r, "rid")))
-	conn, err := upgrader.Upgrade(w, r, nil)
+	ru, err := s.rooms.GetRoomUser(r.Context(), rid, user.ID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
+	} else if ru == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("You do not have access to the room."))
+		return
 	}
-	// client conn data is in-memory only so this can get erased when the server restarts
-	if s.hub.rooms == nil {
-		s.hub.rooms = make(map[uuid.UUID]map[*client]bool)
-		s.hub.rooms[rid] = make(map[*client]bool)
-	} else if s.hub.rooms[rid] == nil {
-		s.hub.rooms[rid] = make(map[*client]bool)
+	// the handshake carries the cookies of a refreshed session, see auth.Authenticator
+	conn, err := s.upgrader.Upgrade(w, r, w.Header())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
 	}
 	c := newClient(s.hub, rid, user.ID, user.Username, conn)
+	c.role = ru.Role
+	c.sessionActive, c.sessionCheck = s.sessionActive(user.SessionID), s.sessionCheck
+	s.hub.register <- c
+	go c.writePump()
+	go c.readPump(r, s.events)
+}
+
+// handleEditMessage lets the author change the content of their message.
+//
+// The new content is read from the `msg` form value, or from the HX-Prompt
+// header when it is sent by the edit button of the chatroom. The update is
+// pushed to the clients in the room through the hub, and the edited message
+// is returned as json for clients that are not connected to the room socket.
+func (s *service) handleEditMessage(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	mid, ok := idParam(w, r, "mid")
+	if !ok {
+		return
+	}
+	body := r.FormValue("msg")
+	if body == "" {
+		body = r.Header.Get("HX-Prompt")
+	}
+	m, err := editMessage(r.Context(), s.messages, s.rooms, s.hub, user.ID, rid, mid, body)
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// handleDeleteMessage lets the author, or a moderator of the room, delete a message.
+//
+// Like handleEditMessage, the change is pushed through the hub and the deleted
+// message is returned as json.
+func (s *service) handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	mid, ok := idParam(w, r, "mid")
+	if !ok {
+		return
+	}
+	m, err := deleteMessage(r.Context(), s.messages, s.rooms, s.hub, user.ID, rid, mid)
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// handlePinMessage pins a message to its room, handleUnpinMessage unpins it.
+// The pinned panel of the clients in the room is updated through the hub, and
+// the pins of the room are returned as json.
+func (s *service) handlePinMessage(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	mid, ok := idParam(w, r, "mid")
+	if !ok {
+		return
+	}
+	pins, err := pinMessage(r.Context(), s.rooms, s.messages, s.hub, user.ID, rid, mid)
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, pins)
+}
+
+func (s *service) handleUnpinMessage(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	mid, ok := idParam(w, r, "mid")
+	if !ok {
+		return
+	}
+	pins, err := unpinMessage(r.Context(), s.rooms, s.messages, s.hub, user.ID, rid, mid)
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, pins)
+}
+
+// handleUploadAttachment stores the file of the `file` multipart field, and
+// returns the attachment as json. Its id is then sent along with a message
+// over the websocket.
+func (s *service) handleUploadAttachment(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	if isMember, err := s.rooms.IsAMember(r.Context(), &RoomUser{RoomID: rid, UserID: user.ID}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	} else if !isMember {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("You do not have access to the room."))
+		return
+	}
+	// leave some room for the multipart headers
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			writeAttachmentError(w, errNoFile)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+		a, err := saveAttachment(r.Context(), s.messages, s.blobs, user.ID, rid, part.FileName(), part)
+		if err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, a)
+		return
+	}
+}
+
+// handleGetAttachment serves the content of an attachment to the members of
+// its room. Only images are shown inline, everything else is downloaded.
+func (s *service) handleGetAttachment(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	aid, ok := idParam(w, r, "aid")
+	if !ok {
+		return
+	}
+	a, err := roomAttachment(r.Context(), s.messages, s.rooms, user.ID, rid, aid)
+	if err != nil {
+		writeAttachmentError(w, err)
+		return
+	}
+	blob, err := s.blobs.Get(r.Context(), a.ID.String())
+	if err != nil {
+		writeAttachmentError(w, err)
+		return
+	}
+	defer blob.Close()
+	disposition := "attachment"
+	if a.image() {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, blob)
+}
+
+// handleRenameRoom changes the name of the room.
+//
+// The new name is read from the `rname` form value, or from the HX-Prompt
+// header when it is sent by the rename button of the chatroom.
+func (s *service) handleRenameRoom(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	name := r.FormValue("rname")
+	if name == "" {
+		name = r.Header.Get("HX-Prompt")
+	}
+	room, err := renameRoom(r.Context(), s.rooms, s.hub, user.ID, rid, name)
+	if err != nil {
+		writeRoomError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, room)
+}
+
+// handleKickMember removes a member from the room and disconnects them.
+func (s *service) handleKickMember(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	uid, ok := idParam(w, r, "uid")
+	if !ok {
+		return
+	}
+	m, err := kickMember(r.Context(), s.rooms, s.hub, user.ID, rid, uid)
+	if err != nil {
+		writeRoomError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// handleSetRole changes the role of a member to the `role` form value.
+func (s *service) handleSetRole(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	uid, ok := idParam(w, r, "uid")
+	if !ok {
+		return
+	}
+	m, err := setMemberRole(r.Context(), s.rooms, s.hub, user.ID, rid, uid, Role(r.FormValue("role")))
+	if err != nil {
+		writeRoomError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// handleSetVisibility changes how users get into the room, from the
+// `visibility` form value.
+func (s *service) handleSetVisibility(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	if err := setVisibility(r.Context(), s.rooms, user.ID, rid, Visibility(r.FormValue("visibility"))); err != nil {
+		writeRoomError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleCreateInvite creates an invite link to the room and serves it as a
+// html fragment.
+//
+// The `ttl` form value is one of inviteTTLs and defaults to a day, and the
+// `single_use` checkbox makes the link stop working once someone joins with it.
+func (s *service) handleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	ttl, ok := inviteTTLs[r.FormValue("ttl")]
+	if !ok {
+		ttl = inviteTTLs["24h"]
+	}
+	inv, err := createInvite(r.Context(), s.rooms, user.ID, rid, ttl, r.FormValue("single_use") != "")
+	if err != nil {
+		writeRoomError(w, err)
+		return
+	}
+	// not r.Host, which is up to the client
+	link := s.publicURL + "/invite/" + inviteToken(s.userauth, inv)
+	w.WriteHeader(http.StatusOK)
+	view.InviteLink(link, formatTime(inv.ExpiresAt), inv.SingleUse).Render(r.Context(), w)
+}
+
+// handleRedeemInvite lets the user into the room of an invite link, and
+// redirects them to it.
+func (s *service) handleRedeemInvite(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	id, rid, err := parseInviteToken(s.userauth, chi.URLParam(r, "token"), time.Now())
+	if err != nil {
+		writeRoomError(w, err)
+		return
+	}
+	inv, err := redeemInvite(r.Context(), s.rooms, user.ID, id, rid)
+	if err != nil {
+		writeRoomError(w, err)
+		return
+	}
+	if inv != nil && inv.CreatedBy != user.ID {
+		if err := notifyInviteUsed(r.Context(), s.rooms, s.notifications, s.hub, inv, user.Username); err != nil {
+			log.Printf("error: %v", err)
+		}
+	}
+	http.Redirect(w, r, "/room/"+rid.String(), http.StatusSeeOther)
+}
+
+// handleApproveJoin lets the user who asked to join the room in.
+func (s *service) handleApproveJoin(w http.ResponseWriter, r *http.Request) {
+	s.handleResolveJoin(w, r, true)
+}
+
+// handleRejectJoin drops the request of a user to join the room.
+func (s *service) handleRejectJoin(w http.ResponseWriter, r *http.Request) {
+	s.handleResolveJoin(w, r, false)
+}
+
+func (s *service) handleResolveJoin(w http.ResponseWriter, r *http.Request, approve bool) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rid, ok := idParam(w, r, "rid")
+	if !ok {
+		return
+	}
+	uid, ok := idParam(w, r, "uid")
+	if !ok {
+		return
+	}
+	if err := resolveJoin(r.Context(), s.rooms, s.hub, user.ID, rid, uid, approve); err != nil {
+		writeRoomError(w, err)
+		return
+	}
+	if approve {
+		if err := notifyApproved(r.Context(), s.rooms, s.notifications, s.hub, rid, uid, user.Username); err != nil {
+			log.Printf("error: %v", err)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveNotifications streams the notifications of the user as Server-Sent
+// Events, for the pages that are not connected to a room. Each event is a
+// html fragment of the notification, named "notification". A comment is
+// sent every streamKeepAlive so that proxies do not close an idle stream.
+func (s *service) serveNotifications(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Streaming is not supported."))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	st := newStream(user.ID)
+	s.hub.subscribe <- st
+	defer func() { s.hub.unsubscribe <- st }()
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	check := time.NewTicker(s.sessionCheck)
+	defer check.Stop()
+	active := s.sessionActive(user.SessionID)
+	for {
+		select {
+		case m, ok := <-st.send:
+			if !ok {
+				// the hub dropped the stream
+				return
+			}
+			var buf bytes.Buffer
+			view.NotificationUpdate(notificationDisplay(m.notification), m.unread).Render(r.Context(), &buf)
+			if err := writeEvent(w, "notification", buf.String()); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+		case <-check.C:
+			if !active() {
+				// the session was revoked since the stream was opened
+				return
+			}
+			continue
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// sessionActive returns the check of a session run by the sockets and
+// streams, which outlive the request they were authenticated with. A session
+// that cannot be looked up is given the benefit of the doubt.
+func (s *service) sessionActive(sid uuid.UUID) func() bool {
+	return func() bool {
+		ok, err := s.userauth.SessionActive(context.Background(), sid)
+		if err != nil {
+			log.Printf("error: %v", err)
+			return true
+		}
+		return ok
+	}
+}
+
+func writeRoomError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNoAccess), errors.Is(err, errNoPermission):
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+	case errors.Is(err, errNotAMember), errors.Is(err, errNoJoinRequest):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+	case errors.Is(err, errEmptyRoomName), errors.Is(err, errInvalidRole), errors.Is(err, errInvalidVisibility), errors.Is(err, errInvalidInvite):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+func writeMessageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Message does not exists."))
+	case errors.Is(err, errForbidden), errors.Is(err, errNoAccess), errors.Is(err, errNoPermission):
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+	case errors.Is(err, errEmptyMessage), errors.Is(err, errMessageTooLong), errors.Is(err, errTooManyPins), errors.Is(err, errAlreadyPinned), errors.Is(err, errNotPinned), errors.Is(err, errPinReply):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+func writeAttachmentError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, errNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Attachment does not exists."))
+	case errors.Is(err, errNoAccess):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+	case errors.Is(err, errAttachmentTooLarge), errors.As(err, &tooLarge):
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(errAttachmentTooLarge.Error()))
+	case errors.Is(err, errNoFile):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// idNames name the ids of the url parameters in the errors of idParam.
+var idNames = map[string]string{"rid": "room", "mid": "message", "aid": "attachment", "uid": "user"}
+
+// idParam parses the uuid url parameter key. It answers 400 and returns false
+// if the parameter is not one.
+func idParam(w http.ResponseWriter, r *http.Request, key string) (uuid.UUID, bool) {
+	id, err := uuid.FromString(chi.URLParam(r, key))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid " + idNames[key] + " id."))
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// serveDashboardWs creates a websocket connection for the dashboard.
+//
+// The dashboard client is registered to the hub for every room of the user,
+// so that the unread counts of the rooms are pushed as they change.
+func (s *service) serveDashboardWs(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	rooms, err := s.rooms.GetRoomsFromUser(r.Context(), user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	// the handshake carries the cookies of a refreshed session, see auth.Authenticator
+	conn, err := s.upgrader.Upgrade(w, r, w.Header())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	c := newDashboardClient(s.hub, user.ID, user.Username, rooms, conn)
+	c.sessionActive, c.sessionCheck = s.sessionActive(user.SessionID), s.sessionCheck
 	s.hub.register <- c
 	go c.writePump()
-	go c.readPump(r, s.db)
+	go c.readPump(r, s.dashboardEvents)
 }
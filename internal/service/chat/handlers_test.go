@@ -0,0 +1,203 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+func TestCreateRoom(t *testing.T) {
+	e := newTestEnv(t)
+	alice := e.login("alice")
+
+	rid := e.createRoom(alice, "general")
+
+	ru, err := e.store.GetRoomUser(context.Background(), rid, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ru == nil || ru.Role != RoleOwner {
+		t.Fatalf("creator membership = %+v, want owner", ru)
+	}
+	rec := e.do(alice, http.MethodGet, "/dashboard", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "general") {
+		t.Fatalf("dashboard: got %d, want the room listed", rec.Code)
+	}
+}
+
+func TestJoinRoom(t *testing.T) {
+	e := newTestEnv(t)
+	alice, bob := e.login("alice"), e.login("bob")
+	rid := e.createRoom(alice, "general")
+
+	tests := []struct {
+		name string
+		u    *testUser
+		want int
+	}{
+		{"owner is already a member", alice, http.StatusBadRequest},
+		{"outsider joins", bob, http.StatusOK},
+		{"member joins again", bob, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := e.do(tt.u, http.MethodPut, "/join", url.Values{"rid": {rid.String()}})
+			if rec.Code != tt.want {
+				t.Fatalf("got %d %q, want %d", rec.Code, rec.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestGotoRoom(t *testing.T) {
+	e := newTestEnv(t)
+	alice, bob, carol := e.login("alice"), e.login("bob"), e.login("carol")
+	rid := e.createRoom(alice, "general")
+	if rec := e.do(bob, http.MethodPut, "/join", url.Values{"rid": {rid.String()}}); rec.Code != http.StatusOK {
+		t.Fatalf("join: got %d", rec.Code)
+	}
+
+	tests := []struct {
+		name string
+		u    *testUser
+		want int
+	}{
+		{"owner", alice, http.StatusOK},
+		{"member", bob, http.StatusOK},
+		{"outsider", carol, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := e.do(tt.u, http.MethodGet, "/room/"+rid.String(), nil)
+			if rec.Code != tt.want {
+				t.Fatalf("got %d %q, want %d", rec.Code, rec.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestProtectedRoutesNeedSession(t *testing.T) {
+	e := newTestEnv(t)
+	rec := e.do(&testUser{}, http.MethodGet, "/dashboard", nil)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("got %d, want a redirect to the landing page", rec.Code)
+	}
+}
+
+func TestEditMessage(t *testing.T) {
+	e := newTestEnv(t)
+	alice, bob, carol := e.login("alice"), e.login("bob"), e.login("carol")
+	rid := e.createRoom(alice, "general")
+	for _, u := range []*testUser{bob, carol} {
+		if rec := e.do(u, http.MethodPut, "/join", url.Values{"rid": {rid.String()}}); rec.Code != http.StatusOK {
+			t.Fatalf("join: got %d", rec.Code)
+		}
+	}
+	ctx := context.Background()
+	send := func(u *testUser) string {
+		m, err := sendMessage(ctx, e.store, e.store, e.s.hub, u.ID, u.Username, rid, "hello", uuid.Nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.ID.String()
+	}
+	mine, bobs, carols := send(alice), send(bob), send(carol)
+	if rec := e.do(carol, http.MethodPost, "/room/"+rid.String()+"/leave", nil); rec.Code != http.StatusOK {
+		t.Fatalf("leave: got %d", rec.Code)
+	}
+
+	tests := []struct {
+		name string
+		u    *testUser
+		mid  string
+		msg  string
+		want int
+	}{
+		{"author", alice, mine, "hello again", http.StatusOK},
+		{"longest message", alice, mine, strings.Repeat("é", maxMessageLen), http.StatusOK},
+		{"too long", alice, mine, strings.Repeat("a", maxMessageLen+1), http.StatusBadRequest},
+		{"empty", alice, mine, "   ", http.StatusBadRequest},
+		{"someone else's", alice, bobs, "mine now", http.StatusForbidden},
+		{"author who left", carol, carols, "still here", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := e.do(tt.u, http.MethodPut, "/room/"+rid.String()+"/messages/"+tt.mid, url.Values{"msg": {tt.msg}})
+			if rec.Code != tt.want {
+				t.Fatalf("got %d %q, want %d", rec.Code, rec.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestMalformedIDs(t *testing.T) {
+	e := newTestEnv(t)
+	alice := e.login("alice")
+	rid := e.createRoom(alice, "general").String()
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/room/nope/messages"},
+		{http.MethodPut, "/room/nope/messages/00000000-0000-0000-0000-000000000000"},
+		{http.MethodPut, "/room/{rid}/messages/nope"},
+		{http.MethodDelete, "/room/{rid}/messages/nope"},
+		{http.MethodGet, "/room/nope/presence"},
+		{http.MethodPost, "/room/nope/leave"},
+		{http.MethodPut, "/room/nope"},
+		{http.MethodDelete, "/room/{rid}/members/nope"},
+		{http.MethodPut, "/room/{rid}/members/nope/role"},
+		{http.MethodPut, "/room/nope/visibility"},
+		{http.MethodPost, "/room/nope/invites"},
+		{http.MethodPost, "/room/{rid}/requests/nope"},
+		{http.MethodDelete, "/room/{rid}/requests/nope"},
+		{http.MethodGet, "/room/{rid}/messages/nope/thread"},
+		{http.MethodPost, "/room/nope/attachments"},
+		{http.MethodGet, "/room/{rid}/attachments/nope"},
+		{http.MethodPut, "/room/{rid}/pins/nope"},
+		{http.MethodDelete, "/room/{rid}/pins/nope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rec := e.do(alice, tt.method, strings.ReplaceAll(tt.path, "{rid}", rid), url.Values{})
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("got %d %q, want 400", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestDeletingRoomDeletesBlobs(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+	}{
+		{"delete", http.MethodDelete, "/delete/{rid}"},
+		{"last owner leaves", http.MethodPost, "/room/{rid}/leave"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			alice := e.login("alice")
+			rid := e.createRoom(alice, "general")
+			ctx := context.Background()
+			a, err := saveAttachment(ctx, e.store, e.s.blobs, alice.ID, rid, "notes.txt", strings.NewReader("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rec := e.do(alice, tt.method, strings.ReplaceAll(tt.path, "{rid}", rid.String()), nil); rec.Code != http.StatusOK {
+				t.Fatalf("got %d %q", rec.Code, rec.Body)
+			}
+			if _, err := e.s.blobs.Get(ctx, a.ID.String()); err != errNotFound {
+				t.Fatalf("blob of the attachment: got %v, want errNotFound", err)
+			}
+		})
+	}
+}
@@ -1,63 +1,143 @@
 package chat
 
 import (
+	"context"
+	"log"
 	"time"
 
 	"github.com/gofrs/uuid/v5"
 )
 
 type hub struct {
-	rooms      map[uuid.UUID]map[*client]bool
-	broadcast  chan *message // inbound messsages from the client
-	register   chan *client  // register requests from the client
-	unregister chan *client  // unregister requests from the client
-	quit       chan bool
+	nodeID        uuid.UUID // identifies this node to the other ones on the backplane
+	rooms         map[uuid.UUID]map[*client]bool
+	dashboards    map[*client]bool
+	watchers      map[uuid.UUID]map[*client]bool // room id -> dashboard clients showing the room
+	backplane     Backplane                      // fans out messages to the hubs of every node
+	messages      MessageStore                   // reloads what is not sent through the backplane
+	broadcast     chan *message                  // inbound messsages from the backplane
+	register      chan *client                   // register requests from the client
+	unregister    chan *client                   // unregister requests from the client
+	remove        chan *message                  // members leaving and rooms deleted, from the backplane
+	presenceQuery chan *presenceQuery            // online users requests from the handlers
+	threadView    chan *threadView               // thread panel changes from the clients
+	subscribe     chan *stream                   // notification streams opened by the handlers
+	unsubscribe   chan *stream                   // notification streams closed by the handlers
+	quit          chan bool
+	typing        map[uuid.UUID]map[uuid.UUID]*typist   // room id -> user id -> typist
+	presence      map[uuid.UUID]map[uuid.UUID]*presence // room id -> user id -> presence
+	threads       map[uuid.UUID]map[*client]bool        // parent message id -> clients viewing the thread
+	viewing       map[*client]uuid.UUID                 // client -> parent message id of the thread it views
+	streams       map[uuid.UUID]map[*stream]bool        // user id -> notification streams
 }
 
 type message struct {
-	roomID   uuid.UUID
-	userID   uuid.UUID
-	username string
-	body     string
-	time     time.Time
+	kind         messageKind
+	id           uuid.UUID
+	roomID       uuid.UUID
+	userID       uuid.UUID
+	username     string
+	body         string
+	time         time.Time
+	typists      []typist
+	node         uuid.UUID
+	online       bool
+	members      []Member
+	parent       uuid.UUID // parent message of a reply
+	replies      int       // number of replies of the parent, for replies
+	reactions    []*Reaction
+	attachment   *Attachment
+	preview      *LinkPreview
+	notification *Notification
+	unread       int // unread mentions or notifications of the user
+	pins         []*Pin
 }
 
-func newHub() *hub {
+func newHub(bp Backplane, messages MessageStore) *hub {
 	return &hub{
-		rooms:      make(map[uuid.UUID]map[*client]bool),
-		broadcast:  make(chan *message),
-		register:   make(chan *client),
-		unregister: make(chan *client),
-		quit:       make(chan bool),
+		nodeID:        uuid.Must(uuid.NewV4()),
+		messages:      messages,
+		rooms:         make(map[uuid.UUID]map[*client]bool),
+		dashboards:    make(map[*client]bool),
+		watchers:      make(map[uuid.UUID]map[*client]bool),
+		backplane:     bp,
+		broadcast:     make(chan *message),
+		register:      make(chan *client),
+		unregister:    make(chan *client),
+		remove:        make(chan *message),
+		presenceQuery: make(chan *presenceQuery),
+		threadView:    make(chan *threadView),
+		subscribe:     make(chan *stream),
+		unsubscribe:   make(chan *stream),
+		quit:          make(chan bool),
+		typing:        make(map[uuid.UUID]map[uuid.UUID]*typist),
+		presence:      make(map[uuid.UUID]map[uuid.UUID]*presence),
+		threads:       make(map[uuid.UUID]map[*client]bool),
+		viewing:       make(map[*client]uuid.UUID),
+		streams:       make(map[uuid.UUID]map[*stream]bool),
 	}
 }
 
 func (h *hub) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(presenceInterval)
+	defer heartbeat.Stop()
+	// ask the other nodes who is connected to them
+	go h.announce(&message{kind: messagePresenceSync, node: h.nodeID})
 	for {
 		select {
 		// register, unregister chan is only for client/conn, not for removing entire user
-		// TODO: another chan for removing user
 		case c := <-h.register:
+			if c.dashboard() {
+				h.watch(c)
+				continue
+			}
 			// register client to the hub
+			if h.rooms[c.roomID] == nil {
+				h.rooms[c.roomID] = make(map[*client]bool)
+			}
 			h.rooms[c.roomID][c] = true
+			h.localPresence(c)
 		case c := <-h.unregister:
 			// remove client from the hub, and close its send channel
-			if room, ok := h.rooms[c.roomID]; ok {
-				if _, ok := room[c]; ok {
-					delete(h.rooms[c.roomID], c)
-					close(c.send)
-				}
-			}
+			h.removeClient(c)
+		case m := <-h.remove:
+			// remove an entire user, or everyone, from a room, letting the
+			// clients know before disconnecting them
+			h.deliver(m)
+			h.disconnect(m)
+		case q := <-h.presenceQuery:
+			h.answerPresence(q)
+		case v := <-h.threadView:
+			h.viewThread(v)
+		case st := <-h.subscribe:
+			h.addStream(st)
+		case st := <-h.unsubscribe:
+			h.removeStream(st)
 		case m := <-h.broadcast:
-			// broadcast messages to every client in the room
-			for client := range h.rooms[m.roomID] {
-				select {
-				case client.send <- m:
-				default:
-					close(client.send)
-					delete(h.rooms[m.roomID], client)
+			switch m.kind {
+			case messagePresenceJoined, messagePresenceLeft, messagePresenceHeartbeat, messagePresenceSync:
+				h.remotePresence(m)
+			case messageTypingStarted, messageTypingStopped:
+				if h.setTyping(m, m.kind == messageTypingStarted) {
+					h.broadcastTyping(m.roomID)
+				}
+			case messageNotification:
+				h.deliverNotification(m)
+			default:
+				// broadcast messages to every client in the room
+				h.deliver(m)
+				// sending a message ends typing
+				if m.kind == messageNew && h.setTyping(m, false) {
+					h.broadcastTyping(m.roomID)
 				}
 			}
+		case now := <-ticker.C:
+			h.expireTyping(now)
+			h.expirePresence(now)
+		case <-heartbeat.C:
+			h.heartbeat()
 		case quit := <-h.quit:
 			if quit {
 				return
@@ -65,3 +145,156 @@ func (h *hub) run() {
 		}
 	}
 }
+
+// deliver sends a message to every client in its room, or to every client of
+// the user for a mention, dropping the clients that are not keeping up.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) deliver(m *message) {
+	var dropped []*client
+	send := func(c *client, m *message) {
+		if m == nil {
+			return
+		}
+		select {
+		case c.send <- m:
+		default:
+			dropped = append(dropped, c)
+		}
+	}
+	if m.kind == messageMention {
+		for _, c := range h.clientsOf(m.userID) {
+			send(c, m)
+		}
+	} else if m.kind != messageRead {
+		for c := range h.rooms[m.roomID] {
+			send(c, h.scoped(c, m))
+		}
+	}
+	if m.kind == messageNew || m.kind == messageRead || m.kind == messageRoomRenamed {
+		// dashboards only care about messages from others, their own reads
+		// and the name of the room
+		for c := range h.watchers[m.roomID] {
+			if m.kind == messageNew && m.userID != c.userID || m.kind == messageRead && m.userID == c.userID || m.kind == messageRoomRenamed {
+				send(c, m)
+			}
+		}
+	}
+	for _, c := range dropped {
+		h.removeClient(c)
+	}
+}
+
+// disconnect removes the clients of a user who left or was kicked from a room, or all the
+// clients of a deleted room, including the dashboards showing it.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) disconnect(m *message) {
+	everyone := m.kind == messageRoomDeleted
+	for c := range h.rooms[m.roomID] {
+		if everyone || c.userID == m.userID {
+			h.removeClient(c)
+		}
+	}
+	for c := range h.watchers[m.roomID] {
+		if everyone || c.userID == m.userID {
+			delete(h.watchers[m.roomID], c)
+		}
+	}
+	if len(h.watchers[m.roomID]) == 0 {
+		delete(h.watchers, m.roomID)
+	}
+}
+
+// watch registers a dashboard client to the rooms it shows.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) watch(c *client) {
+	h.dashboards[c] = true
+	for _, rid := range c.watching {
+		if h.watchers[rid] == nil {
+			h.watchers[rid] = make(map[*client]bool)
+		}
+		h.watchers[rid][c] = true
+	}
+}
+
+// removeClient removes a client from the hub and closes its send channel.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) removeClient(c *client) {
+	if c.dashboard() {
+		h.unwatch(c)
+		return
+	}
+	room, ok := h.rooms[c.roomID]
+	if !ok {
+		return
+	}
+	if _, ok := room[c]; !ok {
+		return
+	}
+	delete(room, c)
+	h.viewThread(&threadView{client: c})
+	close(c.send)
+	if len(room) == 0 {
+		delete(h.rooms, c.roomID)
+	}
+	h.localPresence(c)
+}
+
+// unwatch removes a dashboard client from the hub and closes its send channel.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) unwatch(c *client) {
+	if !h.dashboards[c] {
+		return
+	}
+	delete(h.dashboards, c)
+	for _, rid := range c.watching {
+		delete(h.watchers[rid], c)
+		if len(h.watchers[rid]) == 0 {
+			delete(h.watchers, rid)
+		}
+	}
+	close(c.send)
+}
+
+// publish sends a message accepted from a client to the backplane, which
+// delivers it back to the hub of every node, including this one.
+func (h *hub) publish(ctx context.Context, m *message) error {
+	payload, err := encodeMessage(m)
+	if err != nil {
+		return err
+	}
+	return h.backplane.Publish(ctx, payload)
+}
+
+// receive feeds the messages coming from the backplane into the broadcast
+// channel, or the remove channel for membership changes. It returns once the
+// backplane is closed.
+//
+// The reactions to a message are not sent through the backplane, as there is
+// no bound to how many there are. They are loaded from the store here, before
+// the message reaches the hub.
+func (h *hub) receive() {
+	for payload := range h.backplane.Subscribe() {
+		m, err := decodeMessage(payload)
+		if err != nil {
+			log.Printf("error: %v", err)
+			continue
+		}
+		if m.kind == messageReactions || m.kind == messageEdited {
+			if m.reactions, err = h.messages.GetReactions(context.Background(), m.id); err != nil {
+				log.Printf("error: %v", err)
+				continue
+			}
+		}
+		switch m.kind {
+		case messageMemberLeft, messageMemberKicked, messageRoomDeleted:
+			h.remove <- m
+		default:
+			h.broadcast <- m
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+func newTestHub(t *testing.T) *hub {
+	t.Helper()
+	h := newHub(NewLocalBackplane(), NewMemStore(nil))
+	go h.run()
+	go h.receive()
+	t.Cleanup(func() { h.quit <- true })
+	return h
+}
+
+// nextMessage waits for the next message of a kind sent to a client, skipping
+// the others. It returns nil if the hub closed the client.
+func nextMessage(t *testing.T, c *client, kind messageKind) *message {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case m, ok := <-c.send:
+			if !ok {
+				return nil
+			}
+			if m.kind == kind {
+				return m
+			}
+		case <-timeout:
+			t.Fatalf("no message of kind %d for %s", kind, c.username)
+		}
+	}
+}
+
+// drained reports whether no message of a kind is queued for a client.
+func drained(c *client, kind messageKind) bool {
+	for {
+		select {
+		case m, ok := <-c.send:
+			if !ok {
+				return true
+			}
+			if m.kind == kind {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
+
+func TestHubDeliversToRoom(t *testing.T) {
+	h := newTestHub(t)
+	rid, other := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	alice := newClient(h, rid, uuid.Must(uuid.NewV4()), "alice", nil)
+	bob := newClient(h, rid, uuid.Must(uuid.NewV4()), "bob", nil)
+	carol := newClient(h, other, uuid.Must(uuid.NewV4()), "carol", nil)
+	for _, c := range []*client{alice, bob, carol} {
+		h.register <- c
+	}
+
+	mid := uuid.Must(uuid.NewV4())
+	if err := h.publish(context.Background(), &message{id: mid, roomID: rid, userID: alice.userID, username: "alice", body: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*client{alice, bob} {
+		m := nextMessage(t, c, messageNew)
+		if m == nil || m.id != mid || m.body != "hi" {
+			t.Fatalf("%s got %+v, want the message", c.username, m)
+		}
+	}
+	if !drained(carol, messageNew) {
+		t.Fatal("carol got a message of another room")
+	}
+}
+
+func TestHubDisconnectsLeavingMember(t *testing.T) {
+	h := newTestHub(t)
+	rid := uuid.Must(uuid.NewV4())
+	alice := newClient(h, rid, uuid.Must(uuid.NewV4()), "alice", nil)
+	bob := newClient(h, rid, uuid.Must(uuid.NewV4()), "bob", nil)
+	h.register <- alice
+	h.register <- bob
+
+	if err := h.publish(context.Background(), &message{kind: messageMemberLeft, roomID: rid, userID: bob.userID, username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if m := nextMessage(t, alice, messageMemberLeft); m == nil || m.userID != bob.userID {
+		t.Fatalf("alice got %+v, want bob leaving", m)
+	}
+	// bob is told, then his send channel is closed
+	if m := nextMessage(t, bob, messageMemberLeft); m == nil {
+		t.Fatal("bob was disconnected before being told")
+	}
+	if m := nextMessage(t, bob, messageNew); m != nil {
+		t.Fatalf("bob got %+v after leaving", m)
+	}
+}
+
+func TestThreadViewOfRemovedClient(t *testing.T) {
+	h := newHub(NewLocalBackplane(), NewMemStore(nil))
+	rid, parent := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	c := newClient(h, rid, uuid.Must(uuid.NewV4()), "alice", nil)
+
+	// the view of a client that is not registered, or no longer
+	h.viewThread(&threadView{client: c, parent: parent})
+	if len(h.viewing) != 0 || len(h.threads) != 0 {
+		t.Fatalf("kept the view of a removed client: %v %v", h.viewing, h.threads)
+	}
+	h.rooms[rid] = map[*client]bool{c: true}
+	h.viewThread(&threadView{client: c, parent: parent})
+	if h.viewing[c] != parent || !h.threads[parent][c] {
+		t.Fatal("lost the view of a registered client")
+	}
+}
@@ -0,0 +1,904 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/brianaung/rtm/view"
+	"github.com/gofrs/uuid/v5"
+)
+
+// memStore is an in-memory implementation of RoomStore, MessageStore and
+// NotificationStore.
+//
+// It is meant for running the server without a database (dev mode) and for
+// unit testing the handlers, hub and client. Everything is lost when the
+// process exits.
+type memStore struct {
+	users       UserDirectory
+	mu          sync.RWMutex
+	rooms       map[uuid.UUID]*Room
+	members     map[uuid.UUID]map[uuid.UUID]*RoomUser    // room id -> user id -> membership
+	messages    map[uuid.UUID][]*Message                 // room id -> messages in insertion order
+	byID        map[uuid.UUID]*Message                   // message id -> message
+	invites     map[uuid.UUID]*Invite                    // invite id -> invite
+	requests    map[uuid.UUID]map[uuid.UUID]*JoinRequest // room id -> user id -> join request
+	direct      map[string]uuid.UUID                     // direct key -> room id
+	reactions   map[uuid.UUID][]*Reaction                // message id -> reactions, oldest first
+	attachments map[uuid.UUID]*Attachment                // attachment id -> attachment
+	mentions    map[uuid.UUID]map[uuid.UUID]*time.Time   // message id -> mentioned user id -> read time
+	pins        map[uuid.UUID][]*Pin                     // room id -> pins, oldest first
+	// user id -> notifications, oldest first
+	notifications map[uuid.UUID][]*Notification
+}
+
+func NewMemStore(users UserDirectory) *memStore {
+	return &memStore{
+		users:       users,
+		rooms:       make(map[uuid.UUID]*Room),
+		members:     make(map[uuid.UUID]map[uuid.UUID]*RoomUser),
+		messages:    make(map[uuid.UUID][]*Message),
+		byID:        make(map[uuid.UUID]*Message),
+		invites:     make(map[uuid.UUID]*Invite),
+		requests:    make(map[uuid.UUID]map[uuid.UUID]*JoinRequest),
+		direct:      make(map[string]uuid.UUID),
+		reactions:   make(map[uuid.UUID][]*Reaction),
+		attachments: make(map[uuid.UUID]*Attachment),
+		mentions:    make(map[uuid.UUID]map[uuid.UUID]*time.Time),
+		pins:        make(map[uuid.UUID][]*Pin),
+
+		notifications: make(map[uuid.UUID][]*Notification),
+	}
+}
+
+func (s *memStore) CreateRoomWithCreator(ctx context.Context, r *Room) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[r.ID]; ok {
+		return errDuplicate
+	}
+	room := *r
+	if room.Visibility == "" {
+		room.Visibility = VisibilityPublic
+	}
+	if room.Kind == "" {
+		room.Kind = RoomGroup
+	}
+	s.rooms[r.ID] = &room
+	s.members[r.ID] = map[uuid.UUID]*RoomUser{r.CreatorID: {RoomID: r.ID, UserID: r.CreatorID, Role: RoleOwner}}
+	return nil
+}
+
+func (s *memStore) AddUserToRoom(ctx context.Context, ru *RoomUser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members, ok := s.members[ru.RoomID]
+	if !ok {
+		return errNotFound
+	}
+	if _, ok := members[ru.UserID]; ok {
+		return errDuplicate
+	}
+	members[ru.UserID] = &RoomUser{RoomID: ru.RoomID, UserID: ru.UserID, Role: RoleMember}
+	return nil
+}
+
+func (s *memStore) RemoveUserFromRoom(ctx context.Context, ru *RoomUser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.members[ru.RoomID][ru.UserID]; !ok {
+		return errNotFound
+	}
+	delete(s.members[ru.RoomID], ru.UserID)
+	return nil
+}
+
+func (s *memStore) IsAMember(ctx context.Context, ru *RoomUser) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.members[ru.RoomID][ru.UserID]
+	return ok, nil
+}
+
+func (s *memStore) GetRoomUser(ctx context.Context, rid uuid.UUID, uid uuid.UUID) (*RoomUser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.members[rid][uid]
+	if !ok {
+		return nil, nil
+	}
+	ru := *m
+	return &ru, nil
+}
+
+func (s *memStore) SetRole(ctx context.Context, ru *RoomUser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.members[ru.RoomID][ru.UserID]
+	if !ok {
+		return errNotFound
+	}
+	m.Role = ru.Role
+	return nil
+}
+
+func (s *memStore) GetRoomByID(ctx context.Context, rid uuid.UUID) (*Room, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.rooms[rid]
+	if !ok {
+		return nil, nil
+	}
+	room := *r
+	return &room, nil
+}
+
+func (s *memStore) RenameRoom(ctx context.Context, rid uuid.UUID, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[rid]
+	if !ok {
+		return errNotFound
+	}
+	r.Name = name
+	return nil
+}
+
+func (s *memStore) GetAllRooms(ctx context.Context) ([]*Room, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, r := range s.rooms {
+		room := *r
+		rooms = append(rooms, &room)
+	}
+	return rooms, nil
+}
+
+func (s *memStore) GetRoomsFromUser(ctx context.Context, uid uuid.UUID) ([]*Room, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rooms := make([]*Room, 0)
+	for rid, members := range s.members {
+		ru, ok := members[uid]
+		if !ok {
+			continue
+		}
+		room := *s.rooms[rid]
+		room.Role = ru.Role
+		if room.Kind == RoomDirect {
+			for peer := range members {
+				if peer == uid {
+					continue
+				}
+				name, err := s.users.GetUsernameByID(ctx, peer)
+				if err != nil {
+					return nil, err
+				}
+				room.Peer = name
+			}
+		}
+		for _, m := range s.messages[rid] {
+			if m.UserID != uid && m.ParentID == nil && m.DeletedAt == nil && (ru.LastReadAt == nil || m.Time.After(*ru.LastReadAt)) {
+				room.Unread++
+			}
+		}
+		rooms = append(rooms, &room)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if rooms[i].Name != rooms[j].Name {
+			return rooms[i].Name < rooms[j].Name
+		}
+		return bytes.Compare(rooms[i].ID.Bytes(), rooms[j].ID.Bytes()) < 0
+	})
+	return rooms, nil
+}
+
+func (s *memStore) MarkRead(ctx context.Context, ru *RoomUser, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.members[ru.RoomID][ru.UserID]
+	if !ok {
+		return false, nil
+	}
+	if m.LastReadAt != nil && !at.After(*m.LastReadAt) {
+		return false, nil
+	}
+	m.LastReadAt = &at
+	return true, nil
+}
+
+func (s *memStore) GetRoomMembers(ctx context.Context, rid uuid.UUID) ([]*Member, error) {
+	s.mu.RLock()
+	roles := make(map[uuid.UUID]Role, len(s.members[rid]))
+	for uid, ru := range s.members[rid] {
+		roles[uid] = ru.Role
+	}
+	s.mu.RUnlock()
+	members := make([]*Member, 0, len(roles))
+	for uid, role := range roles {
+		name, err := s.users.GetUsernameByID(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, &Member{UserID: uid, Username: name, Role: role})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Username < members[j].Username })
+	return members, nil
+}
+
+func (s *memStore) DeleteRoom(ctx context.Context, rid uuid.UUID) ([]uuid.UUID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.messages[rid] {
+		delete(s.byID, m.ID)
+		delete(s.reactions, m.ID)
+		delete(s.mentions, m.ID)
+	}
+	delete(s.pins, rid)
+	for id, inv := range s.invites {
+		if inv.RoomID == rid {
+			delete(s.invites, id)
+		}
+	}
+	var attachments []uuid.UUID
+	for id, a := range s.attachments {
+		if a.RoomID == rid {
+			delete(s.attachments, id)
+			attachments = append(attachments, id)
+		}
+	}
+	if r, ok := s.rooms[rid]; ok && r.DirectKey != "" {
+		delete(s.direct, r.DirectKey)
+	}
+	delete(s.requests, rid)
+	delete(s.members, rid)
+	delete(s.messages, rid)
+	delete(s.rooms, rid)
+	return attachments, nil
+}
+
+func (s *memStore) AddMessageEntry(ctx context.Context, m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[m.RoomID]; !ok {
+		return errNotFound
+	}
+	msg := *m
+	if m.Attachment != nil {
+		a, ok := s.attachments[m.Attachment.ID]
+		if !ok || a.RoomID != m.RoomID || a.UserID != m.UserID || a.MessageID != nil {
+			return errNotFound
+		}
+		attachment := *a
+		attachment.MessageID = &msg.ID
+		s.attachments[a.ID] = &attachment
+		msg.Attachment = &attachment
+	}
+	s.messages[m.RoomID] = append(s.messages[m.RoomID], &msg)
+	s.byID[m.ID] = &msg
+	return nil
+}
+
+func (s *memStore) GetMessageByID(ctx context.Context, mid uuid.UUID) (*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if m, ok := s.byID[mid]; ok {
+		msg := *m
+		return &msg, nil
+	}
+	return nil, nil
+}
+
+func (s *memStore) EditMessage(ctx context.Context, mid uuid.UUID, msg string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.byID[mid]
+	if !ok || m.DeletedAt != nil {
+		return errNotFound
+	}
+	m.Msg = msg
+	m.EditedAt = &at
+	return nil
+}
+
+func (s *memStore) DeleteMessage(ctx context.Context, mid uuid.UUID, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.byID[mid]
+	if !ok || m.DeletedAt != nil {
+		return errNotFound
+	}
+	m.DeletedAt = &at
+	return nil
+}
+
+// GetMessagesFromRoom returns a page of messages from a room, latest first,
+// to match the ordering of the postgres implementation.
+func (s *memStore) GetMessagesFromRoom(ctx context.Context, rid uuid.UUID, uid uuid.UUID, before *Cursor, limit int) ([]view.MsgDisplayData, *Cursor, error) {
+	s.mu.RLock()
+	msgs := make([]*Message, 0, len(s.messages[rid]))
+	replies := make(map[uuid.UUID]int)
+	reactions := make(map[uuid.UUID][]*Reaction)
+	mentioned := make(map[uuid.UUID]bool)
+	for _, m := range s.messages[rid] {
+		if m.ParentID != nil {
+			if m.DeletedAt == nil {
+				replies[*m.ParentID]++
+			}
+			continue
+		}
+		if before.before(m.Time, m.ID) {
+			msg := *m
+			msgs = append(msgs, &msg)
+			reactions[m.ID] = s.reactions[m.ID]
+			mentioned[m.ID] = s.isMentioned(m.ID, uid)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(msgs, func(i, j int) bool {
+		if !msgs[i].Time.Equal(msgs[j].Time) {
+			return msgs[i].Time.After(msgs[j].Time)
+		}
+		return bytes.Compare(msgs[i].ID[:], msgs[j].ID[:]) > 0
+	})
+	var next *Cursor
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+		last := msgs[len(msgs)-1]
+		next = &Cursor{Time: last.Time, ID: last.ID}
+	}
+	ms := make([]view.MsgDisplayData, 0, len(msgs))
+	for _, m := range msgs {
+		if m.DeletedAt != nil {
+			m.Msg = ""
+		}
+		ms = append(ms, view.MsgDisplayData{
+			ID:         m.ID,
+			RoomID:     m.RoomID,
+			Username:   m.Username,
+			Msg:        m.Msg,
+			Time:       formatTime(m.Time),
+			Mine:       m.UserID == uid,
+			Edited:     m.EditedAt != nil,
+			Deleted:    m.DeletedAt != nil,
+			Replies:    replies[m.ID],
+			Mentioned:  mentioned[m.ID],
+			Reactions:  summarizeReactions(reactions[m.ID], uid),
+			Attachment: attachmentDisplay(m.Attachment),
+			Preview:    previewDisplay(m.Preview),
+		})
+	}
+	return ms, next, nil
+}
+
+func (s *memStore) GetThread(ctx context.Context, parent uuid.UUID, uid uuid.UUID) ([]view.MsgDisplayData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.byID[parent]
+	if !ok {
+		return []view.MsgDisplayData{}, nil
+	}
+	// messages are kept in insertion order, which is the order of their time
+	ms := make([]view.MsgDisplayData, 0)
+	for _, m := range s.messages[p.RoomID] {
+		if m.ParentID == nil || *m.ParentID != parent {
+			continue
+		}
+		d := view.MsgDisplayData{
+			ID:        m.ID,
+			RoomID:    m.RoomID,
+			Username:  m.Username,
+			Msg:       m.Msg,
+			Time:      formatTime(m.Time),
+			Mine:      m.UserID == uid,
+			Edited:    m.EditedAt != nil,
+			Deleted:   m.DeletedAt != nil,
+			Reply:     true,
+			Reactions: summarizeReactions(s.reactions[m.ID], uid),
+			Mentioned: s.isMentioned(m.ID, uid),
+			Preview:   previewDisplay(m.Preview),
+		}
+		if d.Deleted {
+			d.Msg = ""
+		}
+		ms = append(ms, d)
+	}
+	return ms, nil
+}
+
+func (s *memStore) CountReplies(ctx context.Context, parent uuid.UUID) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.byID[parent]
+	if !ok {
+		return 0, nil
+	}
+	n := 0
+	for _, m := range s.messages[p.RoomID] {
+		if m.ParentID != nil && *m.ParentID == parent && m.DeletedAt == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memStore) SetVisibility(ctx context.Context, rid uuid.UUID, v Visibility) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[rid]
+	if !ok {
+		return errNotFound
+	}
+	r.Visibility = v
+	return nil
+}
+
+func (s *memStore) CreateInvite(ctx context.Context, inv *Invite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[inv.RoomID]; !ok {
+		return errNotFound
+	}
+	invite := *inv
+	s.invites[inv.ID] = &invite
+	return nil
+}
+
+func (s *memStore) RedeemInvite(ctx context.Context, id uuid.UUID, ru *RoomUser, at time.Time) (*Invite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv, ok := s.invites[id]
+	if !ok || inv.RoomID != ru.RoomID || !at.Before(inv.ExpiresAt) || inv.SingleUse && inv.UsedAt != nil {
+		return nil, errNotFound
+	}
+	members, ok := s.members[ru.RoomID]
+	if !ok {
+		return nil, errNotFound
+	}
+	if _, ok := members[ru.UserID]; ok {
+		return nil, errDuplicate
+	}
+	inv.UsedAt = &at
+	delete(s.requests[ru.RoomID], ru.UserID)
+	members[ru.UserID] = &RoomUser{RoomID: ru.RoomID, UserID: ru.UserID, Role: RoleMember}
+	invite := *inv
+	return &invite, nil
+}
+
+func (s *memStore) AddJoinRequest(ctx context.Context, jr *JoinRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[jr.RoomID]; !ok {
+		return errNotFound
+	}
+	if s.requests[jr.RoomID] == nil {
+		s.requests[jr.RoomID] = make(map[uuid.UUID]*JoinRequest)
+	}
+	if _, ok := s.requests[jr.RoomID][jr.UserID]; ok {
+		return errDuplicate
+	}
+	req := *jr
+	s.requests[jr.RoomID][jr.UserID] = &req
+	return nil
+}
+
+func (s *memStore) GetJoinRequests(ctx context.Context, rid uuid.UUID) ([]*JoinRequest, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	requests := make([]*JoinRequest, 0, len(s.requests[rid]))
+	for _, jr := range s.requests[rid] {
+		req := *jr
+		requests = append(requests, &req)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Time.Before(requests[j].Time) })
+	return requests, nil
+}
+
+func (s *memStore) ApproveJoinRequest(ctx context.Context, ru *RoomUser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.requests[ru.RoomID][ru.UserID]; !ok {
+		return errNotFound
+	}
+	delete(s.requests[ru.RoomID], ru.UserID)
+	s.members[ru.RoomID][ru.UserID] = &RoomUser{RoomID: ru.RoomID, UserID: ru.UserID, Role: RoleMember}
+	return nil
+}
+
+func (s *memStore) RejectJoinRequest(ctx context.Context, ru *RoomUser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.requests[ru.RoomID][ru.UserID]; !ok {
+		return errNotFound
+	}
+	delete(s.requests[ru.RoomID], ru.UserID)
+	return nil
+}
+
+func (s *memStore) GetUserByName(ctx context.Context, username string) (*Member, error) {
+	uid, err := s.users.GetUserIDByName(ctx, username)
+	if err != nil || uid == uuid.Nil {
+		return nil, err
+	}
+	// the name is looked up whatever its case
+	name, err := s.users.GetUsernameByID(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	return &Member{UserID: uid, Username: name}, nil
+}
+
+func (s *memStore) CreateDirectRoom(ctx context.Context, r *Room, a uuid.UUID, b uuid.UUID) (*Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rid, ok := s.direct[r.DirectKey]; ok {
+		room := *s.rooms[rid]
+		return &room, nil
+	}
+	room := *r
+	s.rooms[r.ID] = &room
+	s.direct[r.DirectKey] = r.ID
+	s.members[r.ID] = map[uuid.UUID]*RoomUser{
+		a: {RoomID: r.ID, UserID: a, Role: RoleMember},
+		b: {RoomID: r.ID, UserID: b, Role: RoleMember},
+	}
+	res := room
+	return &res, nil
+}
+
+func (s *memStore) AddReaction(ctx context.Context, r *Reaction, max int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byID[r.MessageID]; !ok {
+		return errNotFound
+	}
+	n := 0
+	for _, old := range s.reactions[r.MessageID] {
+		if old.UserID != r.UserID {
+			continue
+		}
+		if old.Emoji == r.Emoji {
+			return errDuplicate
+		}
+		n++
+	}
+	if n >= max {
+		return errLimit
+	}
+	reaction := *r
+	s.reactions[r.MessageID] = append(s.reactions[r.MessageID], &reaction)
+	return nil
+}
+
+func (s *memStore) RemoveReaction(ctx context.Context, r *Reaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs := s.reactions[r.MessageID]
+	for i, old := range rs {
+		if old.UserID == r.UserID && old.Emoji == r.Emoji {
+			s.reactions[r.MessageID] = append(rs[:i:i], rs[i+1:]...)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (s *memStore) GetReactions(ctx context.Context, mid uuid.UUID) ([]*Reaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rs := make([]*Reaction, 0, len(s.reactions[mid]))
+	for _, r := range s.reactions[mid] {
+		reaction := *r
+		rs = append(rs, &reaction)
+	}
+	return rs, nil
+}
+
+func (s *memStore) SearchMessages(ctx context.Context, q *SearchQuery) ([]view.SearchResultDisplayData, error) {
+	terms := searchTerms(q.Terms)
+	if len(terms) == 0 {
+		return []view.SearchResultDisplayData{}, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	found := make([]*Message, 0)
+	for rid, members := range s.members {
+		if _, ok := members[q.UserID]; !ok || (q.RoomID != uuid.Nil && rid != q.RoomID) {
+			continue
+		}
+		for _, m := range s.messages[rid] {
+			if m.DeletedAt != nil ||
+				(q.Author != "" && m.Username != q.Author) ||
+				(!q.From.IsZero() && m.Time.Before(q.From)) ||
+				(!q.To.IsZero() && !m.Time.Before(q.To)) {
+				continue
+			}
+			found = append(found, m)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].Time.Equal(found[j].Time) {
+			return found[i].Time.After(found[j].Time)
+		}
+		return bytes.Compare(found[i].ID[:], found[j].ID[:]) > 0
+	})
+	results := make([]view.SearchResultDisplayData, 0)
+	for _, m := range found {
+		if len(results) == q.Limit {
+			break
+		}
+		snippet := highlight(m.Msg, terms)
+		if snippet == nil {
+			continue
+		}
+		r := view.SearchResultDisplayData{
+			ID:        m.ID,
+			RoomID:    m.RoomID,
+			RoomName:  s.rooms[m.RoomID].Name,
+			Username:  m.Username,
+			Time:      formatTime(m.Time),
+			Snippet:   snippet,
+			ContextID: m.ID,
+		}
+		if m.ParentID != nil {
+			r.ContextID = *m.ParentID
+		}
+		if s.rooms[m.RoomID].Kind == RoomDirect {
+			for peer := range s.members[m.RoomID] {
+				if peer == q.UserID {
+					continue
+				}
+				name, err := s.users.GetUsernameByID(ctx, peer)
+				if err != nil {
+					return nil, err
+				}
+				r.RoomName = name
+			}
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func (s *memStore) AddAttachment(ctx context.Context, a *Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.attachments[a.ID]; ok {
+		return errDuplicate
+	}
+	attachment := *a
+	s.attachments[a.ID] = &attachment
+	return nil
+}
+
+func (s *memStore) GetAttachment(ctx context.Context, aid uuid.UUID) (*Attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if a, ok := s.attachments[aid]; ok {
+		attachment := *a
+		return &attachment, nil
+	}
+	return nil, nil
+}
+
+func (s *memStore) SetLinkPreview(ctx context.Context, mid uuid.UUID, p *LinkPreview) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.byID[mid]
+	if !ok {
+		return errNotFound
+	}
+	preview := *p
+	m.Preview = &preview
+	return nil
+}
+
+func (s *memStore) AddMentions(ctx context.Context, mid uuid.UUID, uids []uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byID[mid]; !ok {
+		return errNotFound
+	}
+	if s.mentions[mid] == nil {
+		s.mentions[mid] = make(map[uuid.UUID]*time.Time)
+	}
+	for _, uid := range uids {
+		if _, ok := s.mentions[mid][uid]; !ok {
+			s.mentions[mid][uid] = nil
+		}
+	}
+	return nil
+}
+
+func (s *memStore) GetMentions(ctx context.Context, uid uuid.UUID, limit int) ([]view.MentionDisplayData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	found := s.mentionsOf(uid)
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].Time.Equal(found[j].Time) {
+			return found[i].Time.After(found[j].Time)
+		}
+		return bytes.Compare(found[i].ID[:], found[j].ID[:]) > 0
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	ms := make([]view.MentionDisplayData, 0, len(found))
+	for _, m := range found {
+		d := view.MentionDisplayData{
+			ID:        m.ID,
+			RoomID:    m.RoomID,
+			RoomName:  s.rooms[m.RoomID].Name,
+			Username:  m.Username,
+			Msg:       m.Msg,
+			Time:      formatTime(m.Time),
+			ContextID: m.ID,
+			Unread:    s.mentions[m.ID][uid] == nil,
+		}
+		if m.ParentID != nil {
+			d.ContextID = *m.ParentID
+		}
+		if s.rooms[m.RoomID].Kind == RoomDirect {
+			// the other user of a direct conversation is the author
+			d.RoomName = m.Username
+		}
+		ms = append(ms, d)
+	}
+	return ms, nil
+}
+
+func (s *memStore) CountUnreadMentions(ctx context.Context, uid uuid.UUID) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, m := range s.mentionsOf(uid) {
+		if s.mentions[m.ID][uid] == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memStore) MarkMentionsRead(ctx context.Context, uid uuid.UUID, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, users := range s.mentions {
+		if read, ok := users[uid]; ok && read == nil {
+			users[uid] = &at
+		}
+	}
+	return nil
+}
+
+// isMentioned must be called with the lock held.
+func (s *memStore) isMentioned(mid uuid.UUID, uid uuid.UUID) bool {
+	_, ok := s.mentions[mid][uid]
+	return ok
+}
+
+// mentionsOf returns the messages mentioning a user that are not deleted, in
+// the rooms they are still a member of. It must be called with the lock held.
+func (s *memStore) mentionsOf(uid uuid.UUID) []*Message {
+	found := make([]*Message, 0)
+	for mid, users := range s.mentions {
+		if _, ok := users[uid]; !ok {
+			continue
+		}
+		m := s.byID[mid]
+		if _, ok := s.members[m.RoomID][uid]; !ok || m.DeletedAt != nil {
+			continue
+		}
+		found = append(found, m)
+	}
+	return found
+}
+
+func (s *memStore) PinMessage(ctx context.Context, p *Pin) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.byID[p.MessageID]; !ok || m.RoomID != p.RoomID {
+		return errNotFound
+	}
+	for _, old := range s.pins[p.RoomID] {
+		if old.MessageID == p.MessageID {
+			return errDuplicate
+		}
+	}
+	pin := *p
+	s.pins[p.RoomID] = append(s.pins[p.RoomID], &pin)
+	return nil
+}
+
+func (s *memStore) UnpinMessage(ctx context.Context, rid uuid.UUID, mid uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps := s.pins[rid]
+	for i, old := range ps {
+		if old.MessageID == mid {
+			s.pins[rid] = append(ps[:i:i], ps[i+1:]...)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (s *memStore) GetPins(ctx context.Context, rid uuid.UUID) ([]*Pin, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ps := make([]*Pin, 0, len(s.pins[rid]))
+	for i := len(s.pins[rid]) - 1; i >= 0; i-- {
+		m := s.byID[s.pins[rid][i].MessageID]
+		if m.DeletedAt != nil {
+			continue
+		}
+		pin := *s.pins[rid][i]
+		pin.Username, pin.Msg = m.Username, m.Msg
+		ps = append(ps, &pin)
+	}
+	return ps, nil
+}
+
+func (s *memStore) AddNotifications(ctx context.Context, ns []*Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range ns {
+		notification := *n
+		s.notifications[n.UserID] = append(s.notifications[n.UserID], &notification)
+	}
+	return nil
+}
+
+func (s *memStore) GetNotifications(ctx context.Context, uid uuid.UUID, limit int) ([]*Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	all := s.notifications[uid]
+	ns := make([]*Notification, 0, min(limit, len(all)))
+	for i := len(all) - 1; i >= 0 && len(ns) < limit; i-- {
+		n := *all[i]
+		ns = append(ns, &n)
+	}
+	return ns, nil
+}
+
+func (s *memStore) CountUnreadNotifications(ctx context.Context, uid uuid.UUID) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	count := 0
+	for _, n := range s.notifications[uid] {
+		if n.ReadAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memStore) MarkNotificationRead(ctx context.Context, uid uuid.UUID, nid uuid.UUID, at time.Time) (*Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.notifications[uid] {
+		if n.ID != nid {
+			continue
+		}
+		if n.ReadAt == nil {
+			n.ReadAt = &at
+		}
+		notification := *n
+		return &notification, nil
+	}
+	return nil, errNotFound
+}
+
+func (s *memStore) MarkNotificationsRead(ctx context.Context, uid uuid.UUID, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.notifications[uid] {
+		if n.ReadAt == nil {
+			n.ReadAt = &at
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+func TestMemStoreRoomsAreOrdered(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemStore(nil)
+	uid := uuid.Must(uuid.NewV4())
+	for _, name := range []string{"random", "general", "announcements", "general"} {
+		if err := s.CreateRoomWithCreator(ctx, &Room{ID: uuid.Must(uuid.NewV4()), Name: name, CreatorID: uid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		rooms, err := s.GetRoomsFromUser(ctx, uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 1; j < len(rooms); j++ {
+			a, b := rooms[j-1], rooms[j]
+			if a.Name > b.Name || (a.Name == b.Name && a.ID.String() > b.ID.String()) {
+				t.Fatalf("room %q (%v) listed before %q (%v)", a.Name, a.ID, b.Name, b.ID)
+			}
+		}
+	}
+}
+
+func TestMemStoreMarkReadOfOutsider(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemStore(nil)
+	rid, uid := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	if err := s.CreateRoomWithCreator(ctx, &Room{ID: rid, Name: "general", CreatorID: uid}); err != nil {
+		t.Fatal(err)
+	}
+	// like the update of the postgres store, which matches no row
+	advanced, err := s.MarkRead(ctx, &RoomUser{RoomID: rid, UserID: uuid.Must(uuid.NewV4())}, time.Now())
+	if err != nil || advanced {
+		t.Fatalf("got %v, %v, want false, nil", advanced, err)
+	}
+}
@@ -0,0 +1,104 @@
+package chat
+
+import (
+	"context"
+
+	"github.com/brianaung/rtm/view"
+	"github.com/gofrs/uuid/v5"
+)
+
+// mentionsLimit is the maximum number of mentions shown in the inbox.
+const mentionsLimit = 50
+
+// maxMentionNotice bounds the length of the message shown in a mention notice.
+const maxMentionNotice = 80
+
+// notifyMentions records the members of the room mentioned in m, and lets
+// each of them know on every socket they have open. Names that are not
+// members of the room are ignored, and so is the author mentioning themself.
+// It returns the users mentioned.
+func notifyMentions(ctx context.Context, rooms RoomStore, messages MessageStore, h *hub, m *Message) ([]uuid.UUID, error) {
+	names := view.MentionedNames(m.Msg)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	members, err := rooms.GetRoomMembers(ctx, m.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]uuid.UUID, len(members))
+	for _, mb := range members {
+		byName[mb.Username] = mb.UserID
+	}
+	uids := make([]uuid.UUID, 0, len(names))
+	for _, name := range names {
+		if uid, ok := byName[name]; ok && uid != m.UserID {
+			uids = append(uids, uid)
+		}
+	}
+	if len(uids) == 0 {
+		return nil, nil
+	}
+	if err := messages.AddMentions(ctx, m.ID, uids); err != nil {
+		return nil, err
+	}
+	for _, uid := range uids {
+		unread, err := messages.CountUnreadMentions(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.publish(ctx, &message{kind: messageMention, id: m.ID, parent: m.parent(), roomID: m.RoomID, userID: uid, username: m.Username, body: m.Msg, time: m.Time, unread: unread}); err != nil {
+			return nil, err
+		}
+	}
+	return uids, nil
+}
+
+// mentions reports whether a message mentions the user, for the messages
+// rendered live. The stored mentions only hold room members, but only
+// members are connected to the room anyway.
+func mentions(body string, username string) bool {
+	for _, name := range view.MentionedNames(body) {
+		if name == username {
+			return true
+		}
+	}
+	return false
+}
+
+// clientsOf returns every client of a user, dashboards and rooms alike.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) clientsOf(uid uuid.UUID) []*client {
+	var cs []*client
+	for c := range h.dashboards {
+		if c.userID == uid {
+			cs = append(cs, c)
+		}
+	}
+	for _, room := range h.rooms {
+		for c := range room {
+			if c.userID == uid {
+				cs = append(cs, c)
+			}
+		}
+	}
+	return cs
+}
+
+// mentionNotice formats a mention broadcast by the hub for MentionNotice.
+func mentionNotice(m *message) view.MentionDisplayData {
+	ctxID := m.id
+	if m.parent != uuid.Nil {
+		ctxID = m.parent
+	}
+	return view.MentionDisplayData{
+		ID:        m.id,
+		RoomID:    m.roomID,
+		Username:  m.username,
+		Msg:       truncate(m.body, maxMentionNotice),
+		Time:      formatTime(m.time),
+		ContextID: ctxID,
+		Unread:    true,
+	}
+}
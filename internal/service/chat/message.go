@@ -0,0 +1,242 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+// messageKind tells the clients what to do with a broadcasted message.
+type messageKind int
+
+const (
+	messageNew messageKind = iota
+	messageEdited
+	messageDeleted
+	messageTypingStarted
+	messageTypingStopped
+	// messageTyping carries the users typing in a room, it is created by
+	// the hub of each node and never goes through the backplane.
+	messageTyping
+	// presence announcements exchanged between the nodes
+	messagePresenceJoined
+	messagePresenceLeft
+	messagePresenceHeartbeat
+	messagePresenceSync
+	// messagePresence tells the clients of a node that a user went online
+	// or offline, it never goes through the backplane.
+	messagePresence
+	// messageRead tells the dashboards of a user that they read a room.
+	messageRead
+	// messageMemberLeft and messageRoomDeleted disconnect clients from a
+	// room on every node.
+	messageMemberLeft
+	messageRoomDeleted
+	// room moderation, see room.go
+	messageMemberKicked
+	messageRoomRenamed
+	messageRoleChanged
+	// join requests of approval-required rooms, see access.go
+	messageJoinRequested
+	messageJoinResolved
+	// messageReply is a message in the thread of another one, see thread.go
+	messageReply
+	// messageReplyCount tells the clients not viewing a thread how many
+	// replies it has, it never goes through the backplane.
+	messageReplyCount
+	// messageReactions tells that the reactions to a message changed, the
+	// hubs load them, see reaction.go
+	messageReactions
+	// messagePreview carries the link preview of a message, see preview.go
+	messagePreview
+	// messageMention tells a user they were mentioned, see mention.go
+	messageMention
+	// messageNotification carries a notification to the streams of its
+	// user, see notification.go
+	messageNotification
+	// messagePins carries the pinned messages of a room, see pin.go
+	messagePins
+)
+
+// maxMessageLen is the longest message, in characters, that can be sent or
+// edited in, over the websocket or http alike.
+const maxMessageLen = 2000
+
+var (
+	errForbidden      = errors.New("You can only change your own messages.")
+	errEmptyMessage   = errors.New("Message cannot be empty.")
+	errMessageTooLong = errors.New("Message cannot be longer than 2000 characters.")
+)
+
+// sendMessage stores a new message from uid in the room rid and broadcasts it,
+// as long as uid is a member of the room.
+// The message may carry an attachment uploaded beforehand by uid, in which
+// case its text may be empty.
+func sendMessage(ctx context.Context, messages MessageStore, rooms RoomStore, h *hub, uid uuid.UUID, username string, rid uuid.UUID, body string, aid uuid.UUID) (*Message, error) {
+	body = strings.TrimSpace(body)
+	if body == "" && aid == uuid.Nil {
+		return nil, errEmptyMessage
+	} else if utf8.RuneCountInString(body) > maxMessageLen {
+		return nil, errMessageTooLong
+	}
+	if err := member(ctx, rooms, rid, uid); err != nil {
+		return nil, err
+	}
+	m := &Message{ID: uuid.Must(uuid.NewV4()), Msg: body, Time: time.Now(), RoomID: rid, UserID: uid, Username: username}
+	if aid != uuid.Nil {
+		a, err := messages.GetAttachment(ctx, aid)
+		if err != nil {
+			return nil, err
+		}
+		if a == nil || a.RoomID != rid || a.UserID != uid || a.MessageID != nil {
+			return nil, errInvalidAttachment
+		}
+		m.Attachment = a
+	}
+	if err := messages.AddMessageEntry(ctx, m); errors.Is(err, errNotFound) && m.Attachment != nil {
+		// the attachment was sent with another message in the meantime
+		return nil, errInvalidAttachment
+	} else if err != nil {
+		return nil, err
+	}
+	if err := h.publish(ctx, &message{id: m.ID, body: m.Msg, roomID: m.RoomID, userID: m.UserID, username: m.Username, time: m.Time, attachment: m.Attachment}); err != nil {
+		// the message is saved, the clients see it once they reload
+		log.Printf("error: %v", err)
+	}
+	return m, nil
+}
+
+// editMessage replaces the content of a message and broadcasts the change.
+//
+// It is shared by the websocket and the http handlers. Only the author can
+// edit their message, only while it is not deleted and while they are still
+// a member of the room.
+func editMessage(ctx context.Context, messages MessageStore, rooms RoomStore, h *hub, uid uuid.UUID, rid uuid.UUID, mid uuid.UUID, body string) (*Message, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return nil, errEmptyMessage
+	} else if utf8.RuneCountInString(body) > maxMessageLen {
+		return nil, errMessageTooLong
+	}
+	if err := member(ctx, rooms, rid, uid); err != nil {
+		return nil, err
+	}
+	m, err := ownMessage(ctx, messages, uid, rid, mid)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := messages.EditMessage(ctx, mid, body, now); err != nil {
+		return nil, err
+	}
+	m.Msg, m.EditedAt = body, &now
+	// the edit is saved, failing to push it is only logged
+	if err := publishEdit(ctx, messages, h, m); err != nil {
+		log.Printf("error: %v", err)
+	}
+	return m, nil
+}
+
+// publishEdit broadcasts an edited message, and the pinned panel quoting it.
+// The edited message is rendered anew, with its reactions loaded by the hubs.
+func publishEdit(ctx context.Context, messages MessageStore, h *hub, m *Message) error {
+	if err := h.publish(ctx, &message{kind: messageEdited, id: m.ID, parent: m.parent(), roomID: m.RoomID, userID: m.UserID, username: m.Username, body: m.Msg, time: m.Time, attachment: m.Attachment, preview: m.Preview}); err != nil {
+		return err
+	}
+	return refreshPin(ctx, messages, h, m)
+}
+
+// deleteMessage soft deletes a message and broadcasts the change.
+//
+// It is shared by the websocket and the http handlers. The author can delete
+// their message, and so can the moderators of the room who outrank them.
+func deleteMessage(ctx context.Context, messages MessageStore, rooms RoomStore, h *hub, uid uuid.UUID, rid uuid.UUID, mid uuid.UUID) (*Message, error) {
+	m, err := roomMessage(ctx, messages, rid, mid)
+	if err != nil {
+		return nil, err
+	}
+	if m.UserID != uid {
+		if err := moderate(ctx, rooms, uid, m); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	if err := messages.DeleteMessage(ctx, mid, now); err != nil {
+		return nil, err
+	}
+	m.Msg, m.DeletedAt = "", &now
+	var replies int
+	if m.ParentID != nil {
+		if replies, err = messages.CountReplies(ctx, *m.ParentID); err != nil {
+			return nil, err
+		}
+	}
+	if err := h.publish(ctx, &message{kind: messageDeleted, id: m.ID, parent: m.parent(), replies: replies, roomID: m.RoomID, userID: m.UserID, username: m.Username, time: m.Time}); err != nil {
+		// the message is deleted, the clients see it once they reload
+		log.Printf("error: %v", err)
+	}
+	// deleted messages do not stay pinned
+	if err := messages.UnpinMessage(ctx, rid, mid); errors.Is(err, errNotFound) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if _, err := publishPins(ctx, messages, h, rid); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ownMessage fetches a live message of the room rid written by uid.
+func ownMessage(ctx context.Context, messages MessageStore, uid uuid.UUID, rid uuid.UUID, mid uuid.UUID) (*Message, error) {
+	m, err := roomMessage(ctx, messages, rid, mid)
+	if err != nil {
+		return nil, err
+	}
+	if m.UserID != uid {
+		return nil, errForbidden
+	}
+	return m, nil
+}
+
+// roomMessage fetches a live message of the room rid.
+func roomMessage(ctx context.Context, messages MessageStore, rid uuid.UUID, mid uuid.UUID) (*Message, error) {
+	m, err := messages.GetMessageByID(ctx, mid)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil || m.RoomID != rid || m.DeletedAt != nil {
+		return nil, errNotFound
+	}
+	return m, nil
+}
+
+// moderate checks that uid may change the message of another member, i.e.
+// has the permission to moderate the room and outranks the author. Authors
+// who left the room are treated as plain members.
+func moderate(ctx context.Context, rooms RoomStore, uid uuid.UUID, m *Message) error {
+	ru, err := rooms.GetRoomUser(ctx, m.RoomID, uid)
+	if err != nil {
+		return err
+	}
+	if ru == nil || !ru.Role.can(permModerate) {
+		return errForbidden
+	}
+	author, err := rooms.GetRoomUser(ctx, m.RoomID, m.UserID)
+	if err != nil {
+		return err
+	}
+	role := RoleMember
+	if author != nil {
+		role = author.Role
+	}
+	if !ru.Role.outranks(role) {
+		return errForbidden
+	}
+	return nil
+}
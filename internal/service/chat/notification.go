@@ -0,0 +1,231 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/brianaung/rtm/view"
+	"github.com/gofrs/uuid/v5"
+)
+
+// NotificationKind tells what a notification is about.
+type NotificationKind string
+
+const (
+	// NotificationMention is a message of a group room mentioning the user.
+	NotificationMention NotificationKind = "mention"
+	// NotificationDirect is a message sent to the user in a direct
+	// conversation, mentions included.
+	NotificationDirect NotificationKind = "direct"
+	// NotificationInvite tells the creator of an invite link that someone
+	// joined with it.
+	NotificationInvite NotificationKind = "invite"
+	// NotificationApproved tells the user their join request was approved.
+	NotificationApproved NotificationKind = "approved"
+	// NotificationRoomDeleted tells the members of a room it was deleted.
+	NotificationRoomDeleted NotificationKind = "room_deleted"
+)
+
+const (
+	// notificationsLimit is the maximum number of notifications listed.
+	notificationsLimit = 50
+	// dashboardNotifications is the number of notifications shown on the
+	// dashboard.
+	dashboardNotifications = 5
+	// maxNotificationBody bounds the length of the message quoted by a
+	// notification.
+	maxNotificationBody = 80
+	// streamKeepAlive is how often an idle notification stream gets a
+	// comment.
+	streamKeepAlive = 30 * time.Second
+)
+
+// stream is a Server-Sent Events connection receiving the notifications of a
+// user, see serveNotifications.
+type stream struct {
+	userID uuid.UUID
+	// Buffered channel of notifications, closed by the hub.
+	send chan *message
+}
+
+func newStream(uid uuid.UUID) *stream {
+	return &stream{userID: uid, send: make(chan *message, 16)}
+}
+
+// addStream registers a notification stream to the hub.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) addStream(st *stream) {
+	if h.streams[st.userID] == nil {
+		h.streams[st.userID] = make(map[*stream]bool)
+	}
+	h.streams[st.userID][st] = true
+}
+
+// removeStream removes a notification stream from the hub and closes its
+// send channel.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) removeStream(st *stream) {
+	if !h.streams[st.userID][st] {
+		return
+	}
+	delete(h.streams[st.userID], st)
+	if len(h.streams[st.userID]) == 0 {
+		delete(h.streams, st.userID)
+	}
+	close(st.send)
+}
+
+// deliverNotification sends a notification to the streams of its user,
+// dropping the ones that are not keeping up.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) deliverNotification(m *message) {
+	for st := range h.streams[m.userID] {
+		select {
+		case st.send <- m:
+		default:
+			h.removeStream(st)
+		}
+	}
+}
+
+// writeEvent writes a Server-Sent Event, the lines of data each get their
+// own field.
+func writeEvent(w io.Writer, event string, data string) error {
+	var buf bytes.Buffer
+	buf.WriteString("event: " + event + "\n")
+	for _, line := range strings.Split(data, "\n") {
+		buf.WriteString("data: " + line + "\n")
+	}
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// notify stores notifications and pushes each of them to its user.
+func notify(ctx context.Context, notifications NotificationStore, h *hub, ns []*Notification) error {
+	if len(ns) == 0 {
+		return nil
+	}
+	if err := notifications.AddNotifications(ctx, ns); err != nil {
+		return err
+	}
+	for _, n := range ns {
+		unread, err := notifications.CountUnreadNotifications(ctx, n.UserID)
+		if err != nil {
+			return err
+		}
+		if err := h.publish(ctx, &message{kind: messageNotification, userID: n.UserID, notification: n, unread: unread}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newNotification(uid uuid.UUID, kind NotificationKind, room *Room, actor string) *Notification {
+	return &Notification{ID: uuid.Must(uuid.NewV4()), UserID: uid, Kind: kind, RoomID: room.ID, RoomName: room.Name, Actor: actor, Time: time.Now()}
+}
+
+// notifyMessage notifies the other user of a direct conversation of a new
+// message, or the members of a group room mentioned in it.
+func notifyMessage(ctx context.Context, rooms RoomStore, notifications NotificationStore, h *hub, m *Message, mentioned []uuid.UUID) error {
+	room, err := rooms.GetRoomByID(ctx, m.RoomID)
+	if err != nil || room == nil {
+		return err
+	}
+	kind, uids := NotificationMention, mentioned
+	if room.Kind == RoomDirect {
+		members, err := rooms.GetRoomMembers(ctx, m.RoomID)
+		if err != nil {
+			return err
+		}
+		kind, uids = NotificationDirect, nil
+		for _, mb := range members {
+			if mb.UserID != m.UserID {
+				uids = append(uids, mb.UserID)
+			}
+		}
+	}
+	at := m.ID
+	if m.ParentID != nil {
+		at = *m.ParentID
+	}
+	ns := make([]*Notification, 0, len(uids))
+	for _, uid := range uids {
+		n := newNotification(uid, kind, room, m.Username)
+		n.MessageID = &at
+		n.Body = truncate(m.Msg, maxNotificationBody)
+		if kind == NotificationDirect {
+			// direct conversations are named after the other user
+			n.RoomName = m.Username
+		}
+		ns = append(ns, n)
+	}
+	return notify(ctx, notifications, h, ns)
+}
+
+// notifyInviteUsed tells the creator of an invite that username joined with it.
+func notifyInviteUsed(ctx context.Context, rooms RoomStore, notifications NotificationStore, h *hub, inv *Invite, username string) error {
+	room, err := rooms.GetRoomByID(ctx, inv.RoomID)
+	if err != nil || room == nil {
+		return err
+	}
+	return notify(ctx, notifications, h, []*Notification{newNotification(inv.CreatedBy, NotificationInvite, room, username)})
+}
+
+// notifyApproved tells a user that username let them into a room.
+func notifyApproved(ctx context.Context, rooms RoomStore, notifications NotificationStore, h *hub, rid uuid.UUID, uid uuid.UUID, username string) error {
+	room, err := rooms.GetRoomByID(ctx, rid)
+	if err != nil || room == nil {
+		return err
+	}
+	return notify(ctx, notifications, h, []*Notification{newNotification(uid, NotificationApproved, room, username)})
+}
+
+// notifyRoomDeleted tells the members of a deleted room, but the one who
+// deleted it, that it is gone. The room and its members are looked up before
+// the deletion.
+func notifyRoomDeleted(ctx context.Context, notifications NotificationStore, h *hub, room *Room, members []*Member, uid uuid.UUID, username string) error {
+	ns := make([]*Notification, 0, len(members))
+	for _, mb := range members {
+		if mb.UserID != uid {
+			ns = append(ns, newNotification(mb.UserID, NotificationRoomDeleted, room, username))
+		}
+	}
+	return notify(ctx, notifications, h, ns)
+}
+
+// notificationDisplay formats a notification for the html templates. Deleted
+// rooms are not linked to.
+func notificationDisplay(n *Notification) view.NotificationDisplayData {
+	d := view.NotificationDisplayData{
+		ID:       n.ID,
+		Kind:     string(n.Kind),
+		RoomName: n.RoomName,
+		Actor:    n.Actor,
+		Body:     n.Body,
+		Time:     formatTime(n.Time),
+		Unread:   n.ReadAt == nil,
+	}
+	switch {
+	case n.Kind == NotificationRoomDeleted:
+	case n.MessageID != nil:
+		d.Link = "/room/" + n.RoomID.String() + "?at=" + n.MessageID.String() + "#msg-" + n.MessageID.String()
+	default:
+		d.Link = "/room/" + n.RoomID.String()
+	}
+	return d
+}
+
+func notificationsDisplay(ns []*Notification) []view.NotificationDisplayData {
+	ds := make([]view.NotificationDisplayData, 0, len(ns))
+	for _, n := range ns {
+		ds = append(ds, notificationDisplay(n))
+	}
+	return ds
+}
@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+// Role is the rank of a member in a room.
+type Role string
+
+const (
+	RoleOwner  Role = "owner"
+	RoleAdmin  Role = "admin"
+	RoleMember Role = "member"
+)
+
+// permission is an action in a room that not every member may take.
+type permission int
+
+const (
+	permDeleteRoom permission = iota
+	permRenameRoom
+	permKickMember
+	permPinMessage
+	// permModerate allows deleting the messages of other members.
+	permModerate
+	// permManageRoles allows promoting members to admins and back.
+	permManageRoles
+	// permManageAccess allows changing the visibility of the room, inviting
+	// users and approving their join requests.
+	permManageAccess
+)
+
+var rolePermissions = map[Role]map[permission]bool{
+	RoleOwner: {
+		permDeleteRoom:   true,
+		permRenameRoom:   true,
+		permKickMember:   true,
+		permPinMessage:   true,
+		permModerate:     true,
+		permManageRoles:  true,
+		permManageAccess: true,
+	},
+	RoleAdmin: {
+		permRenameRoom: true,
+		permKickMember: true,
+		permPinMessage: true,
+		permModerate:   true,
+	},
+	RoleMember: {},
+}
+
+var (
+	errNoAccess     = errors.New("You do not have access to the room.")
+	errNoPermission = errors.New("You do not have permission to do this.")
+	errInvalidRole  = errors.New("Invalid role.")
+)
+
+// can reports whether the role grants the permission. Unknown roles grant nothing.
+func (r Role) can(p permission) bool {
+	return rolePermissions[r][p]
+}
+
+func (r Role) rank() int {
+	switch r {
+	case RoleOwner:
+		return 2
+	case RoleAdmin:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// outranks reports whether a member with the role can act on a member with
+// the other role, e.g. kick them or delete their messages. Admins cannot act
+// on each other, and nobody can act on the owner.
+func (r Role) outranks(other Role) bool {
+	return r.rank() > other.rank()
+}
+
+// member checks that uid is still a member of the room rid. Clients are
+// connected to a room as members, but they stay connected a little while
+// after leaving, until the hub hears about it.
+func member(ctx context.Context, rooms RoomStore, rid uuid.UUID, uid uuid.UUID) error {
+	ru, err := rooms.GetRoomUser(ctx, rid, uid)
+	if err != nil {
+		return err
+	}
+	if ru == nil {
+		return errNoAccess
+	}
+	return nil
+}
+
+// authorize checks that uid is a member of the room rid with a role granting
+// the permission, and returns their membership.
+//
+// It is shared by the websocket and the http handlers, so that both enforce
+// the same rules.
+func authorize(ctx context.Context, rooms RoomStore, rid uuid.UUID, uid uuid.UUID, p permission) (*RoomUser, error) {
+	ru, err := rooms.GetRoomUser(ctx, rid, uid)
+	if err != nil {
+		return nil, err
+	}
+	if ru == nil {
+		return nil, errNoAccess
+	}
+	if !ru.Role.can(p) {
+		return nil, errNoPermission
+	}
+	return ru, nil
+}
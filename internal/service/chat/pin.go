@@ -0,0 +1,121 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/brianaung/rtm/view"
+	"github.com/gofrs/uuid/v5"
+)
+
+const (
+	// maxPinLen bounds the length of the message quoted by the pinned panel.
+	maxPinLen = 80
+	// maxPins is the most messages a room can have pinned.
+	maxPins = 25
+)
+
+var (
+	errTooManyPins   = errors.New("A room cannot have more than 25 pinned messages.")
+	errAlreadyPinned = errors.New("The message is already pinned.")
+	errNotPinned     = errors.New("The message is not pinned.")
+	errPinReply      = errors.New("Replies cannot be pinned.")
+)
+
+// pinMessage pins a message of the room rid, and broadcasts and returns the
+// pins of the room. Only the members allowed to pin messages can, and only messages
+// that are not replies.
+func pinMessage(ctx context.Context, rooms RoomStore, messages MessageStore, h *hub, uid uuid.UUID, rid uuid.UUID, mid uuid.UUID) ([]*Pin, error) {
+	if _, err := authorize(ctx, rooms, rid, uid, permPinMessage); err != nil {
+		return nil, err
+	}
+	m, err := roomMessage(ctx, messages, rid, mid)
+	if err != nil {
+		return nil, err
+	}
+	if m.ParentID != nil {
+		return nil, errPinReply
+	}
+	pins, err := messages.GetPins(ctx, rid)
+	if err != nil {
+		return nil, err
+	}
+	if len(pins) >= maxPins {
+		return nil, errTooManyPins
+	}
+	if err := messages.PinMessage(ctx, &Pin{RoomID: rid, MessageID: mid, PinnedBy: uid, Time: time.Now()}); errors.Is(err, errDuplicate) {
+		return nil, errAlreadyPinned
+	} else if err != nil {
+		return nil, err
+	}
+	return publishPins(ctx, messages, h, rid)
+}
+
+// unpinMessage unpins a message of the room rid, and broadcasts and returns
+// the pins of the room.
+func unpinMessage(ctx context.Context, rooms RoomStore, messages MessageStore, h *hub, uid uuid.UUID, rid uuid.UUID, mid uuid.UUID) ([]*Pin, error) {
+	if _, err := authorize(ctx, rooms, rid, uid, permPinMessage); err != nil {
+		return nil, err
+	}
+	if err := messages.UnpinMessage(ctx, rid, mid); errors.Is(err, errNotFound) {
+		return nil, errNotPinned
+	} else if err != nil {
+		return nil, err
+	}
+	return publishPins(ctx, messages, h, rid)
+}
+
+// publishPins broadcasts every pinned message of a room, so that the clients
+// replace their pinned panel.
+func publishPins(ctx context.Context, messages MessageStore, h *hub, rid uuid.UUID) ([]*Pin, error) {
+	pins, err := messages.GetPins(ctx, rid)
+	if err != nil {
+		return nil, err
+	}
+	return pins, h.publish(ctx, &message{kind: messagePins, roomID: rid, pins: quotedPins(pins)})
+}
+
+// quotedPins copies pins with their message cut to what the pinned panel
+// shows, which is all that needs to go through the backplane.
+func quotedPins(pins []*Pin) []*Pin {
+	qs := make([]*Pin, 0, len(pins))
+	for _, p := range pins {
+		q := *p
+		q.Msg = truncate(q.Msg, maxPinLen)
+		qs = append(qs, &q)
+	}
+	return qs
+}
+
+// refreshPin broadcasts the pins of the room of m again if m is one of them,
+// after it changed.
+func refreshPin(ctx context.Context, messages MessageStore, h *hub, m *Message) error {
+	if m.ParentID != nil {
+		return nil
+	}
+	pins, err := messages.GetPins(ctx, m.RoomID)
+	if err != nil {
+		return err
+	}
+	for _, p := range pins {
+		if p.MessageID == m.ID {
+			return h.publish(ctx, &message{kind: messagePins, roomID: m.RoomID, pins: quotedPins(pins)})
+		}
+	}
+	return nil
+}
+
+// pinsDisplay formats the pins of a room for the html templates.
+func pinsDisplay(pins []*Pin) []view.PinDisplayData {
+	ds := make([]view.PinDisplayData, 0, len(pins))
+	for _, p := range pins {
+		ds = append(ds, view.PinDisplayData{
+			MessageID: p.MessageID,
+			Username:  p.Username,
+			Msg:       truncate(p.Msg, maxPinLen),
+			Time:      formatTime(p.Time),
+		})
+	}
+	return ds
+}
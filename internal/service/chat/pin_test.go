@@ -0,0 +1,57 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+func TestPinsAreCappedAndQuoted(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore(nil)
+	h := newTestHub(t)
+	rid, alice := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	if err := store.CreateRoomWithCreator(ctx, &Room{ID: rid, Name: "general", CreatorID: alice}); err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(h, rid, alice, "alice", nil)
+	h.register <- c
+	post := func() uuid.UUID {
+		m := &Message{ID: uuid.Must(uuid.NewV4()), RoomID: rid, UserID: alice, Msg: strings.Repeat("a", maxMessageLen), Time: time.Now()}
+		if err := store.AddMessageEntry(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+		return m.ID
+	}
+
+	for i := 0; i < maxPins; i++ {
+		if _, err := pinMessage(ctx, store, store, h, alice, rid, post()); err != nil {
+			t.Fatalf("pin %d: %v", i+1, err)
+		}
+		got := nextMessage(t, c, messagePins)
+		if len(got.pins) != i+1 {
+			t.Fatalf("got %d pins, want %d", len(got.pins), i+1)
+		}
+		for _, p := range got.pins {
+			if n := utf8.RuneCountInString(p.Msg); n > maxPinLen {
+				t.Fatalf("published a pin quoting %d runes, want at most %d", n, maxPinLen)
+			}
+		}
+	}
+	if _, err := pinMessage(ctx, store, store, h, alice, rid, post()); !errors.Is(err, errTooManyPins) {
+		t.Fatalf("got %v, want errTooManyPins", err)
+	}
+	// only the published copies are cut, the store keeps the whole messages
+	pins, err := store.GetPins(ctx, rid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != maxPins || len(pins[0].Msg) != maxMessageLen {
+		t.Fatalf("got %d pins of %d bytes, want %d of %d", len(pins), len(pins[0].Msg), maxPins, maxMessageLen)
+	}
+}
@@ -0,0 +1,185 @@
+package chat
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+const (
+	// Every node announces the users connected to it this often.
+	presenceInterval = 30 * time.Second
+	// Users seen on another node are considered gone if that node has not
+	// announced them for this long, e.g. because it crashed or we missed
+	// their leave.
+	presenceTimeout = 3 * presenceInterval
+	// presenceChunk is the most users announced by one heartbeat message,
+	// so that heartbeats of crowded rooms fit in a notification.
+	presenceChunk = 50
+)
+
+// presence is the online state of a user in a room. A user is online as long
+// as at least one node has a client of theirs connected to the room, no matter
+// how many tabs they have opened.
+type presence struct {
+	username string
+	nodes    map[uuid.UUID]time.Time // node id -> last time the node announced the user
+}
+
+// presenceQuery asks the hub for the online users of a room.
+type presenceQuery struct {
+	roomID uuid.UUID
+	reply  chan map[uuid.UUID]bool
+}
+
+// online returns the users currently connected to a room, on any node.
+func (h *hub) online(ctx context.Context, rid uuid.UUID) (map[uuid.UUID]bool, error) {
+	q := &presenceQuery{roomID: rid, reply: make(chan map[uuid.UUID]bool, 1)}
+	select {
+	case h.presenceQuery <- q:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case users := <-q.reply:
+		return users, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// answerPresence replies to a presence query.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) answerPresence(q *presenceQuery) {
+	users := make(map[uuid.UUID]bool, len(h.presence[q.roomID]))
+	for uid := range h.presence[q.roomID] {
+		users[uid] = true
+	}
+	q.reply <- users
+}
+
+// setPresence records whether a node has a user connected to a room, and
+// tells the clients of the room when the user goes online or offline.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) setPresence(rid uuid.UUID, uid uuid.UUID, username string, node uuid.UUID, online bool, at time.Time) {
+	room := h.presence[rid]
+	p, was := room[uid]
+	if online {
+		if room == nil {
+			room = make(map[uuid.UUID]*presence)
+			h.presence[rid] = room
+		}
+		if !was {
+			p = &presence{username: username, nodes: make(map[uuid.UUID]time.Time)}
+			room[uid] = p
+		}
+		p.nodes[node] = at
+	} else if was {
+		delete(p.nodes, node)
+		if len(p.nodes) > 0 {
+			return
+		}
+		delete(room, uid)
+		if len(room) == 0 {
+			delete(h.presence, rid)
+		}
+	}
+	if was != online {
+		h.deliver(&message{kind: messagePresence, roomID: rid, userID: uid, username: username, online: online})
+	}
+}
+
+// localPresence updates the presence of the user of a client that has just
+// been registered or unregistered, and announces it to the other nodes when
+// the user's first client connects or their last one disconnects.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) localPresence(c *client) {
+	for other := range h.rooms[c.roomID] {
+		if other != c && other.userID == c.userID {
+			// the user has another client connected here
+			return
+		}
+	}
+	_, joined := h.rooms[c.roomID][c]
+	kind := messagePresenceLeft
+	if joined {
+		kind = messagePresenceJoined
+	}
+	h.setPresence(c.roomID, c.userID, c.username, h.nodeID, joined, time.Now())
+	go h.announce(&message{kind: kind, node: h.nodeID, roomID: c.roomID, userID: c.userID, username: c.username})
+}
+
+// remotePresence applies a presence message published by another node.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) remotePresence(m *message) {
+	if m.node == h.nodeID {
+		// our own announcements, already applied
+		return
+	}
+	now := time.Now()
+	switch m.kind {
+	case messagePresenceJoined, messagePresenceLeft:
+		h.setPresence(m.roomID, m.userID, m.username, m.node, m.kind == messagePresenceJoined, now)
+	case messagePresenceHeartbeat:
+		// a heartbeat may only carry some of the users of the node, the
+		// ones it no longer has expire, see expirePresence
+		for _, mb := range m.members {
+			h.setPresence(m.roomID, mb.UserID, mb.Username, m.node, true, now)
+		}
+	case messagePresenceSync:
+		// a node has just started, let it know who is here right away
+		h.heartbeat()
+	}
+}
+
+// heartbeat announces the users connected to this node, room by room, in
+// chunks of presenceChunk users.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) heartbeat() {
+	for rid, clients := range h.rooms {
+		seen := make(map[uuid.UUID]bool)
+		members := make([]Member, 0, len(clients))
+		for c := range clients {
+			if !seen[c.userID] {
+				seen[c.userID] = true
+				members = append(members, Member{UserID: c.userID, Username: c.username})
+			}
+		}
+		for len(members) > 0 {
+			n := min(len(members), presenceChunk)
+			go h.announce(&message{kind: messagePresenceHeartbeat, node: h.nodeID, roomID: rid, members: members[:n]})
+			members = members[n:]
+		}
+	}
+}
+
+// expirePresence forgets the users that nodes have stopped announcing, or
+// whose nodes have gone quiet.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) expirePresence(now time.Time) {
+	for rid, room := range h.presence {
+		for uid, p := range room {
+			for node, at := range p.nodes {
+				if node != h.nodeID && now.Sub(at) > presenceTimeout {
+					h.setPresence(rid, uid, p.username, node, false, now)
+				}
+			}
+		}
+	}
+}
+
+// announce publishes a presence message to the other nodes. It is run in
+// its own goroutine, as the hub cannot block on the backplane that feeds it.
+func (h *hub) announce(m *message) {
+	if err := h.publish(context.Background(), m); err != nil {
+		log.Printf("error: %v", err)
+	}
+}
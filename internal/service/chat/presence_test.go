@@ -0,0 +1,65 @@
+package chat
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+func TestHeartbeatChunks(t *testing.T) {
+	bp := NewLocalBackplane()
+	h := newHub(bp, NewMemStore(nil))
+	rid := uuid.Must(uuid.NewV4())
+	h.rooms[rid] = make(map[*client]bool)
+	const users = 2*presenceChunk + 20
+	for i := 0; i < users; i++ {
+		// usernames as long as they get
+		c := newClient(h, rid, uuid.Must(uuid.NewV4()), fmt.Sprintf("user_%026d", i), nil)
+		h.rooms[rid][c] = true
+	}
+
+	h.heartbeat()
+
+	// another node, fed with the chunks
+	other := newHub(NewLocalBackplane(), NewMemStore(nil))
+	announced := 0
+	for announced < users {
+		select {
+		case payload := <-bp.Subscribe():
+			if len(payload) > maxNotifyPayload {
+				t.Fatalf("heartbeat of %d bytes does not fit in a notification", len(payload))
+			}
+			m, err := decodeMessage(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m.members) > presenceChunk {
+				t.Fatalf("heartbeat announces %d users, want at most %d", len(m.members), presenceChunk)
+			}
+			announced += len(m.members)
+			other.remotePresence(m)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d users announced, want %d", announced, users)
+		}
+	}
+	// a chunk does not take the users of the previous ones offline
+	if got := len(other.presence[rid]); got != users {
+		t.Fatalf("%d users online on the other node, want %d", got, users)
+	}
+}
+
+func TestPresenceExpires(t *testing.T) {
+	h := newHub(NewLocalBackplane(), NewMemStore(nil))
+	rid, node := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	now := time.Now()
+	h.setPresence(rid, uuid.Must(uuid.NewV4()), "stale", node, true, now.Add(-presenceTimeout-time.Second))
+	h.setPresence(rid, uuid.Must(uuid.NewV4()), "fresh", node, true, now)
+
+	h.expirePresence(now)
+
+	if got := len(h.presence[rid]); got != 1 {
+		t.Fatalf("%d users online, want only the fresh one", got)
+	}
+}
@@ -0,0 +1,338 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/brianaung/rtm/view"
+	"golang.org/x/net/html"
+)
+
+const (
+	// previewTimeout bounds the whole fetch of a page, redirects included.
+	previewTimeout = 5 * time.Second
+	// previewMaxBody is how much of a page is read to find its metadata.
+	previewMaxBody = 512 << 10
+	// previewCacheTTL is how long a page is not fetched again, whether it had
+	// a preview or not.
+	previewCacheTTL  = time.Hour
+	previewCacheSize = 1024
+	previewWorkers   = 4
+	previewQueueSize = 256
+)
+
+var errBlockedAddress = errors.New("address is not allowed")
+
+// blockedNets are the special purpose ranges not covered by the net.IP
+// predicates used by publicIP.
+var blockedNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"100.64.0.0/10",
+		"192.0.0.0/24",
+		"198.18.0.0/15",
+		"240.0.0.0/4",
+		"64:ff9b::/96",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// previewJob is a message waiting for the preview of its first link.
+type previewJob struct {
+	m   *Message
+	url string
+}
+
+type cachedPreview struct {
+	// preview is nil for pages without a title
+	preview *LinkPreview
+	expires time.Time
+}
+
+// previewer fetches the OpenGraph metadata of the links posted in messages,
+// in the background, and attaches it to the messages once it is known.
+//
+// The pages are fetched from the server, so the client refuses to connect to
+// anything but public addresses on the default http(s) ports. The check is
+// made on the address actually dialed, after name resolution and on every
+// redirect, so that a host cannot resolve to an internal address.
+type previewer struct {
+	messages MessageStore
+	hub      *hub
+	client   *http.Client
+	jobs     chan *previewJob
+	mu       sync.Mutex
+	cache    map[string]*cachedPreview
+}
+
+func newPreviewer(messages MessageStore, h *hub) *previewer {
+	dialer := &net.Dialer{Timeout: previewTimeout, Control: guardAddress}
+	return &previewer{
+		messages: messages,
+		hub:      h,
+		client: &http.Client{
+			Timeout: previewTimeout,
+			Transport: &http.Transport{
+				// no proxy, it would dial the internal addresses for us
+				Proxy:                 nil,
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   previewTimeout,
+				ResponseHeaderTimeout: previewTimeout,
+				MaxIdleConns:          16,
+				IdleConnTimeout:       time.Minute,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 3 {
+					return errors.New("too many redirects")
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return errBlockedAddress
+				}
+				return nil
+			},
+		},
+		jobs:  make(chan *previewJob, previewQueueSize),
+		cache: make(map[string]*cachedPreview),
+	}
+}
+
+// run starts the workers fetching the previews.
+func (p *previewer) run() {
+	for i := 0; i < previewWorkers; i++ {
+		go func() {
+			for j := range p.jobs {
+				p.process(j)
+			}
+		}()
+	}
+}
+
+// enqueue asks for the preview of the first link of m, if it has one. The
+// preview is skipped when the queue is full, previews are a nicety and
+// sending messages must not wait for them. It is a no-op on a nil previewer,
+// when previews are disabled.
+func (p *previewer) enqueue(m *Message) {
+	if p == nil {
+		return
+	}
+	link := view.FirstLink(m.Msg)
+	if link == "" {
+		return
+	}
+	select {
+	case p.jobs <- &previewJob{m: m, url: link}:
+	default:
+		log.Printf("preview: queue full, skipping %s", link)
+	}
+}
+
+func (p *previewer) process(j *previewJob) {
+	lp, err := p.lookup(j.url)
+	if err != nil {
+		log.Printf("preview: %s: %v", j.url, err)
+		return
+	}
+	if lp == nil {
+		return
+	}
+	ctx := context.Background()
+	if err := p.messages.SetLinkPreview(ctx, j.m.ID, lp); err != nil {
+		log.Printf("preview: %s: %v", j.url, err)
+		return
+	}
+	p.hub.publish(ctx, &message{kind: messagePreview, id: j.m.ID, parent: j.m.parent(), roomID: j.m.RoomID, preview: lp})
+}
+
+// lookup returns the preview of a page from the cache, or fetches it. Failed
+// fetches are cached like pages without a preview, so that a broken link is
+// not fetched for every message.
+func (p *previewer) lookup(link string) (*LinkPreview, error) {
+	now := time.Now()
+	p.mu.Lock()
+	if c, ok := p.cache[link]; ok && now.Before(c.expires) {
+		p.mu.Unlock()
+		return c.preview, nil
+	}
+	p.mu.Unlock()
+	lp, err := p.fetch(link)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.cache) >= previewCacheSize {
+		for k, c := range p.cache {
+			if now.After(c.expires) {
+				delete(p.cache, k)
+			}
+		}
+		// still full, make room for the new entry
+		for k := range p.cache {
+			if len(p.cache) < previewCacheSize {
+				break
+			}
+			delete(p.cache, k)
+		}
+	}
+	p.cache[link] = &cachedPreview{preview: lp, expires: now.Add(previewCacheTTL)}
+	return lp, err
+}
+
+// fetch gets a page and reads its metadata. Pages that are not html, or have
+// no title, have no preview.
+func (p *previewer) fetch(link string) (*LinkPreview, error) {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return nil, errBlockedAddress
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "rtm-linkpreview/1.0")
+	req.Header.Set("Accept", "text/html")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+	if mt, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); mt != "text/html" {
+		return nil, nil
+	}
+	lp := parsePreview(io.LimitReader(res.Body, previewMaxBody))
+	if lp == nil {
+		return nil, nil
+	}
+	lp.URL = link
+	return lp, nil
+}
+
+// parsePreview reads the OpenGraph properties of a page, falling back to its
+// title and description meta tags. It stops at the end of the head.
+func parsePreview(r io.Reader) *LinkPreview {
+	var (
+		lp      LinkPreview
+		title   string
+		desc    string
+		inTitle bool
+	)
+	z := html.NewTokenizer(r)
+loop:
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "title":
+				inTitle = true
+			case "meta":
+				var key, content string
+				for _, a := range t.Attr {
+					switch a.Key {
+					case "property", "name":
+						key = strings.ToLower(a.Val)
+					case "content":
+						content = strings.TrimSpace(a.Val)
+					}
+				}
+				switch key {
+				case "og:title":
+					lp.Title = content
+				case "og:description":
+					lp.Description = content
+				case "og:site_name":
+					lp.SiteName = content
+				case "description":
+					desc = content
+				}
+			case "body":
+				break loop
+			}
+		case html.TextToken:
+			if inTitle {
+				title += string(z.Text())
+			}
+		case html.EndTagToken:
+			switch z.Token().Data {
+			case "title":
+				inTitle = false
+			case "head":
+				break loop
+			}
+		}
+	}
+	if lp.Title == "" {
+		lp.Title = strings.TrimSpace(title)
+	}
+	if lp.Description == "" {
+		lp.Description = desc
+	}
+	if lp.Title == "" {
+		return nil
+	}
+	lp.Title = truncate(lp.Title, 200)
+	lp.Description = truncate(lp.Description, 300)
+	lp.SiteName = truncate(lp.SiteName, 100)
+	return &lp
+}
+
+// guardAddress is the dialer control refusing the connections to anything but
+// public addresses on the http(s) ports.
+func guardAddress(network string, address string, c syscall.RawConn) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicIP(ip) || (port != "80" && port != "443") {
+		return errBlockedAddress
+	}
+	return nil
+}
+
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// truncate cuts s to at most n runes.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// previewDisplay formats a link preview for the html templates, it returns
+// nil if there is none.
+func previewDisplay(p *LinkPreview) *view.LinkPreviewDisplayData {
+	if p == nil {
+		return nil
+	}
+	return &view.LinkPreviewDisplayData{URL: p.URL, Title: p.Title, Description: p.Description, SiteName: p.SiteName}
+}
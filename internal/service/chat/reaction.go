@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/brianaung/rtm/view"
+	"github.com/gofrs/uuid/v5"
+)
+
+const (
+	// maxEmojiLen bounds the emoji of a reaction in bytes, so that it fits
+	// the emoji column of message_reaction.
+	maxEmojiLen = 32
+	// maxUserReactions is the most emojis a user can react to a message with.
+	maxUserReactions = 20
+)
+
+var (
+	errInvalidEmoji     = errors.New("Invalid emoji.")
+	errTooManyReactions = errors.New("You cannot react to a message with more than 20 emojis.")
+	errAlreadyReacted   = errors.New("You already reacted with this emoji.")
+	errNoReaction       = errors.New("You did not react with this emoji.")
+)
+
+// validEmoji accepts short strings made of non ascii, non space runes, which
+// covers emoji with their modifiers and joiners without a full emoji table.
+func validEmoji(e string) bool {
+	if e == "" || len(e) > maxEmojiLen || !utf8.ValidString(e) {
+		return false
+	}
+	for _, r := range e {
+		if r < utf8.RuneSelf || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// react adds the reaction of uid to a message and broadcasts the new counts.
+// Only the current members of the room can react.
+func react(ctx context.Context, rooms RoomStore, messages MessageStore, h *hub, uid uuid.UUID, rid uuid.UUID, mid uuid.UUID, emoji string) error {
+	emoji = strings.TrimSpace(emoji)
+	if !validEmoji(emoji) {
+		return errInvalidEmoji
+	}
+	if err := member(ctx, rooms, rid, uid); err != nil {
+		return err
+	}
+	m, err := roomMessage(ctx, messages, rid, mid)
+	if err != nil {
+		return err
+	}
+	err = messages.AddReaction(ctx, &Reaction{MessageID: mid, UserID: uid, Emoji: emoji, Time: time.Now()}, maxUserReactions)
+	if errors.Is(err, errDuplicate) {
+		return errAlreadyReacted
+	} else if errors.Is(err, errLimit) {
+		return errTooManyReactions
+	} else if err != nil {
+		return err
+	}
+	return publishReactions(ctx, h, m)
+}
+
+// unreact removes the reaction of uid to a message and broadcasts the new counts.
+func unreact(ctx context.Context, rooms RoomStore, messages MessageStore, h *hub, uid uuid.UUID, rid uuid.UUID, mid uuid.UUID, emoji string) error {
+	if err := member(ctx, rooms, rid, uid); err != nil {
+		return err
+	}
+	m, err := roomMessage(ctx, messages, rid, mid)
+	if err != nil {
+		return err
+	}
+	if err := messages.RemoveReaction(ctx, &Reaction{MessageID: mid, UserID: uid, Emoji: strings.TrimSpace(emoji)}); errors.Is(err, errNotFound) {
+		return errNoReaction
+	} else if err != nil {
+		return err
+	}
+	return publishReactions(ctx, h, m)
+}
+
+// publishReactions tells every node that the reactions to m changed. Each hub
+// loads them from the store, so that its clients can count them and tell
+// which are their own.
+func publishReactions(ctx context.Context, h *hub, m *Message) error {
+	return h.publish(ctx, &message{kind: messageReactions, id: m.ID, parent: m.parent(), roomID: m.RoomID})
+}
+
+// summarizeReactions counts the reactions to a message by emoji, in the order
+// the emojis were first used, as seen by uid.
+func summarizeReactions(rs []*Reaction, uid uuid.UUID) []view.ReactionDisplayData {
+	var sum []view.ReactionDisplayData
+	index := make(map[string]int)
+	for _, r := range rs {
+		i, ok := index[r.Emoji]
+		if !ok {
+			i = len(sum)
+			index[r.Emoji] = i
+			sum = append(sum, view.ReactionDisplayData{Emoji: r.Emoji})
+		}
+		sum[i].Count++
+		sum[i].Mine = sum[i].Mine || r.UserID == uid
+	}
+	return sum
+}
@@ -0,0 +1,175 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+func TestValidEmoji(t *testing.T) {
+	tests := []struct {
+		emoji string
+		want  bool
+	}{
+		{"👍", true},
+		{"❤️", true},
+		{"👩‍👩‍👧", true},
+		{"", false},
+		{"a", false},
+		{"👍 👍", false},
+		{"👍\u0000", false},
+		{strings.Repeat("👍", maxEmojiLen/4+1), false},
+		{"\xff", false},
+	}
+	for _, tt := range tests {
+		if got := validEmoji(tt.emoji); got != tt.want {
+			t.Errorf("validEmoji(%q) = %v, want %v", tt.emoji, got, tt.want)
+		}
+	}
+}
+
+// reactionRoom creates a room of alice and bob, with a message of alice.
+func reactionRoom(t *testing.T, store *memStore) (rid uuid.UUID, alice uuid.UUID, bob uuid.UUID, m *Message) {
+	t.Helper()
+	ctx := context.Background()
+	rid, alice, bob = uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	if err := store.CreateRoomWithCreator(ctx, &Room{ID: rid, Name: "general", CreatorID: alice}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddUserToRoom(ctx, &RoomUser{RoomID: rid, UserID: bob}); err != nil {
+		t.Fatal(err)
+	}
+	m = &Message{ID: uuid.Must(uuid.NewV4()), RoomID: rid, UserID: alice, Msg: "hi", Time: time.Now()}
+	if err := store.AddMessageEntry(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	return rid, alice, bob, m
+}
+
+// emoji returns distinct emojis of one rune past the ascii range, which all
+// count as valid.
+func emoji(i int) string { return fmt.Sprintf("%c", 0x1F600+i) }
+
+func TestReactionsPerUserAreCapped(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore(nil)
+	h := newTestHub(t)
+	rid, alice, bob, m := reactionRoom(t, store)
+
+	for i := 0; i < maxUserReactions; i++ {
+		if err := react(ctx, store, store, h, alice, rid, m.ID, emoji(i)); err != nil {
+			t.Fatalf("reaction %d: %v", i+1, err)
+		}
+	}
+	if err := react(ctx, store, store, h, alice, rid, m.ID, emoji(maxUserReactions)); !errors.Is(err, errTooManyReactions) {
+		t.Fatalf("got %v, want errTooManyReactions", err)
+	}
+	// an emoji already used is reported as such, even at the cap
+	if err := react(ctx, store, store, h, alice, rid, m.ID, emoji(0)); !errors.Is(err, errAlreadyReacted) {
+		t.Fatalf("got %v, want errAlreadyReacted", err)
+	}
+	// the cap is per user
+	if err := react(ctx, store, store, h, bob, rid, m.ID, emoji(0)); err != nil {
+		t.Fatal(err)
+	}
+	// and frees up as reactions are removed
+	if err := unreact(ctx, store, store, h, alice, rid, m.ID, emoji(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := react(ctx, store, store, h, alice, rid, m.ID, emoji(maxUserReactions)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReactionsAreLoadedByTheHub(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore(nil)
+	h := newHub(NewLocalBackplane(), store)
+	go h.run()
+	go h.receive()
+	t.Cleanup(func() { h.quit <- true })
+
+	rid, alice, bob, m := reactionRoom(t, store)
+	c := newClient(h, rid, bob, "bob", nil)
+	h.register <- c
+
+	for _, u := range []uuid.UUID{alice, bob} {
+		if err := react(ctx, store, store, h, u, rid, m.ID, "👍"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the payload only carries the message, the rows come from the store
+	payload, err := encodeMessage(&message{kind: messageReactions, id: m.ID, roomID: rid, reactions: []*Reaction{{Emoji: "👍"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(payload), "👍") {
+		t.Fatalf("reactions sent through the backplane: %s", payload)
+	}
+	nextMessage(t, c, messageReactions)
+	got := nextMessage(t, c, messageReactions)
+	sum := summarizeReactions(got.reactions, bob)
+	if len(sum) != 1 || sum[0].Count != 2 || !sum[0].Mine {
+		t.Fatalf("bob sees %+v, want 👍 twice, his included", sum)
+	}
+}
+
+func TestConcurrentReactionsAreCapped(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore(nil)
+	h := newTestHub(t)
+	rid, alice, _, m := reactionRoom(t, store)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2*maxUserReactions; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			react(ctx, store, store, h, alice, rid, m.ID, emoji(i))
+		}(i)
+	}
+	wg.Wait()
+	rs, err := store.GetReactions(ctx, m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != maxUserReactions {
+		t.Fatalf("got %d reactions, want %d", len(rs), maxUserReactions)
+	}
+}
+
+func TestOutsidersCannotReact(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore(nil)
+	h := newTestHub(t)
+	rid, alice, bob, m := reactionRoom(t, store)
+	if err := react(ctx, store, store, h, bob, rid, m.ID, "👍"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveUserFromRoom(ctx, &RoomUser{RoomID: rid, UserID: bob}); err != nil {
+		t.Fatal(err)
+	}
+	outsider := uuid.Must(uuid.NewV4())
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"react after leaving", react(ctx, store, store, h, bob, rid, m.ID, "❤️")},
+		{"unreact after leaving", unreact(ctx, store, store, h, bob, rid, m.ID, "👍")},
+		{"react as an outsider", react(ctx, store, store, h, outsider, rid, m.ID, "👍")},
+	}
+	for _, tt := range tests {
+		if !errors.Is(tt.err, errNoAccess) {
+			t.Errorf("%s: got %v, want errNoAccess", tt.name, tt.err)
+		}
+	}
+	if err := react(ctx, store, store, h, alice, rid, m.ID, "👍"); err != nil {
+		t.Fatal(err)
+	}
+}
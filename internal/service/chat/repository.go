@@ -2,7 +2,7 @@ package chat
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"time"
 
 	"github.com/brianaung/rtm/view"
@@ -12,14 +12,93 @@ import (
 )
 
 type Room struct {
-	ID        uuid.UUID `json:"id"`
-	Name      string    `json:"roomname"`
-	CreatorID uuid.UUID `json:"creator_id"`
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"roomname"`
+	CreatorID  uuid.UUID  `json:"creator_id"`
+	Visibility Visibility `json:"visibility"`
+	Kind       RoomKind   `json:"kind"`
+	// DirectKey is the pair of users of a direct conversation, see directKey.
+	DirectKey string `json:"-"`
+	// Peer is the username of the other user of a direct conversation, it is
+	// only set when listing the rooms of a user.
+	Peer string `json:"peer,omitempty"`
+	// Unread is the number of messages the user has not read yet, it is only
+	// set when listing the rooms of a user.
+	Unread int `json:"unread"`
+	// Role of the user in the room, it is only set when listing the rooms of
+	// a user.
+	Role Role `json:"role,omitempty"`
 }
 
 type RoomUser struct {
-	RoomID uuid.UUID `json:"room_id"`
-	UserID uuid.UUID `json:"user_id"`
+	RoomID     uuid.UUID  `json:"room_id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	LastReadAt *time.Time `json:"last_read_at"`
+	Role       Role       `json:"role"`
+}
+
+// Member is a user that is part of a room.
+type Member struct {
+	UserID   uuid.UUID `json:"id"`
+	Username string    `json:"username"`
+	Role     Role      `json:"role"`
+}
+
+// Invite lets users into a room until it expires, or until it is used if it
+// is single use.
+type Invite struct {
+	ID        uuid.UUID  `json:"id"`
+	RoomID    uuid.UUID  `json:"room_id"`
+	CreatedBy uuid.UUID  `json:"created_by"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	SingleUse bool       `json:"single_use"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+// JoinRequest is a user waiting to be let into an approval-required room.
+type JoinRequest struct {
+	RoomID   uuid.UUID `json:"room_id"`
+	UserID   uuid.UUID `json:"user_id"`
+	Username string    `json:"username"`
+	Time     time.Time `json:"time"`
+}
+
+// Reaction is an emoji a user reacted to a message with.
+type Reaction struct {
+	MessageID uuid.UUID `json:"message_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Emoji     string    `json:"emoji"`
+	Time      time.Time `json:"time"`
+}
+
+// Pin is a message pinned to its room. Username and Msg are the author and
+// content of the message, filled in by GetPins.
+type Pin struct {
+	RoomID    uuid.UUID `json:"room_id"`
+	MessageID uuid.UUID `json:"message_id"`
+	PinnedBy  uuid.UUID `json:"pinned_by"`
+	Time      time.Time `json:"time"`
+	Username  string    `json:"username,omitempty"`
+	Msg       string    `json:"msg,omitempty"`
+}
+
+// Notification tells a user about something that happened outside of the
+// rooms they have open, see notification.go. The room and the users involved
+// are kept by name, as the room may have been renamed or deleted since.
+type Notification struct {
+	ID       uuid.UUID        `json:"id"`
+	UserID   uuid.UUID        `json:"user_id"`
+	Kind     NotificationKind `json:"kind"`
+	RoomID   uuid.UUID        `json:"room_id"`
+	RoomName string           `json:"room_name"`
+	// Actor is the username of the user who caused the notification.
+	Actor string `json:"actor"`
+	// MessageID is the message to show in the room, for the notifications
+	// about a message.
+	MessageID *uuid.UUID `json:"message_id"`
+	Body      string     `json:"body"`
+	Time      time.Time  `json:"time"`
+	ReadAt    *time.Time `json:"read_at"`
 }
 
 type Message struct {
@@ -28,16 +107,107 @@ type Message struct {
 	Time   time.Time `json:"time"`
 	RoomID uuid.UUID `json:"room_id"`
 	UserID uuid.UUID `json:"user_id"`
+	// Username of the author. It is not stored with the message in postgres,
+	// the user table is joined instead.
+	Username  string     `json:"username"`
+	EditedAt  *time.Time `json:"edited_at"`
+	DeletedAt *time.Time `json:"deleted_at"`
+	// ParentID is the message replied to, for the messages of a thread.
+	ParentID   *uuid.UUID  `json:"parent_id"`
+	Attachment *Attachment `json:"attachment,omitempty"`
+	// Preview of the first link of the message, added once it is fetched.
+	Preview *LinkPreview `json:"preview,omitempty"`
+}
+
+// LinkPreview is the OpenGraph summary of a page linked to in a message.
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+// previewColumns selects the link preview of a message, with an empty url if
+// it has none.
+const previewColumns = `coalesce(message_preview.url, ''), coalesce(message_preview.title, ''),
+            coalesce(message_preview.description, ''), coalesce(message_preview.site_name, '')`
+
+// columns are the scan destinations, in the order of previewColumns.
+func (p *LinkPreview) columns() []any {
+	return []any{&p.URL, &p.Title, &p.Description, &p.SiteName}
+}
+
+// orNil returns nil for the empty preview of a message without one.
+func (p *LinkPreview) orNil() *LinkPreview {
+	if p.URL == "" {
+		return nil
+	}
+	return p
+}
+
+// Attachment is a file uploaded to a room. Its content is kept in the
+// BlobStore under its id. MessageID is nil until it is sent with a message.
+type Attachment struct {
+	ID          uuid.UUID  `json:"id"`
+	RoomID      uuid.UUID  `json:"room_id"`
+	UserID      uuid.UUID  `json:"user_id"`
+	MessageID   *uuid.UUID `json:"message_id,omitempty"`
+	Filename    string     `json:"filename"`
+	ContentType string     `json:"content_type"`
+	Size        int64      `json:"size"`
+	Time        time.Time  `json:"time"`
+}
+
+// nullAttachment scans the columns of an attachment left joined to a message.
+type nullAttachment struct {
+	ID          *uuid.UUID
+	Filename    *string
+	ContentType *string
+	Size        *int64
+}
+
+// columns are the scan destinations, in the order of attachmentColumns.
+func (n *nullAttachment) columns() []any {
+	return []any{&n.ID, &n.Filename, &n.ContentType, &n.Size}
+}
+
+// attachment returns the attachment of the message mid, with the fields needed
+// to show it, or nil if it has none.
+func (n *nullAttachment) attachment(rid uuid.UUID, mid uuid.UUID) *Attachment {
+	if n.ID == nil {
+		return nil
+	}
+	return &Attachment{ID: *n.ID, RoomID: rid, MessageID: &mid, Filename: *n.Filename, ContentType: *n.ContentType, Size: *n.Size}
+}
+
+// attachmentColumns selects the attachment of a message, see nullAttachment.
+const attachmentColumns = `attachment.id, attachment.filename, attachment.content_type, attachment.size`
+
+// parent returns the id of the message replied to, or uuid.Nil.
+func (m *Message) parent() uuid.UUID {
+	if m.ParentID == nil {
+		return uuid.Nil
+	}
+	return *m.ParentID
+}
+
+// pgStore is the postgres backed implementation of RoomStore and MessageStore.
+type pgStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPgStore(db *pgxpool.Pool) *pgStore {
+	return &pgStore{db: db}
 }
 
 // =================================== Creating rooms and adding users to rooms ===================================
-// createRoomWithCreator adds a new room entry and add the creator as an initial member of the room.
+// CreateRoomWithCreator adds a new room entry and add the creator as an initial member of the room.
 //
 // This function first creates a new entry in the room table, then it updates
 // the room_user table with the creator_id so that the creator will be apart of
 // the newly created room.
-func createRoomWithCreator(ctx context.Context, db *pgxpool.Pool, r *Room) error {
-	tx, err := db.Begin(ctx)
+func (s *pgStore) CreateRoomWithCreator(ctx context.Context, r *Room) error {
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
 		return err
 	}
@@ -47,69 +217,198 @@ func createRoomWithCreator(ctx context.Context, db *pgxpool.Pool, r *Room) error
 		return err
 	}
 	// add user to room (update room_user table)
-	if err := addUserRoomEntry(ctx, tx, &RoomUser{RoomID: r.ID, UserID: r.CreatorID}); err != nil {
+	if err := addUserRoomEntry(ctx, tx, &RoomUser{RoomID: r.ID, UserID: r.CreatorID, Role: RoleOwner}); err != nil {
 		return err
 	}
 	return tx.Commit(ctx)
 }
 
-func addUserToRoom(ctx context.Context, db *pgxpool.Pool, ru *RoomUser) error {
-	tx, err := db.Begin(ctx)
+func (s *pgStore) AddUserToRoom(ctx context.Context, ru *RoomUser) error {
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(ctx)
-	if err := addUserRoomEntry(ctx, tx, &RoomUser{RoomID: ru.RoomID, UserID: ru.UserID}); err != nil {
+	if err := addUserRoomEntry(ctx, tx, &RoomUser{RoomID: ru.RoomID, UserID: ru.UserID, Role: RoleMember}); err != nil {
 		return err
 	}
 	return tx.Commit(ctx)
 }
 
+func (s *pgStore) RemoveUserFromRoom(ctx context.Context, ru *RoomUser) error {
+	tag, err := s.db.Exec(ctx, `delete from room_user ru where ru.room_id = $1 and ru.user_id = $2`, ru.RoomID, ru.UserID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
 func addRoomEntry(ctx context.Context, tx pgx.Tx, r *Room) error {
-	_, err := tx.Exec(ctx, `insert into room(id, roomname, creator_id) values($1, $2, $3)`, r.ID, r.Name, r.CreatorID)
+	if r.Visibility == "" {
+		r.Visibility = VisibilityPublic
+	}
+	if r.Kind == "" {
+		r.Kind = RoomGroup
+	}
+	_, err := tx.Exec(ctx, `insert into room(id, roomname, creator_id, visibility, kind) values($1, $2, $3, $4, $5)`, r.ID, r.Name, r.CreatorID, r.Visibility, r.Kind)
 	return err
 }
 
 func addUserRoomEntry(ctx context.Context, tx pgx.Tx, ru *RoomUser) error {
-	_, err := tx.Exec(ctx, `insert into room_user(room_id, user_id) values($1, $2)`, ru.RoomID, ru.UserID)
+	_, err := tx.Exec(ctx, `insert into room_user(room_id, user_id, role) values($1, $2, $3)`, ru.RoomID, ru.UserID, ru.Role)
 	return err
 }
 
-func isAMember(ctx context.Context, db *pgxpool.Pool, ru *RoomUser) (bool, error) {
+func (s *pgStore) SetRole(ctx context.Context, ru *RoomUser) error {
+	tag, err := s.db.Exec(ctx, `update room_user set role = $3 where room_id = $1 and user_id = $2`, ru.RoomID, ru.UserID, ru.Role)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) IsAMember(ctx context.Context, ru *RoomUser) (bool, error) {
 	exists := false
-	err := db.QueryRow(ctx, `select exists(select 1 from room_user ru where ru.room_id = $1 and ru.user_id = $2)`, ru.RoomID, ru.UserID).Scan(&exists)
+	err := s.db.QueryRow(ctx, `select exists(select 1 from room_user ru where ru.room_id = $1 and ru.user_id = $2)`, ru.RoomID, ru.UserID).Scan(&exists)
 	if err != nil {
 		return false, err
 	}
 	return exists, nil
 }
 
+func (s *pgStore) GetRoomUser(ctx context.Context, rid uuid.UUID, uid uuid.UUID) (*RoomUser, error) {
+	ru := &RoomUser{}
+	err := s.db.QueryRow(ctx,
+		`select ru.room_id, ru.user_id, ru.last_read_at, ru.role
+            from room_user ru
+            where ru.room_id = $1 and ru.user_id = $2`, rid, uid).Scan(&ru.RoomID, &ru.UserID, &ru.LastReadAt, &ru.Role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ru, nil
+}
+
 // ================================================================================================================
 
-func addMessageEntry(ctx context.Context, db *pgxpool.Pool, m *Message) error {
-	_, err := db.Exec(ctx, `insert into message(id, msg, time, room_id, user_id) values($1, $2, $3, $4, $5)`, m.ID, m.Msg, m.Time, m.RoomID, m.UserID)
-	return err
+func (s *pgStore) AddMessageEntry(ctx context.Context, m *Message) error {
+	if m.Attachment == nil {
+		_, err := s.db.Exec(ctx, `insert into message(id, msg, time, room_id, user_id, parent_id) values($1, $2, $3, $4, $5, $6)`, m.ID, m.Msg, m.Time, m.RoomID, m.UserID, m.ParentID)
+		return err
+	}
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `insert into message(id, msg, time, room_id, user_id, parent_id) values($1, $2, $3, $4, $5, $6)`, m.ID, m.Msg, m.Time, m.RoomID, m.UserID, m.ParentID); err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx,
+		`update attachment set message_id = $1
+            where id = $2 and room_id = $3 and user_id = $4 and message_id is null`, m.ID, m.Attachment.ID, m.RoomID, m.UserID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return tx.Commit(ctx)
 }
 
-func getRoomByID(ctx context.Context, db *pgxpool.Pool, rid uuid.UUID) (*Room, error) {
-	r := &Room{}
-	err := db.QueryRow(ctx, `select * from room where room.id = $1`, rid).Scan(&r.ID, &r.Name, &r.CreatorID)
+func (s *pgStore) GetMessageByID(ctx context.Context, mid uuid.UUID) (*Message, error) {
+	m := &Message{}
+	var (
+		a  nullAttachment
+		lp LinkPreview
+	)
+	err := s.db.QueryRow(ctx,
+		`select message.id, message.msg, message.time, message.room_id, message.user_id, u.username, message.edited_at, message.deleted_at, message.parent_id,
+            `+attachmentColumns+`, `+previewColumns+`
+            from message
+            inner join "user" u on u.id = message.user_id
+            left join attachment on attachment.message_id = message.id
+            left join message_preview on message_preview.message_id = message.id
+            where message.id = $1`, mid).Scan(append(append([]any{&m.ID, &m.Msg, &m.Time, &m.RoomID, &m.UserID, &m.Username, &m.EditedAt, &m.DeletedAt, &m.ParentID}, a.columns()...), lp.columns()...)...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m.Attachment = a.attachment(m.RoomID, m.ID)
+	m.Preview = lp.orNil()
+	if m.Attachment != nil {
+		m.Attachment.UserID = m.UserID
+	}
+	return m, nil
+}
+
+// EditMessage replaces the content of a message that has not been deleted.
+func (s *pgStore) EditMessage(ctx context.Context, mid uuid.UUID, msg string, at time.Time) error {
+	tag, err := s.db.Exec(ctx, `update message set msg = $2, edited_at = $3 where message.id = $1 and message.deleted_at is null`, mid, msg, at)
 	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// DeleteMessage soft deletes a message. The row is kept so that the history
+// and its cursors stay stable, but its content is no longer served.
+func (s *pgStore) DeleteMessage(ctx context.Context, mid uuid.UUID, at time.Time) error {
+	tag, err := s.db.Exec(ctx, `update message set deleted_at = $2 where message.id = $1 and message.deleted_at is null`, mid, at)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) GetRoomByID(ctx context.Context, rid uuid.UUID) (*Room, error) {
+	r := &Room{}
+	err := s.db.QueryRow(ctx,
+		`select room.id, room.roomname, room.creator_id, room.visibility, room.kind
+            from room where room.id = $1`, rid).Scan(&r.ID, &r.Name, &r.CreatorID, &r.Visibility, &r.Kind)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
 		return nil, err
 	}
 	return r, nil
 }
 
-func getAllRooms(ctx context.Context, db *pgxpool.Pool) ([]*Room, error) {
-	rows, err := db.Query(ctx, `select * from room`)
-	defer rows.Close()
+func (s *pgStore) RenameRoom(ctx context.Context, rid uuid.UUID, name string) error {
+	tag, err := s.db.Exec(ctx, `update room set roomname = $2 where room.id = $1`, rid, name)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) GetAllRooms(ctx context.Context) ([]*Room, error) {
+	rows, err := s.db.Query(ctx, `select room.id, room.roomname, room.creator_id, room.visibility, room.kind from room`)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	rooms := make([]*Room, 0)
 	for rows.Next() {
 		room := &Room{}
-		err := rows.Scan(&room.ID, &room.Name, &room.CreatorID)
+		err := rows.Scan(&room.ID, &room.Name, &room.CreatorID, &room.Visibility, &room.Kind)
 		if err != nil {
 			return nil, err
 		}
@@ -118,50 +417,257 @@ func getAllRooms(ctx context.Context, db *pgxpool.Pool) ([]*Room, error) {
 	return rooms, nil
 }
 
-// getMessagesFromRoom retrieves top 10 latest messages from the specified room.
+// GetMessagesFromRoom retrieves a page of messages from the specified room.
 //
+// It uses keyset pagination on (time, id) so that the message_time_idx index
+// can be walked from the cursor instead of scanning the whole history. One
+// extra row is fetched to find out whether there is a next page.
 // The data is formatted in a way to use as view.MsgData by the relevant html templates.
-func getMessagesFromRoom(ctx context.Context, db *pgxpool.Pool, rid uuid.UUID, uid uuid.UUID) ([]view.MsgDisplayData, error) {
-	rows, err := db.Query(ctx,
-		`select message.msg, message.time, u.username, message.user_id = $1 as mine
+func (s *pgStore) GetMessagesFromRoom(ctx context.Context, rid uuid.UUID, uid uuid.UUID, before *Cursor, limit int) ([]view.MsgDisplayData, *Cursor, error) {
+	var (
+		bt  *time.Time
+		bid *uuid.UUID
+	)
+	if before != nil {
+		bt, bid = &before.Time, &before.ID
+	}
+	rows, err := s.db.Query(ctx,
+		`select message.id, message.msg, message.time, u.username, message.user_id = $1 as mine,
+            message.edited_at is not null as edited, message.deleted_at is not null as deleted,
+            (select count(*) from message reply
+                where reply.parent_id = message.id and reply.deleted_at is null) as replies,
+            exists(select 1 from mention where mention.message_id = message.id and mention.user_id = $1) as mentioned,
+            `+attachmentColumns+`, `+previewColumns+`
             from message 
             inner join "user" u on u.id = message.user_id
+            left join attachment on attachment.message_id = message.id
+            left join message_preview on message_preview.message_id = message.id
             where message.room_id = $2
-            order by message.time desc`, uid, rid) // todo: limit 10 and fetch more with infinite scroll?
+            and message.parent_id is null
+            and ($3::timestamptz is null or (message.time, message.id) < ($3, $4::uuid))
+            order by message.time desc, message.id desc
+            limit $5`, uid, rid, bt, bid, limit+1)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	defer rows.Close()
 	ms := make([]view.MsgDisplayData, 0)
+	var (
+		next     *Cursor
+		lastTime time.Time
+	)
 	for rows.Next() {
 		var m view.MsgDisplayData
 		var time time.Time
-		err := rows.Scan(&m.Msg, &time, &m.Username, &m.Mine)
+		var (
+			a  nullAttachment
+			lp LinkPreview
+		)
+		err := rows.Scan(append(append([]any{&m.ID, &m.Msg, &time, &m.Username, &m.Mine, &m.Edited, &m.Deleted, &m.Replies, &m.Mentioned}, a.columns()...), lp.columns()...)...)
 		if err != nil {
+			return nil, nil, err
+		}
+		m.Attachment = attachmentDisplay(a.attachment(rid, m.ID))
+		m.Preview = previewDisplay(lp.orNil())
+		if len(ms) == limit {
+			last := ms[len(ms)-1]
+			next = &Cursor{Time: lastTime, ID: last.ID}
+			break
+		}
+		m.RoomID = rid
+		m.Time = formatTime(time)
+		if m.Deleted {
+			m.Msg = ""
+		}
+		lastTime = time
+		ms = append(ms, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err := s.addReactions(ctx, ms, uid); err != nil {
+		return nil, nil, err
+	}
+	return ms, next, nil
+}
+
+// GetThread retrieves the replies to a message, formatted like the messages of
+// GetMessagesFromRoom.
+func (s *pgStore) GetThread(ctx context.Context, parent uuid.UUID, uid uuid.UUID) ([]view.MsgDisplayData, error) {
+	rows, err := s.db.Query(ctx,
+		`select message.id, message.room_id, message.msg, message.time, u.username, message.user_id = $1 as mine,
+            message.edited_at is not null as edited, message.deleted_at is not null as deleted,
+            exists(select 1 from mention where mention.message_id = message.id and mention.user_id = $1) as mentioned,
+            `+previewColumns+`
+            from message
+            inner join "user" u on u.id = message.user_id
+            left join message_preview on message_preview.message_id = message.id
+            where message.parent_id = $2
+            order by message.time, message.id`, uid, parent)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ms := make([]view.MsgDisplayData, 0)
+	for rows.Next() {
+		m := view.MsgDisplayData{Reply: true}
+		var time time.Time
+		var lp LinkPreview
+		if err := rows.Scan(append([]any{&m.ID, &m.RoomID, &m.Msg, &time, &m.Username, &m.Mine, &m.Edited, &m.Deleted, &m.Mentioned}, lp.columns()...)...); err != nil {
 			return nil, err
 		}
-		formatted := fmt.Sprintf("%d/%02d/%02d %02d:%02d:%02d",
-			time.Year(), time.Month(), time.Day(),
-			time.Hour(), time.Minute(), time.Second())
-		m.Time = formatted
+		m.Preview = previewDisplay(lp.orNil())
+		m.Time = formatTime(time)
+		if m.Deleted {
+			m.Msg = ""
+		}
 		ms = append(ms, m)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.addReactions(ctx, ms, uid); err != nil {
+		return nil, err
+	}
 	return ms, nil
 }
 
-func getRoomsFromUser(ctx context.Context, db *pgxpool.Pool, uid uuid.UUID) ([]*Room, error) {
-	rows, err := db.Query(ctx,
-		`select room.id, room.roomname, room.creator_id
+func (s *pgStore) CountReplies(ctx context.Context, parent uuid.UUID) (int, error) {
+	n := 0
+	err := s.db.QueryRow(ctx, `select count(*) from message where message.parent_id = $1 and message.deleted_at is null`, parent).Scan(&n)
+	return n, err
+}
+
+// addReactions fills in the reaction counts of a page of messages, seen by uid.
+// Emojis are listed in the order they were first used on each message.
+func (s *pgStore) addReactions(ctx context.Context, ms []view.MsgDisplayData, uid uuid.UUID) error {
+	if len(ms) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, len(ms))
+	index := make(map[uuid.UUID]int, len(ms))
+	for i, m := range ms {
+		ids[i] = m.ID
+		index[m.ID] = i
+	}
+	rows, err := s.db.Query(ctx,
+		`select message_id, emoji, count(*), bool_or(user_id = $2) as mine
+            from message_reaction
+            where message_id = any($1)
+            group by message_id, emoji
+            order by message_id, min(time)`, ids, uid)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			mid uuid.UUID
+			r   view.ReactionDisplayData
+		)
+		if err := rows.Scan(&mid, &r.Emoji, &r.Count, &r.Mine); err != nil {
+			return err
+		}
+		m := &ms[index[mid]]
+		m.Reactions = append(m.Reactions, r)
+	}
+	return rows.Err()
+}
+
+// ===== Reactions =====
+
+// AddReaction locks the message while counting the reactions of the user, so
+// that concurrent reactions cannot both pass the limit.
+func (s *pgStore) AddReaction(ctx context.Context, r *Reaction, max int) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	n := 0
+	err = tx.QueryRow(ctx,
+		`select (select count(*) from message_reaction
+                where message_id = message.id and user_id = $2 and emoji <> $3)
+            from message where id = $1
+            for update`, r.MessageID, r.UserID, r.Emoji).Scan(&n)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+	if n >= max {
+		return errLimit
+	}
+	tag, err := tx.Exec(ctx,
+		`insert into message_reaction(message_id, user_id, emoji, time) values($1, $2, $3, $4)
+            on conflict do nothing`, r.MessageID, r.UserID, r.Emoji, r.Time)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errDuplicate
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *pgStore) RemoveReaction(ctx context.Context, r *Reaction) error {
+	tag, err := s.db.Exec(ctx,
+		`delete from message_reaction where message_id = $1 and user_id = $2 and emoji = $3`, r.MessageID, r.UserID, r.Emoji)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) GetReactions(ctx context.Context, mid uuid.UUID) ([]*Reaction, error) {
+	rows, err := s.db.Query(ctx,
+		`select message_id, user_id, emoji, time from message_reaction
+            where message_id = $1
+            order by time`, mid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rs := make([]*Reaction, 0)
+	for rows.Next() {
+		r := &Reaction{}
+		if err := rows.Scan(&r.MessageID, &r.UserID, &r.Emoji, &r.Time); err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, rows.Err()
+}
+
+func (s *pgStore) GetRoomsFromUser(ctx context.Context, uid uuid.UUID) ([]*Room, error) {
+	rows, err := s.db.Query(ctx,
+		`select room.id, room.roomname, room.creator_id, room.visibility, room.kind, room_user.role,
+            (select count(*) from message
+                where message.room_id = room.id
+                and message.user_id <> $1
+                and message.parent_id is null
+                and message.deleted_at is null
+                and message.time > coalesce(room_user.last_read_at, '-infinity')) as unread,
+            coalesce((select u.username from room_user peer
+                inner join "user" u on u.id = peer.user_id
+                where room.kind = 'direct'
+                and peer.room_id = room.id
+                and peer.user_id <> $1), '') as peer
             from room
             inner join room_user on room_user.room_id = room.id
-            inner join "user" u on room_user.user_id = u.id
-            where u.id = $1`, uid)
+            where room_user.user_id = $1
+            order by room.roomname, room.id`, uid)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	rooms := make([]*Room, 0)
 	for rows.Next() {
 		room := &Room{}
-		err := rows.Scan(&room.ID, &room.Name, &room.CreatorID)
+		err := rows.Scan(&room.ID, &room.Name, &room.CreatorID, &room.Visibility, &room.Kind, &room.Role, &room.Unread, &room.Peer)
 		if err != nil {
 			return nil, err
 		}
@@ -170,33 +676,73 @@ func getRoomsFromUser(ctx context.Context, db *pgxpool.Pool, uid uuid.UUID) ([]*
 	return rooms, nil
 }
 
+func (s *pgStore) MarkRead(ctx context.Context, ru *RoomUser, at time.Time) (bool, error) {
+	tag, err := s.db.Exec(ctx,
+		`update room_user set last_read_at = $3
+            where room_id = $1 and user_id = $2
+            and (last_read_at is null or last_read_at < $3)`, ru.RoomID, ru.UserID, at)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *pgStore) GetRoomMembers(ctx context.Context, rid uuid.UUID) ([]*Member, error) {
+	rows, err := s.db.Query(ctx,
+		`select u.id, u.username, room_user.role
+            from room_user
+            inner join "user" u on room_user.user_id = u.id
+            where room_user.room_id = $1
+            order by u.username`, rid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := make([]*Member, 0)
+	for rows.Next() {
+		m := &Member{}
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
 // =================================== Deleting a room ===================================
-// deleteRoom performs the deletion of a room and its associated entries.
+// DeleteRoom performs the deletion of a room and its associated entries.
 //
 // It deletes users associated with the room from the room_user junction table,
 // then all messages related to the room from the message table, and finally
 // removes the room entry from the room table. Any error encountered
 // during the deletion process or transaction execution will be returned.
-func deleteRoom(ctx context.Context, db *pgxpool.Pool, rid uuid.UUID) error {
-	tx, err := db.Begin(ctx)
+func (s *pgStore) DeleteRoom(ctx context.Context, rid uuid.UUID) ([]uuid.UUID, error) {
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// We will rollback in case of an early return.
 	// Since it is "deferred", it will still gets called after the function returns
 	// successfully, but since the transaction will already be committed by then,
 	// the rollback function will have no effect on it.
 	defer tx.Rollback(ctx)
+	if err := deleteRoomAccess(ctx, tx, rid); err != nil {
+		return nil, err
+	}
 	if err := deleteAllUsersFromRoom(ctx, tx, rid); err != nil {
-		return err
+		return nil, err
+	}
+	attachments, err := deleteAllAttachmentsFromRoom(ctx, tx, rid)
+	if err != nil {
+		return nil, err
 	}
 	if err := deleteAllMessagesFromRoom(ctx, tx, rid); err != nil {
-		return err
+		return nil, err
 	}
 	if err := deleteRoomEntry(ctx, tx, rid); err != nil {
-		return err
+		return nil, err
 	}
-	return tx.Commit(ctx)
+	return attachments, tx.Commit(ctx)
 }
 
 func deleteRoomEntry(ctx context.Context, tx pgx.Tx, rid uuid.UUID) error {
@@ -204,14 +750,506 @@ func deleteRoomEntry(ctx context.Context, tx pgx.Tx, rid uuid.UUID) error {
 	return err
 }
 
+func deleteRoomAccess(ctx context.Context, tx pgx.Tx, rid uuid.UUID) error {
+	if _, err := tx.Exec(ctx, `delete from room_invite where room_id = $1`, rid); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, `delete from room_join_request where room_id = $1`, rid)
+	return err
+}
+
 func deleteAllUsersFromRoom(ctx context.Context, tx pgx.Tx, rid uuid.UUID) error {
 	_, err := tx.Exec(ctx, `delete from room_user ru where ru.room_id = $1`, rid)
 	return err
 }
 
+// deleteAllAttachmentsFromRoom returns the ids of the deleted attachments,
+// which are also the keys of their blobs.
+func deleteAllAttachmentsFromRoom(ctx context.Context, tx pgx.Tx, rid uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := tx.Query(ctx, `delete from attachment where room_id = $1 returning id`, rid)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+}
+
 func deleteAllMessagesFromRoom(ctx context.Context, tx pgx.Tx, rid uuid.UUID) error {
 	_, err := tx.Exec(ctx, `delete from message where message.room_id = $1`, rid)
 	return err
 }
 
 // =======================================================================================
+
+// =================================== Room access ===================================
+func (s *pgStore) SetVisibility(ctx context.Context, rid uuid.UUID, v Visibility) error {
+	tag, err := s.db.Exec(ctx, `update room set visibility = $2 where room.id = $1`, rid, v)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) CreateInvite(ctx context.Context, inv *Invite) error {
+	_, err := s.db.Exec(ctx,
+		`insert into room_invite(id, room_id, created_by, expires_at, single_use) values($1, $2, $3, $4, $5)`,
+		inv.ID, inv.RoomID, inv.CreatedBy, inv.ExpiresAt, inv.SingleUse)
+	return err
+}
+
+// RedeemInvite marks the invite as used and adds the user to the room.
+//
+// The update only matches a live invite, so two users racing for a single use
+// invite cannot both get in.
+func (s *pgStore) RedeemInvite(ctx context.Context, id uuid.UUID, ru *RoomUser, at time.Time) (*Invite, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	inv := &Invite{}
+	err = tx.QueryRow(ctx,
+		`update room_invite set used_at = $3
+            where id = $1 and room_id = $2 and expires_at > $3
+            and (not single_use or used_at is null)
+            returning id, room_id, created_by, expires_at, single_use, used_at`, id, ru.RoomID, at).Scan(&inv.ID, &inv.RoomID, &inv.CreatedBy, &inv.ExpiresAt, &inv.SingleUse, &inv.UsedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `delete from room_join_request where room_id = $1 and user_id = $2`, ru.RoomID, ru.UserID); err != nil {
+		return nil, err
+	}
+	if err := addUserRoomEntry(ctx, tx, &RoomUser{RoomID: ru.RoomID, UserID: ru.UserID, Role: RoleMember}); err != nil {
+		return nil, err
+	}
+	return inv, tx.Commit(ctx)
+}
+
+func (s *pgStore) AddJoinRequest(ctx context.Context, jr *JoinRequest) error {
+	tag, err := s.db.Exec(ctx,
+		`insert into room_join_request(room_id, user_id, time) values($1, $2, $3)
+            on conflict do nothing`, jr.RoomID, jr.UserID, jr.Time)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errDuplicate
+	}
+	return nil
+}
+
+func (s *pgStore) GetJoinRequests(ctx context.Context, rid uuid.UUID) ([]*JoinRequest, error) {
+	rows, err := s.db.Query(ctx,
+		`select jr.room_id, jr.user_id, u.username, jr.time
+            from room_join_request jr
+            inner join "user" u on u.id = jr.user_id
+            where jr.room_id = $1
+            order by jr.time`, rid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	requests := make([]*JoinRequest, 0)
+	for rows.Next() {
+		jr := &JoinRequest{}
+		if err := rows.Scan(&jr.RoomID, &jr.UserID, &jr.Username, &jr.Time); err != nil {
+			return nil, err
+		}
+		requests = append(requests, jr)
+	}
+	return requests, rows.Err()
+}
+
+func (s *pgStore) ApproveJoinRequest(ctx context.Context, ru *RoomUser) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := deleteJoinRequest(ctx, tx, ru); err != nil {
+		return err
+	}
+	if err := addUserRoomEntry(ctx, tx, &RoomUser{RoomID: ru.RoomID, UserID: ru.UserID, Role: RoleMember}); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *pgStore) RejectJoinRequest(ctx context.Context, ru *RoomUser) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := deleteJoinRequest(ctx, tx, ru); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func deleteJoinRequest(ctx context.Context, tx pgx.Tx, ru *RoomUser) error {
+	tag, err := tx.Exec(ctx, `delete from room_join_request where room_id = $1 and user_id = $2`, ru.RoomID, ru.UserID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// ===================================================================================
+
+// =================================== Direct conversations ===================================
+func (s *pgStore) GetUserByName(ctx context.Context, username string) (*Member, error) {
+	m := &Member{}
+	err := s.db.QueryRow(ctx, `select u.id, u.username from "user" u where lower(u.username) = lower($1)`, username).Scan(&m.UserID, &m.Username)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CreateDirectRoom inserts the room unless the pair already has one, which the
+// unique dm_key settles even when both users start the conversation at once.
+func (s *pgStore) CreateDirectRoom(ctx context.Context, r *Room, a uuid.UUID, b uuid.UUID) (*Room, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx,
+		`insert into room(id, roomname, creator_id, visibility, kind, dm_key) values($1, $2, $3, $4, $5, $6)
+            on conflict (dm_key) do nothing`, r.ID, r.Name, r.CreatorID, r.Visibility, r.Kind, r.DirectKey)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() > 0 {
+		for _, uid := range []uuid.UUID{a, b} {
+			if err := addUserRoomEntry(ctx, tx, &RoomUser{RoomID: r.ID, UserID: uid, Role: RoleMember}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	room := &Room{}
+	err = tx.QueryRow(ctx,
+		`select room.id, room.roomname, room.creator_id, room.visibility, room.kind, room.dm_key
+            from room where room.dm_key = $1`, r.DirectKey).Scan(&room.ID, &room.Name, &room.CreatorID, &room.Visibility, &room.Kind, &room.DirectKey)
+	if err != nil {
+		return nil, err
+	}
+	return room, tx.Commit(ctx)
+}
+
+// ============================================================================================
+
+// ===== Search =====
+
+// SearchMessages matches the terms against the search column of message, a
+// tsvector generated from msg, so it is kept in sync by postgres on insert
+// and edit. The terms use the websearch syntax: quoted phrases, or and -.
+func (s *pgStore) SearchMessages(ctx context.Context, q *SearchQuery) ([]view.SearchResultDisplayData, error) {
+	var (
+		rid      *uuid.UUID
+		author   *string
+		from, to *time.Time
+	)
+	if q.RoomID != uuid.Nil {
+		rid = &q.RoomID
+	}
+	if q.Author != "" {
+		author = &q.Author
+	}
+	if !q.From.IsZero() {
+		from = &q.From
+	}
+	if !q.To.IsZero() {
+		to = &q.To
+	}
+	rows, err := s.db.Query(ctx,
+		`select message.id, message.room_id, room.roomname,
+            coalesce((select u.username from room_user peer
+                inner join "user" u on u.id = peer.user_id
+                where room.kind = 'direct'
+                and peer.room_id = room.id
+                and peer.user_id <> $1), '') as peer,
+            u.username, message.time, coalesce(message.parent_id, message.id),
+            ts_headline('english', message.msg, query, $8)
+            from message
+            inner join room_user on room_user.room_id = message.room_id and room_user.user_id = $1
+            inner join room on room.id = message.room_id
+            inner join "user" u on u.id = message.user_id,
+            websearch_to_tsquery('english', $2) query
+            where message.search @@ query
+            and message.deleted_at is null
+            and ($3::uuid is null or message.room_id = $3)
+            and ($4::varchar is null or u.username = $4)
+            and ($5::timestamptz is null or message.time >= $5)
+            and ($6::timestamptz is null or message.time < $6)
+            order by message.time desc, message.id desc
+            limit $7`, q.UserID, q.Terms, rid, author, from, to, q.Limit,
+		`StartSel="`+headlineStart+`", StopSel="`+headlineStop+`", MaxFragments=2, FragmentDelimiter=" ... "`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make([]view.SearchResultDisplayData, 0)
+	for rows.Next() {
+		var (
+			r        view.SearchResultDisplayData
+			peer     string
+			headline string
+			time     time.Time
+		)
+		if err := rows.Scan(&r.ID, &r.RoomID, &r.RoomName, &peer, &r.Username, &time, &r.ContextID, &headline); err != nil {
+			return nil, err
+		}
+		if peer != "" {
+			r.RoomName = peer
+		}
+		r.Time = formatTime(time)
+		r.Snippet = splitHeadline(headline)
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// ===== Attachments =====
+
+func (s *pgStore) AddAttachment(ctx context.Context, a *Attachment) error {
+	_, err := s.db.Exec(ctx,
+		`insert into attachment(id, room_id, user_id, filename, content_type, size, time) values($1, $2, $3, $4, $5, $6, $7)`,
+		a.ID, a.RoomID, a.UserID, a.Filename, a.ContentType, a.Size, a.Time)
+	return err
+}
+
+func (s *pgStore) GetAttachment(ctx context.Context, aid uuid.UUID) (*Attachment, error) {
+	a := &Attachment{}
+	err := s.db.QueryRow(ctx,
+		`select id, room_id, user_id, message_id, filename, content_type, size, time
+            from attachment
+            where id = $1`, aid).Scan(&a.ID, &a.RoomID, &a.UserID, &a.MessageID, &a.Filename, &a.ContentType, &a.Size, &a.Time)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetLinkPreview replaces the link preview of a message.
+func (s *pgStore) SetLinkPreview(ctx context.Context, mid uuid.UUID, p *LinkPreview) error {
+	tag, err := s.db.Exec(ctx,
+		`insert into message_preview(message_id, url, title, description, site_name)
+            select message.id, $2, $3, $4, $5 from message where message.id = $1
+            on conflict (message_id) do update
+            set url = excluded.url, title = excluded.title, description = excluded.description, site_name = excluded.site_name`,
+		mid, p.URL, p.Title, p.Description, p.SiteName)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// ===== Mentions =====
+
+func (s *pgStore) AddMentions(ctx context.Context, mid uuid.UUID, uids []uuid.UUID) error {
+	_, err := s.db.Exec(ctx,
+		`insert into mention(message_id, user_id) select $1, unnest($2::uuid[])
+            on conflict do nothing`, mid, uids)
+	return err
+}
+
+// GetMentions names direct conversations after the other user, like
+// SearchMessages.
+func (s *pgStore) GetMentions(ctx context.Context, uid uuid.UUID, limit int) ([]view.MentionDisplayData, error) {
+	rows, err := s.db.Query(ctx,
+		`select message.id, message.room_id, room.roomname,
+            coalesce((select u.username from room_user peer
+                inner join "user" u on u.id = peer.user_id
+                where room.kind = 'direct'
+                and peer.room_id = room.id
+                and peer.user_id <> $1), '') as peer,
+            u.username, message.msg, message.time, coalesce(message.parent_id, message.id),
+            mention.read_at is null as unread
+            from mention
+            inner join message on message.id = mention.message_id
+            inner join room_user on room_user.room_id = message.room_id and room_user.user_id = $1
+            inner join room on room.id = message.room_id
+            inner join "user" u on u.id = message.user_id
+            where mention.user_id = $1
+            and message.deleted_at is null
+            order by message.time desc, message.id desc
+            limit $2`, uid, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ms := make([]view.MentionDisplayData, 0)
+	for rows.Next() {
+		var (
+			m    view.MentionDisplayData
+			peer string
+			time time.Time
+		)
+		if err := rows.Scan(&m.ID, &m.RoomID, &m.RoomName, &peer, &m.Username, &m.Msg, &time, &m.ContextID, &m.Unread); err != nil {
+			return nil, err
+		}
+		if peer != "" {
+			m.RoomName = peer
+		}
+		m.Time = formatTime(time)
+		ms = append(ms, m)
+	}
+	return ms, rows.Err()
+}
+
+func (s *pgStore) CountUnreadMentions(ctx context.Context, uid uuid.UUID) (int, error) {
+	n := 0
+	err := s.db.QueryRow(ctx,
+		`select count(*) from mention
+            inner join message on message.id = mention.message_id
+            inner join room_user on room_user.room_id = message.room_id and room_user.user_id = $1
+            where mention.user_id = $1
+            and mention.read_at is null
+            and message.deleted_at is null`, uid).Scan(&n)
+	return n, err
+}
+
+func (s *pgStore) MarkMentionsRead(ctx context.Context, uid uuid.UUID, at time.Time) error {
+	_, err := s.db.Exec(ctx, `update mention set read_at = $2 where user_id = $1 and read_at is null`, uid, at)
+	return err
+}
+
+// ===== Pins =====
+
+func (s *pgStore) PinMessage(ctx context.Context, p *Pin) error {
+	tag, err := s.db.Exec(ctx,
+		`insert into room_pin(room_id, message_id, pinned_by, time) values($1, $2, $3, $4)
+            on conflict do nothing`, p.RoomID, p.MessageID, p.PinnedBy, p.Time)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errDuplicate
+	}
+	return nil
+}
+
+func (s *pgStore) UnpinMessage(ctx context.Context, rid uuid.UUID, mid uuid.UUID) error {
+	tag, err := s.db.Exec(ctx, `delete from room_pin where room_id = $1 and message_id = $2`, rid, mid)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) GetPins(ctx context.Context, rid uuid.UUID) ([]*Pin, error) {
+	rows, err := s.db.Query(ctx,
+		`select room_pin.room_id, room_pin.message_id, room_pin.pinned_by, room_pin.time, u.username, message.msg
+            from room_pin
+            inner join message on message.id = room_pin.message_id
+            inner join "user" u on u.id = message.user_id
+            where room_pin.room_id = $1
+            and message.deleted_at is null
+            order by room_pin.time desc`, rid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ps := make([]*Pin, 0)
+	for rows.Next() {
+		p := &Pin{}
+		if err := rows.Scan(&p.RoomID, &p.MessageID, &p.PinnedBy, &p.Time, &p.Username, &p.Msg); err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, rows.Err()
+}
+
+// ===== Notifications =====
+
+// notificationColumns are the columns scanned by scan.
+const notificationColumns = `id, user_id, kind, room_id, room_name, actor, message_id, body, time, read_at`
+
+func (n *Notification) columns() []any {
+	return []any{&n.ID, &n.UserID, &n.Kind, &n.RoomID, &n.RoomName, &n.Actor, &n.MessageID, &n.Body, &n.Time, &n.ReadAt}
+}
+
+func (s *pgStore) AddNotifications(ctx context.Context, ns []*Notification) error {
+	if len(ns) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for _, n := range ns {
+		if _, err := tx.Exec(ctx,
+			`insert into notification(`+notificationColumns+`) values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`, n.columns()...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *pgStore) GetNotifications(ctx context.Context, uid uuid.UUID, limit int) ([]*Notification, error) {
+	rows, err := s.db.Query(ctx,
+		`select `+notificationColumns+` from notification
+            where user_id = $1
+            order by time desc, id desc
+            limit $2`, uid, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ns := make([]*Notification, 0)
+	for rows.Next() {
+		n := &Notification{}
+		if err := rows.Scan(n.columns()...); err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return ns, rows.Err()
+}
+
+func (s *pgStore) CountUnreadNotifications(ctx context.Context, uid uuid.UUID) (int, error) {
+	n := 0
+	err := s.db.QueryRow(ctx, `select count(*) from notification where user_id = $1 and read_at is null`, uid).Scan(&n)
+	return n, err
+}
+
+// MarkNotificationRead keeps the time a notification was first read at.
+func (s *pgStore) MarkNotificationRead(ctx context.Context, uid uuid.UUID, nid uuid.UUID, at time.Time) (*Notification, error) {
+	n := &Notification{}
+	err := s.db.QueryRow(ctx,
+		`update notification set read_at = coalesce(read_at, $3)
+            where id = $2 and user_id = $1
+            returning `+notificationColumns, uid, nid, at).Scan(n.columns()...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (s *pgStore) MarkNotificationsRead(ctx context.Context, uid uuid.UUID, at time.Time) error {
+	_, err := s.db.Exec(ctx, `update notification set read_at = $2 where user_id = $1 and read_at is null`, uid, at)
+	return err
+}
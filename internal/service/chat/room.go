@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+var (
+	errEmptyRoomName = errors.New("Room name cannot be empty.")
+	errNotAMember    = errors.New("The user is not in the room.")
+)
+
+// renameRoom changes the name of a room and broadcasts it to the members and
+// their dashboards.
+//
+// It is shared by the websocket and the http handlers, like the functions of
+// message.go.
+func renameRoom(ctx context.Context, rooms RoomStore, h *hub, uid uuid.UUID, rid uuid.UUID, name string) (*Room, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errEmptyRoomName
+	}
+	if _, err := authorize(ctx, rooms, rid, uid, permRenameRoom); err != nil {
+		return nil, err
+	}
+	if err := rooms.RenameRoom(ctx, rid, name); err != nil {
+		return nil, err
+	}
+	room, err := rooms.GetRoomByID(ctx, rid)
+	if err != nil {
+		return nil, err
+	}
+	return room, h.publish(ctx, &message{kind: messageRoomRenamed, roomID: rid, userID: uid, body: name})
+}
+
+// kickMember removes another member from a room and disconnects them, the
+// same way as if they had left. Members can only kick the ones they outrank.
+func kickMember(ctx context.Context, rooms RoomStore, h *hub, uid uuid.UUID, rid uuid.UUID, target uuid.UUID) (*Member, error) {
+	ru, err := authorize(ctx, rooms, rid, uid, permKickMember)
+	if err != nil {
+		return nil, err
+	}
+	m, err := roomMember(ctx, rooms, rid, target)
+	if err != nil {
+		return nil, err
+	}
+	if !ru.Role.outranks(m.Role) {
+		return nil, errNoPermission
+	}
+	if err := rooms.RemoveUserFromRoom(ctx, &RoomUser{RoomID: rid, UserID: target}); errors.Is(err, errNotFound) {
+		return nil, errNotAMember
+	} else if err != nil {
+		return nil, err
+	}
+	return m, h.publish(ctx, &message{kind: messageMemberKicked, roomID: rid, userID: m.UserID, username: m.Username})
+}
+
+// setMemberRole promotes a member to admin or demotes an admin back to a
+// member. The ownership of a room cannot be given away.
+func setMemberRole(ctx context.Context, rooms RoomStore, h *hub, uid uuid.UUID, rid uuid.UUID, target uuid.UUID, role Role) (*Member, error) {
+	if role != RoleAdmin && role != RoleMember {
+		return nil, errInvalidRole
+	}
+	ru, err := authorize(ctx, rooms, rid, uid, permManageRoles)
+	if err != nil {
+		return nil, err
+	}
+	m, err := roomMember(ctx, rooms, rid, target)
+	if err != nil {
+		return nil, err
+	}
+	if !ru.Role.outranks(m.Role) {
+		return nil, errNoPermission
+	}
+	if err := rooms.SetRole(ctx, &RoomUser{RoomID: rid, UserID: target, Role: role}); errors.Is(err, errNotFound) {
+		return nil, errNotAMember
+	} else if err != nil {
+		return nil, err
+	}
+	m.Role = role
+	return m, h.publish(ctx, &message{kind: messageRoleChanged, roomID: rid, userID: m.UserID, username: m.Username, body: string(role)})
+}
+
+// roomMember finds a member of a room, with their username and role.
+func roomMember(ctx context.Context, rooms RoomStore, rid uuid.UUID, uid uuid.UUID) (*Member, error) {
+	members, err := rooms.GetRoomMembers(ctx, rid)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range members {
+		if m.UserID == uid {
+			return m, nil
+		}
+	}
+	return nil, errNotAMember
+}
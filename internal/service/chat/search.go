@@ -0,0 +1,151 @@
+package chat
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/brianaung/rtm/view"
+	"github.com/gofrs/uuid/v5"
+)
+
+// searchLimit is the maximum number of results of a search.
+const searchLimit = 50
+
+// searchDateLayout is the format of the date filters of a search.
+const searchDateLayout = "2006-01-02"
+
+// headlineStart and headlineStop delimit the matches in the headlines
+// returned by postgres. They are control characters so that they cannot be
+// confused with html or the content of the message.
+const (
+	headlineStart = "\x01"
+	headlineStop  = "\x02"
+)
+
+var (
+	errEmptySearch = errors.New("Search query cannot be empty.")
+	errInvalidDate = errors.New("Dates must be formatted as YYYY-MM-DD.")
+	errInvalidRoom = errors.New("Invalid room id.")
+)
+
+// SearchQuery filters the messages returned by SearchMessages. Zero fields
+// other than UserID and Terms do not filter.
+type SearchQuery struct {
+	// UserID is the user searching, only the rooms they are a member of are
+	// searched.
+	UserID uuid.UUID
+	Terms  string
+	RoomID uuid.UUID
+	// Author is the username of the author.
+	Author string
+	From   time.Time
+	// To is exclusive.
+	To    time.Time
+	Limit int
+}
+
+// parseSearchQuery reads a search of uid from the query string of /search.
+// Dates are whole days, both ends included.
+func parseSearchQuery(uid uuid.UUID, v url.Values) (*SearchQuery, error) {
+	q := &SearchQuery{
+		UserID: uid,
+		Terms:  strings.TrimSpace(v.Get("q")),
+		Author: strings.TrimSpace(v.Get("author")),
+		Limit:  searchLimit,
+	}
+	if q.Terms == "" {
+		return nil, errEmptySearch
+	}
+	if rid := v.Get("room"); rid != "" {
+		id, err := uuid.FromString(rid)
+		if err != nil {
+			return nil, errInvalidRoom
+		}
+		q.RoomID = id
+	}
+	if from := v.Get("from"); from != "" {
+		t, err := time.ParseInLocation(searchDateLayout, from, time.Local)
+		if err != nil {
+			return nil, errInvalidDate
+		}
+		q.From = t
+	}
+	if to := v.Get("to"); to != "" {
+		t, err := time.ParseInLocation(searchDateLayout, to, time.Local)
+		if err != nil {
+			return nil, errInvalidDate
+		}
+		q.To = t.AddDate(0, 0, 1)
+	}
+	return q, nil
+}
+
+// splitHeadline turns a headline delimited with headlineStart and headlineStop
+// into the parts of a snippet.
+func splitHeadline(h string) []view.SnippetPart {
+	parts := make([]view.SnippetPart, 0)
+	for h != "" {
+		before, rest, found := strings.Cut(h, headlineStart)
+		if before != "" {
+			parts = append(parts, view.SnippetPart{Text: before})
+		}
+		if !found {
+			break
+		}
+		match, after, _ := strings.Cut(rest, headlineStop)
+		if match != "" {
+			parts = append(parts, view.SnippetPart{Text: match, Match: true})
+		}
+		h = after
+	}
+	return parts
+}
+
+// searchTerms are the lowercased words of a query, for the in-memory store
+// which matches words by substring instead of stemming them like postgres.
+func searchTerms(q string) []string {
+	return strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// highlight splits text into the parts of a snippet, the occurrences of terms
+// being matches. It returns nil if some term does not occur in text.
+func highlight(text string, terms []string) []view.SnippetPart {
+	// lowercasing can change the length of some runes, so matches are
+	// looked for rune by rune
+	runes := []rune(text)
+	lower := []rune(strings.ToLower(text))
+	if len(lower) != len(runes) {
+		lower = runes
+	}
+	matched := make([]bool, len(runes))
+	for _, t := range terms {
+		term := []rune(t)
+		found := false
+		for i := 0; i+len(term) <= len(lower); i++ {
+			if string(lower[i:i+len(term)]) == t {
+				found = true
+				for j := i; j < i+len(term); j++ {
+					matched[j] = true
+				}
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	parts := make([]view.SnippetPart, 0)
+	for i := 0; i < len(runes); {
+		j := i
+		for j < len(runes) && matched[j] == matched[i] {
+			j++
+		}
+		parts = append(parts, view.SnippetPart{Text: string(runes[i:j]), Match: matched[i]})
+		i = j
+	}
+	return parts
+}
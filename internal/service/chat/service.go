@@ -1,26 +1,67 @@
 package chat
 
 import (
+	"strings"
+	"time"
+
 	"github.com/brianaung/rtm/internal/auth"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/jwtauth/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/gorilla/websocket"
 )
 
 type service struct {
-	r        *chi.Mux
-	db       *pgxpool.Pool
-	userauth *auth.Auth
-	hub      *hub
+	r             *chi.Mux
+	rooms         RoomStore
+	messages      MessageStore
+	notifications NotificationStore
+	blobs         BlobStore
+	userauth      *auth.Auth
+	hub           *hub
+	upgrader      websocket.Upgrader
+	// publicURL prefixes the links handed out to be shared, such as the
+	// invite links. They are relative when it is empty.
+	publicURL string
+	// how often the open sockets and streams check their session, see
+	// sessionActive
+	sessionCheck time.Duration
+	// previews is nil when link previews are disabled
+	previews *previewer
+	events   *events
+	// events of the dashboard socket
+	dashboardEvents *events
 }
 
-func NewService(r *chi.Mux, db *pgxpool.Pool, userauth *auth.Auth) (s *service) {
-	h := newHub()
+func NewService(r *chi.Mux, rooms RoomStore, messages MessageStore, notifications NotificationStore, blobs BlobStore, userauth *auth.Auth, bp Backplane) (s *service) {
+	h := newHub(bp, messages)
 	go h.run()
-	s = &service{r: r, db: db, userauth: userauth, hub: h}
+	go h.receive()
+	s = &service{r: r, rooms: rooms, messages: messages, notifications: notifications, blobs: blobs, userauth: userauth, hub: h, upgrader: newUpgrader(nil), sessionCheck: sessionCheckPeriod, events: newEvents(), dashboardEvents: newEvents()}
+	s.registerEvents()
 	return
 }
 
+// EnableLinkPreviews starts fetching the previews of the links posted in
+// messages. It must be called before the service handles any request.
+func (s *service) EnableLinkPreviews() {
+	s.previews = newPreviewer(s.messages, s.hub)
+	s.previews.run()
+}
+
+// SetPublicURL sets the address the server is reached at, such as
+// https://chat.example.com, to build the links handed out to be shared. It
+// must be called before the service handles any request.
+func (s *service) SetPublicURL(u string) {
+	s.publicURL = strings.TrimRight(u, "/")
+}
+
+// AllowOrigins lets the pages of other origins, such as https://example.com,
+// open the chat websockets. It must be called before the service handles any
+// request.
+func (s *service) AllowOrigins(origins []string) {
+	s.upgrader = newUpgrader(origins)
+}
+
 // Routes creates routes for listening to requests.
 //
 // It handles the protected routes for different chat services.
@@ -34,11 +75,40 @@ func (s *service) Routes() {
 		r.Get("/dashboard", s.handleDashboard)
 		r.Post("/create", s.handleCreateRoom)
 		r.Put("/join", s.handleJoinRoom)
+		r.Post("/dm", s.handleOpenDirect)
 		r.Get("/room/{rid}", s.handleGotoRoom)
+		r.Get("/room/{rid}/messages", s.handleGetMessages)
+		r.Get("/room/{rid}/presence", s.handleGetPresence)
+		r.Put("/room/{rid}/messages/{mid}", s.handleEditMessage)
+		r.Delete("/room/{rid}/messages/{mid}", s.handleDeleteMessage)
+		r.Get("/room/{rid}/messages/{mid}/thread", s.handleGetThread)
+		r.Put("/room/{rid}/pins/{mid}", s.handlePinMessage)
+		r.Delete("/room/{rid}/pins/{mid}", s.handleUnpinMessage)
+		r.Post("/room/{rid}/attachments", s.handleUploadAttachment)
+		r.Get("/room/{rid}/attachments/{aid}", s.handleGetAttachment)
+		r.Get("/search", s.handleSearch)
+		r.Get("/mentions", s.handleMentions)
+		r.Get("/mentions/count", s.handleMentionCount)
+		r.Get("/notifications", s.handleNotifications)
+		r.Get("/notifications/count", s.handleNotificationCount)
+		r.Post("/notifications/read", s.handleReadNotifications)
+		r.Post("/notifications/{nid}/read", s.handleReadNotification)
 		r.Delete("/delete/{rid}", s.handleDeleteRoom)
-		// TODO: leave room route?
+		r.Post("/room/{rid}/leave", s.handleLeaveRoom)
+		r.Put("/room/{rid}", s.handleRenameRoom)
+		r.Delete("/room/{rid}/members/{uid}", s.handleKickMember)
+		r.Put("/room/{rid}/members/{uid}/role", s.handleSetRole)
+		r.Put("/room/{rid}/visibility", s.handleSetVisibility)
+		r.Post("/room/{rid}/invites", s.handleCreateInvite)
+		r.Get("/invite/{token}", s.handleRedeemInvite)
+		r.Post("/room/{rid}/requests/{uid}", s.handleApproveJoin)
+		r.Delete("/room/{rid}/requests/{uid}", s.handleRejectJoin)
 
 		// ws connection
 		r.Get("/ws/chat/{rid}", s.serveWs)
+		r.Get("/ws/dashboard", s.serveDashboardWs)
+
+		// sse connection
+		r.Get("/notifications/stream", s.serveNotifications)
 	})
 }
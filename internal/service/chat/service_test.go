@@ -0,0 +1,179 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianaung/rtm/internal/auth"
+	"github.com/brianaung/rtm/internal/service/user"
+	"github.com/go-chi/chi/v5"
+	"github.com/gofrs/uuid/v5"
+	"github.com/gorilla/websocket"
+)
+
+// testEnv is a chat service running on the in-memory stores and the local
+// backplane, served by a test http server for the websockets.
+type testEnv struct {
+	t     *testing.T
+	r     *chi.Mux
+	s     *service
+	store *memStore
+	users user.UserStore
+	auth  *auth.Auth
+	srv   *httptest.Server
+}
+
+// testUser is a user logged in to a testEnv.
+type testUser struct {
+	*auth.UserContext
+	cookies []*http.Cookie
+	// csrf is the token sent back in the header of the requests changing
+	// state, see auth.CSRF.
+	csrf string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test secret")
+	users := user.NewMemStore()
+	store := NewMemStore(users)
+	blobs, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp := NewLocalBackplane()
+	a := auth.Init(users)
+	r := chi.NewRouter()
+	r.Use(a.CSRF())
+	s := NewService(r, store, store, store, blobs, a, bp)
+	s.Routes()
+	srv := httptest.NewServer(r)
+	t.Cleanup(func() {
+		srv.Close()
+		// the backplane is left open, presence announcements may still be
+		// on their way to it
+		s.hub.quit <- true
+	})
+	return &testEnv{t: t, r: r, s: s, store: store, users: users, auth: a, srv: srv}
+}
+
+// login signs up a user and opens a session for them.
+func (e *testEnv) login(name string) *testUser {
+	e.t.Helper()
+	u, err := e.users.AddUser(context.Background(), &user.User{Username: name, Email: name + "@example.com", Password: "unused"})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	uc := &auth.UserContext{ID: u.ID, Username: u.Username, Email: u.Email}
+	rec := httptest.NewRecorder()
+	if err := e.auth.StartSession(rec, httptest.NewRequest(http.MethodPost, "/login", nil), uc); err != nil {
+		e.t.Fatal(err)
+	}
+	tu := &testUser{UserContext: uc, cookies: rec.Result().Cookies()}
+	// any page hands out the csrf token
+	rec = httptest.NewRecorder()
+	e.r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "csrf" {
+			tu.cookies, tu.csrf = append(tu.cookies, c), c.Value
+		}
+	}
+	return tu
+}
+
+// do serves a request of u, with the form values in its body.
+func (e *testEnv) do(u *testUser, method string, path string, form url.Values) *httptest.ResponseRecorder {
+	e.t.Helper()
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req := httptest.NewRequest(method, path, body)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set(auth.CSRFHeader, u.csrf)
+	for _, c := range u.cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	e.r.ServeHTTP(rec, req)
+	return rec
+}
+
+// createRoom creates a room owned by u through the handler, and returns its id.
+func (e *testEnv) createRoom(u *testUser, name string) uuid.UUID {
+	e.t.Helper()
+	rec := e.do(u, http.MethodPost, "/create", url.Values{"rname": {name}})
+	if rec.Code != http.StatusOK {
+		e.t.Fatalf("create room: got %d %q", rec.Code, rec.Body)
+	}
+	rid, err := uuid.FromString(strings.TrimPrefix(rec.Header().Get("HX-Redirect"), "/room/"))
+	if err != nil {
+		e.t.Fatalf("create room: %v", err)
+	}
+	return rid
+}
+
+// dial opens a websocket of u to the test server.
+func (e *testEnv) dial(u *testUser, path string) *websocket.Conn {
+	e.t.Helper()
+	conn, res, err := e.tryDial(u, path)
+	if err != nil {
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+		}
+		e.t.Fatalf("dial %s: %v (status %d)", path, err, status)
+	}
+	e.t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// tryDial is dial for the handshakes that may be refused.
+func (e *testEnv) tryDial(u *testUser, path string) (*websocket.Conn, *http.Response, error) {
+	header := http.Header{}
+	for _, c := range u.cookies {
+		header.Add("Cookie", c.String())
+	}
+	return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(e.srv.URL, "http")+path, header)
+}
+
+// sendEvent writes an event envelope to a websocket.
+func sendEvent(t *testing.T, conn *websocket.Conn, typ string, id string, payload any) {
+	t.Helper()
+	e := &envelope{V: protocolVersion, Type: typ, ID: id}
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Payload = raw
+	}
+	if err := conn.WriteJSON(e); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readUntil reads frames from a websocket until one contains s, and returns it.
+func readUntil(t *testing.T, conn *websocket.Conn, s string) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", s, err)
+		}
+		if strings.Contains(string(frame), s) {
+			return string(frame)
+		}
+	}
+}
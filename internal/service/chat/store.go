@@ -0,0 +1,166 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/brianaung/rtm/view"
+	"github.com/gofrs/uuid/v5"
+)
+
+var (
+	errNotFound  = errors.New("not found")
+	errDuplicate = errors.New("already exists")
+	errLimit     = errors.New("limit reached")
+)
+
+// RoomStore persists rooms and their memberships.
+//
+// Lookups of a single entry return a nil value with a nil error when
+// nothing matches, so handlers can tell "not found" apart from a failure.
+type RoomStore interface {
+	CreateRoomWithCreator(ctx context.Context, r *Room) error
+	AddUserToRoom(ctx context.Context, ru *RoomUser) error
+	// RemoveUserFromRoom returns errNotFound if the user is not a member.
+	RemoveUserFromRoom(ctx context.Context, ru *RoomUser) error
+	IsAMember(ctx context.Context, ru *RoomUser) (bool, error)
+	// GetRoomUser returns the membership of a user in a room, with their role.
+	GetRoomUser(ctx context.Context, rid uuid.UUID, uid uuid.UUID) (*RoomUser, error)
+	// SetRole changes the role of a member, it returns errNotFound if the
+	// user is not a member.
+	SetRole(ctx context.Context, ru *RoomUser) error
+	GetRoomByID(ctx context.Context, rid uuid.UUID) (*Room, error)
+	// RenameRoom returns errNotFound if the room does not exist.
+	RenameRoom(ctx context.Context, rid uuid.UUID, name string) error
+	GetAllRooms(ctx context.Context) ([]*Room, error)
+	// GetRoomsFromUser returns the rooms of a user ordered by name, with the
+	// number of messages from others they have not read yet.
+	GetRoomsFromUser(ctx context.Context, uid uuid.UUID) ([]*Room, error)
+	// MarkRead moves the read marker of a member forward to at. It reports
+	// whether the marker moved, acks older than the marker and acks of
+	// users who are not members are ignored.
+	MarkRead(ctx context.Context, ru *RoomUser, at time.Time) (bool, error)
+	// GetRoomMembers returns the members of a room ordered by username, with
+	// their roles.
+	GetRoomMembers(ctx context.Context, rid uuid.UUID) ([]*Member, error)
+	// DeleteRoom returns the ids of the attachments deleted with the room,
+	// whose blobs are left to the caller.
+	DeleteRoom(ctx context.Context, rid uuid.UUID) ([]uuid.UUID, error)
+
+	// SetVisibility returns errNotFound if the room does not exist.
+	SetVisibility(ctx context.Context, rid uuid.UUID, v Visibility) error
+	CreateInvite(ctx context.Context, inv *Invite) error
+	// RedeemInvite adds the user to the room of the invite and marks the
+	// invite as used, in one go, and returns the invite. It returns
+	// errNotFound if the invite does not exist, has expired or was single use
+	// and already used.
+	RedeemInvite(ctx context.Context, id uuid.UUID, ru *RoomUser, at time.Time) (*Invite, error)
+	// AddJoinRequest returns errDuplicate if the user already asked.
+	AddJoinRequest(ctx context.Context, jr *JoinRequest) error
+	// GetJoinRequests returns the pending requests of a room, oldest first.
+	GetJoinRequests(ctx context.Context, rid uuid.UUID) ([]*JoinRequest, error)
+	// ApproveJoinRequest turns a request into a membership, and
+	// RejectJoinRequest drops it. Both return errNotFound if there is no
+	// such request.
+	ApproveJoinRequest(ctx context.Context, ru *RoomUser) error
+	RejectJoinRequest(ctx context.Context, ru *RoomUser) error
+
+	// GetUserByName finds the user to start a direct conversation with,
+	// whatever the case of the username.
+	GetUserByName(ctx context.Context, username string) (*Member, error)
+	// CreateDirectRoom creates the direct conversation between the two users
+	// of r.DirectKey, or returns the existing one if they already have one.
+	CreateDirectRoom(ctx context.Context, r *Room, a uuid.UUID, b uuid.UUID) (*Room, error)
+}
+
+// UserDirectory resolves user accounts for the in-memory store, which cannot
+// join the user table like the postgres store does.
+type UserDirectory interface {
+	GetUsernameByID(ctx context.Context, uid uuid.UUID) (string, error)
+	// GetUserIDByName matches the username whatever its case, and returns
+	// uuid.Nil if there is no such user.
+	GetUserIDByName(ctx context.Context, username string) (uuid.UUID, error)
+}
+
+// MessageStore persists the chat history of rooms.
+type MessageStore interface {
+	// AddMessageEntry also sends m.Attachment with the message. It returns
+	// errNotFound if the attachment is not an unsent one of the author in
+	// the room.
+	AddMessageEntry(ctx context.Context, m *Message) error
+	GetMessageByID(ctx context.Context, mid uuid.UUID) (*Message, error)
+	// EditMessage and DeleteMessage return errNotFound if the message does
+	// not exist or has already been deleted.
+	EditMessage(ctx context.Context, mid uuid.UUID, msg string, at time.Time) error
+	DeleteMessage(ctx context.Context, mid uuid.UUID, at time.Time) error
+	// GetMessagesFromRoom returns a page of at most limit messages older than
+	// the before cursor (or the latest ones if before is nil), newest first.
+	// The returned cursor points to the next page and is nil on the last one.
+	// Replies are left out, they are fetched per thread with GetThread.
+	GetMessagesFromRoom(ctx context.Context, rid uuid.UUID, uid uuid.UUID, before *Cursor, limit int) ([]view.MsgDisplayData, *Cursor, error)
+	// GetThread returns the replies to a message, oldest first.
+	GetThread(ctx context.Context, parent uuid.UUID, uid uuid.UUID) ([]view.MsgDisplayData, error)
+	// CountReplies returns the number of replies to a message that are not deleted.
+	CountReplies(ctx context.Context, parent uuid.UUID) (int, error)
+
+	// AddReaction returns errDuplicate if the user already reacted with the
+	// emoji, and errLimit if they already reacted with max other emojis,
+	// which is checked atomically with the insert. RemoveReaction returns
+	// errNotFound if they did not react with the emoji.
+	AddReaction(ctx context.Context, r *Reaction, max int) error
+	RemoveReaction(ctx context.Context, r *Reaction) error
+	// GetReactions returns the reactions to a message, oldest first.
+	GetReactions(ctx context.Context, mid uuid.UUID) ([]*Reaction, error)
+
+	// SearchMessages returns the messages matching a search, newest first.
+	// Deleted messages and rooms the user is not a member of are left out.
+	SearchMessages(ctx context.Context, q *SearchQuery) ([]view.SearchResultDisplayData, error)
+
+	AddAttachment(ctx context.Context, a *Attachment) error
+	GetAttachment(ctx context.Context, aid uuid.UUID) (*Attachment, error)
+
+	// SetLinkPreview returns errNotFound if the message does not exist.
+	SetLinkPreview(ctx context.Context, mid uuid.UUID, p *LinkPreview) error
+
+	// AddMentions records the users mentioned in a message, the ones already
+	// recorded are left as they are.
+	AddMentions(ctx context.Context, mid uuid.UUID, uids []uuid.UUID) error
+	// GetMentions returns at most limit messages mentioning a user, newest
+	// first. Deleted messages and rooms the user left are left out, and so
+	// they are by CountUnreadMentions.
+	GetMentions(ctx context.Context, uid uuid.UUID, limit int) ([]view.MentionDisplayData, error)
+	CountUnreadMentions(ctx context.Context, uid uuid.UUID) (int, error)
+	// MarkMentionsRead marks every mention of a user as read.
+	MarkMentionsRead(ctx context.Context, uid uuid.UUID, at time.Time) error
+
+	// PinMessage returns errDuplicate if the message is already pinned,
+	// UnpinMessage returns errNotFound if it is not.
+	PinMessage(ctx context.Context, p *Pin) error
+	UnpinMessage(ctx context.Context, rid uuid.UUID, mid uuid.UUID) error
+	// GetPins returns the pinned messages of a room, the latest pinned first.
+	// Deleted messages are left out.
+	GetPins(ctx context.Context, rid uuid.UUID) ([]*Pin, error)
+}
+
+// NotificationStore persists the notifications of users.
+type NotificationStore interface {
+	AddNotifications(ctx context.Context, ns []*Notification) error
+	// GetNotifications returns at most limit notifications of a user, newest
+	// first.
+	GetNotifications(ctx context.Context, uid uuid.UUID, limit int) ([]*Notification, error)
+	CountUnreadNotifications(ctx context.Context, uid uuid.UUID) (int, error)
+	// MarkNotificationRead returns the notification once read, or
+	// errNotFound if the user has no such notification.
+	MarkNotificationRead(ctx context.Context, uid uuid.UUID, nid uuid.UUID, at time.Time) (*Notification, error)
+	// MarkNotificationsRead marks every notification of a user as read.
+	MarkNotificationsRead(ctx context.Context, uid uuid.UUID, at time.Time) error
+}
+
+// formatTime formats message timestamps the way they are displayed in the chatroom.
+func formatTime(t time.Time) string {
+	return fmt.Sprintf("%d/%02d/%02d %02d:%02d:%02d",
+		t.Year(), t.Month(), t.Day(),
+		t.Hour(), t.Minute(), t.Second())
+}
@@ -0,0 +1,94 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+var errNestedReply = errors.New("Replies cannot be replied to.")
+
+// threadView tells the hub which thread a client shows in its thread panel.
+// The parent is uuid.Nil when the panel is closed.
+type threadView struct {
+	client *client
+	parent uuid.UUID
+}
+
+// sendReply stores a reply from uid to the message parent and broadcasts it
+// to the clients viewing the thread. Threads are one level deep, replies
+// cannot be replied to.
+func sendReply(ctx context.Context, messages MessageStore, rooms RoomStore, h *hub, uid uuid.UUID, username string, rid uuid.UUID, parent uuid.UUID, body string) (*Message, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return nil, errEmptyMessage
+	} else if utf8.RuneCountInString(body) > maxMessageLen {
+		return nil, errMessageTooLong
+	}
+	if err := member(ctx, rooms, rid, uid); err != nil {
+		return nil, err
+	}
+	p, err := roomMessage(ctx, messages, rid, parent)
+	if err != nil {
+		return nil, err
+	}
+	if p.ParentID != nil {
+		return nil, errNestedReply
+	}
+	m := &Message{ID: uuid.Must(uuid.NewV4()), Msg: body, Time: time.Now(), RoomID: rid, UserID: uid, Username: username, ParentID: &parent}
+	if err := messages.AddMessageEntry(ctx, m); err != nil {
+		return nil, err
+	}
+	replies, err := messages.CountReplies(ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.publish(ctx, &message{kind: messageReply, id: m.ID, parent: parent, replies: replies, body: m.Msg, roomID: m.RoomID, userID: m.UserID, username: m.Username, time: m.Time}); err != nil {
+		// the reply is saved, the clients see it once they reload
+		log.Printf("error: %v", err)
+	}
+	return m, nil
+}
+
+// viewThread records the thread shown by a client, replacing the previous one.
+// The views of clients the hub already removed are ignored, nothing would
+// clear them.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) viewThread(v *threadView) {
+	if old, ok := h.viewing[v.client]; ok {
+		delete(h.threads[old], v.client)
+		if len(h.threads[old]) == 0 {
+			delete(h.threads, old)
+		}
+		delete(h.viewing, v.client)
+	}
+	if v.parent == uuid.Nil || !h.rooms[v.client.roomID][v.client] {
+		return
+	}
+	if h.threads[v.parent] == nil {
+		h.threads[v.parent] = make(map[*client]bool)
+	}
+	h.threads[v.parent][v.client] = true
+	h.viewing[v.client] = v.parent
+}
+
+// scoped returns what a room client gets of a message. The messages of a
+// thread only reach the clients viewing it, the others just learn the new
+// number of replies, or nothing at all for an edit or a reaction.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) scoped(c *client, m *message) *message {
+	if m.parent == uuid.Nil || h.threads[m.parent][c] {
+		return m
+	}
+	if m.kind != messageReply && m.kind != messageDeleted {
+		return nil
+	}
+	return &message{kind: messageReplyCount, roomID: m.roomID, id: m.parent, replies: m.replies}
+}
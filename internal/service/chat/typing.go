@@ -0,0 +1,74 @@
+package chat
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+// typingTimeout is how long a user is shown as typing after their last
+// typing event. Clients keep sending typing.start while the user types.
+const typingTimeout = 5 * time.Second
+
+// typist is a user currently typing in a room.
+type typist struct {
+	userID   uuid.UUID
+	username string
+	expires  time.Time
+}
+
+// setTyping updates the typing state of the author of m in its room. It
+// reports whether the set of users typing in the room has changed.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) setTyping(m *message, typing bool) bool {
+	room := h.typing[m.roomID]
+	_, was := room[m.userID]
+	if !typing {
+		if was {
+			delete(room, m.userID)
+		}
+		return was
+	}
+	if room == nil {
+		room = make(map[uuid.UUID]*typist)
+		h.typing[m.roomID] = room
+	}
+	room[m.userID] = &typist{userID: m.userID, username: m.username, expires: time.Now().Add(typingTimeout)}
+	return !was
+}
+
+// expireTyping drops the typists that have not sent an event for a while and
+// notifies the rooms that changed.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) expireTyping(now time.Time) {
+	for rid, room := range h.typing {
+		changed := false
+		for uid, t := range room {
+			if now.After(t.expires) {
+				delete(room, uid)
+				changed = true
+			}
+		}
+		if len(room) == 0 {
+			delete(h.typing, rid)
+		}
+		if changed {
+			h.broadcastTyping(rid)
+		}
+	}
+}
+
+// broadcastTyping sends the users typing in a room to all its clients.
+//
+// Must only be called from the hub.run goroutine.
+func (h *hub) broadcastTyping(rid uuid.UUID) {
+	typists := make([]typist, 0, len(h.typing[rid]))
+	for _, t := range h.typing[rid] {
+		typists = append(typists, *t)
+	}
+	sort.Slice(typists, func(i, j int) bool { return typists[i].username < typists[j].username })
+	h.deliver(&message{kind: messageTyping, roomID: rid, typists: typists})
+}
@@ -1,9 +1,20 @@
 package user
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/brianaung/rtm/internal/auth"
 	"github.com/brianaung/rtm/view"
+	"github.com/go-chi/chi/v5"
+	"github.com/gofrs/uuid/v5"
 )
 
 func (s *service) handleHome(w http.ResponseWriter, r *http.Request) {
@@ -13,71 +24,269 @@ func (s *service) handleHome(w http.ResponseWriter, r *http.Request) {
 
 func (s *service) handleGetLoginForm(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusFound)
-	view.LoginForm().Render(r.Context(), w)
+	view.LoginForm(view.AuthFormData{}).Render(r.Context(), w)
 }
 
 func (s *service) handleGetSignupForm(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusFound)
-	view.SignupForm().Render(r.Context(), w)
+	view.SignupForm(view.AuthFormData{}).Render(r.Context(), w)
 }
 
 /* ================================================ */
 /* Deals with user auth, jwt token creations and managing token cookies */
 func (s *service) handleSignup(w http.ResponseWriter, r *http.Request) {
-	username := r.FormValue("username")
-	email := r.FormValue("email")
-	password := r.FormValue("password")
-
-	// todo: more input validations
-	if u, _ := getUserByName(r.Context(), s.db, username); u != nil {
-		w.Write([]byte("username already exists"))
+	f := &signupForm{
+		Username: r.FormValue("username"),
+		Email:    r.FormValue("email"),
+		Password: r.FormValue("password"),
+	}
+	f.normalize()
+	if errs := f.validate(); len(errs) > 0 {
+		rejectSignup(w, r, f, errs)
 		return
 	}
 
-	hashedPassword, _ := s.userauth.HashAndSalt(password)
-	u := &User{Username: username, Email: email, Password: hashedPassword}
-	u, err := addUser(r.Context(), s.db, u)
-	// res, err := json.Marshal(u)
+	hashedPassword, err := s.userauth.HashAndSalt(f.Password)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
+	u := &User{Username: f.Username, Email: f.Email, Password: hashedPassword}
+	// the unique constraints of the store tell whether the username or the
+	// email is taken, even by a concurrent signup
+	u, err = s.users.AddUser(r.Context(), u)
+	if errors.Is(err, errUsernameTaken) {
+		rejectSignup(w, r, f, fieldErrors{"username": "Username is already taken."})
+		return
+	} else if errors.Is(err, errEmailTaken) {
+		rejectSignup(w, r, f, fieldErrors{"email": "Email is already used by another account."})
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
-	claims := map[string]interface{}{"id": u.ID, "username": u.Username, "email": u.Email}
-	s.userauth.SetTokenCookie(w, claims)
+	if err := s.userauth.StartSession(w, r, &auth.UserContext{ID: u.ID, Username: u.Username, Email: u.Email}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
 	w.Header().Set("HX-Redirect", "/dashboard")
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *service) handleLogin(w http.ResponseWriter, r *http.Request) {
-	username := r.FormValue("username")
+	username := strings.TrimSpace(r.FormValue("username"))
 	password := r.FormValue("password")
 
-	u, err := getUserByName(r.Context(), s.db, username)
+	errs := fieldErrors{}
+	if username == "" {
+		errs["username"] = "Username is required."
+	}
+	if password == "" {
+		errs["password"] = "Password is required."
+	}
+	if len(errs) > 0 {
+		rejectLogin(w, r, username, errs)
+		return
+	}
+
+	now := time.Now()
+	if wait, err := s.allowLogin(r.Context(), r, username, now); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	} else if wait > 0 {
+		s.auditLogin(r, username, nil, failRateLimited, now)
+		throttleLogin(w, r, username, now.Add(wait))
+		return
+	}
+
+	f, err := s.users.GetLoginFailures(r.Context(), loginKey(username))
 	if err != nil {
-		w.Write([]byte("user not found"))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
 		return
 	}
-	err = s.userauth.CheckPassword(u.Password, password)
+	u, err := s.users.GetUserByName(r.Context(), username)
 	if err != nil {
-		w.Write([]byte("wrong password"))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	// unknown and locked usernames take as long as a wrong password, and
+	// are answered the same as the others
+	if f != nil && f.LockedUntil != nil && now.Before(*f.LockedUntil) {
+		s.userauth.CheckNoPassword(password)
+		s.auditLogin(r, username, u, failLocked, now)
+		throttleLogin(w, r, username, *f.LockedUntil)
+		return
+	}
+	if u == nil {
+		s.userauth.CheckNoPassword(password)
+		s.auditLogin(r, username, nil, failUnknownUser, now)
+		s.rejectBadLogin(w, r, username, now)
+		return
+	}
+	err = s.userauth.CheckPassword(u.Password, password)
+	if errors.Is(err, auth.ErrWrongPassword) {
+		s.auditLogin(r, username, u, failWrongPassword, now)
+		s.rejectBadLogin(w, r, username, now)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
 		return
 	}
+	if f != nil {
+		if err := s.users.ResetLoginFailures(r.Context(), loginKey(username)); err != nil {
+			log.Printf("error: %v", err)
+		}
+	}
+	// the password is known now, hash it again if the hashing settings changed
+	if s.userauth.NeedsRehash(u.Password) {
+		if err := s.rehash(r.Context(), u, password); err != nil {
+			log.Printf("error: %v", err)
+		}
+	}
 
-	claims := map[string]interface{}{"id": u.ID, "username": u.Username, "email": u.Email}
-	s.userauth.SetTokenCookie(w, claims)
+	if err := s.userauth.StartSession(w, r, &auth.UserContext{ID: u.ID, Username: u.Username, Email: u.Email}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
 	w.Header().Set("HX-Redirect", "/dashboard")
 	w.WriteHeader(http.StatusOK)
 }
 
+// rejectSignup and rejectLogin render their form again with the errors of its
+// fields. Rejected forms are answered with 422, which the layout swaps in.
+// Logins are rejected with errBadLogin whatever the reason, see handleLogin.
+func rejectSignup(w http.ResponseWriter, r *http.Request, f *signupForm, errs fieldErrors) {
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	view.SignupForm(view.AuthFormData{Username: f.Username, Email: f.Email, Errors: errs}).Render(r.Context(), w)
+}
+
+func rejectLogin(w http.ResponseWriter, r *http.Request, username string, errs fieldErrors) {
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	view.LoginForm(view.AuthFormData{Username: username, Errors: errs}).Render(r.Context(), w)
+}
+
+// rejectBadLogin counts a failed login to username, and rejects it with
+// errBadLogin, or throttles it if the username got locked.
+func (s *service) rejectBadLogin(w http.ResponseWriter, r *http.Request, username string, now time.Time) {
+	until, err := s.failLogin(r.Context(), username, now)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+	} else if until != nil {
+		throttleLogin(w, r, username, *until)
+	} else {
+		rejectLogin(w, r, username, fieldErrors{"form": errBadLogin})
+	}
+}
+
+// throttleLogin renders the login form again for a client that may not try
+// again until t, either rate limited or locked out. Both answer the same.
+func throttleLogin(w http.ResponseWriter, r *http.Request, username string, t time.Time) {
+	d := time.Until(t)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	view.LoginForm(view.AuthFormData{Username: username, Errors: fieldErrors{"form": retryAfter(d)}}).Render(r.Context(), w)
+}
+
+// rehash replaces the password hash of a user with one made with the current
+// settings. The login goes on if it fails, the old hash still works.
+func (s *service) rehash(ctx context.Context, u *User, password string) error {
+	hashed, err := s.userauth.HashAndSalt(password)
+	if err != nil {
+		return err
+	}
+	return s.users.UpdatePassword(ctx, u.ID, hashed)
+}
+
 func (s *service) handleLogout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{Name: "jwt", Value: "", MaxAge: -1, HttpOnly: true})
+	if err := s.userauth.EndSession(w, r); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
 	w.Header().Set("HX-Redirect", "/")
 	w.WriteHeader(http.StatusFound)
 }
 
+// handleLogoutAll revokes every session of the user, on all their devices.
+func (s *service) handleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	if err := s.userauth.EndAllSessions(w, r); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("HX-Redirect", "/")
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleSettings lists the active sessions of the user, so they can revoke the
+// ones they do not recognise.
+func (s *service) handleSettings(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	sessions, err := s.userauth.Sessions(r.Context(), user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	data := make([]view.SessionDisplayData, 0, len(sessions))
+	for _, ss := range sessions {
+		data = append(data, view.SessionDisplayData{
+			ID:       ss.ID,
+			Device:   ss.UserAgent,
+			IP:       ss.IP,
+			Created:  formatTime(ss.CreatedAt),
+			LastSeen: formatTime(ss.LastSeenAt),
+			Current:  ss.ID == user.SessionID,
+		})
+	}
+	w.WriteHeader(http.StatusOK)
+	view.Settings(user, data).Render(r.Context(), w)
+}
+
+// handleRevokeSession ends one session of the user. Revoking the current one
+// logs the user out.
+func (s *service) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*auth.UserContext)
+	sid, err := uuid.FromString(chi.URLParam(r, "sid"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid session id."))
+		return
+	}
+	if sid == user.SessionID {
+		s.handleLogout(w, r)
+		return
+	}
+	if err := s.userauth.RevokeSession(r.Context(), user.ID, sid); errors.Is(err, auth.ErrNoSession) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Session does not exists."))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func formatTime(t time.Time) string {
+	return fmt.Sprintf("%d/%02d/%02d %02d:%02d:%02d",
+		t.Year(), t.Month(), t.Day(),
+		t.Hour(), t.Minute(), t.Second())
+}
+
 /* ================================================ */
@@ -0,0 +1,169 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Bucket is the size and refill rate of a token bucket: up to Burst
+// attempts at once, then one every Period.
+type Bucket struct {
+	Burst  float64
+	Period time.Duration
+}
+
+var (
+	// ipBucket limits the logins from one address by default, which may be
+	// shared by many users behind a NAT, see LimitLoginsPerIP.
+	ipBucket = Bucket{Burst: 20, Period: 30 * time.Second}
+	// usernameBucket limits the logins to one account, from anywhere.
+	usernameBucket = Bucket{Burst: 10, Period: time.Minute}
+)
+
+// ParseBucket reads a bucket written as burst/period, such as 20/30s.
+func ParseBucket(v string) (Bucket, error) {
+	burst, period, ok := strings.Cut(v, "/")
+	if !ok {
+		return Bucket{}, fmt.Errorf("bucket %q is not burst/period", v)
+	}
+	n, err := strconv.ParseUint(burst, 10, 32)
+	if err != nil || n == 0 {
+		return Bucket{}, fmt.Errorf("invalid burst %q", burst)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Bucket{}, fmt.Errorf("invalid period %q", period)
+	}
+	return Bucket{Burst: float64(n), Period: d}, nil
+}
+
+// RateLimiter limits the login attempts per key, such as the address of the
+// client or the username tried.
+type RateLimiter interface {
+	// Allow takes a token from the bucket of key. It returns how long to
+	// wait for the next token when there is none left, and 0 otherwise.
+	Allow(ctx context.Context, key string, b Bucket, now time.Time) (time.Duration, error)
+	// Prune forgets the buckets last used before before, which are full
+	// again by then and the same as no bucket at all.
+	Prune(ctx context.Context, before time.Time) error
+}
+
+// wait returns how long a bucket holding tokens takes to get a whole one.
+func (b Bucket) wait(tokens float64) time.Duration {
+	return time.Duration(math.Ceil((1 - tokens) * float64(b.Period)))
+}
+
+// full returns how long an empty bucket takes to fill up.
+func (b Bucket) full() time.Duration {
+	return time.Duration(b.Burst * float64(b.Period))
+}
+
+// refill returns the tokens of a bucket holding tokens at updated, at now.
+func (b Bucket) refill(tokens float64, updated time.Time, now time.Time) float64 {
+	return math.Min(b.Burst, tokens+float64(now.Sub(updated))/float64(b.Period))
+}
+
+// =================================== In-memory limiter ===================================
+// memRateLimiter keeps the buckets in the process. It is the default for a
+// single node deployment.
+type memRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*memBucket
+}
+
+type memBucket struct {
+	tokens  float64
+	updated time.Time
+	b       Bucket
+}
+
+// maxMemBuckets is the number of buckets above which the full ones are
+// forgotten, they are the same as no bucket at all.
+const maxMemBuckets = 10000
+
+func NewMemRateLimiter() *memRateLimiter {
+	return &memRateLimiter{buckets: make(map[string]*memBucket)}
+}
+
+func (l *memRateLimiter) Allow(ctx context.Context, key string, b Bucket, now time.Time) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buckets) > maxMemBuckets {
+		for k, mb := range l.buckets {
+			if mb.b.refill(mb.tokens, mb.updated, now) >= mb.b.Burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	mb, ok := l.buckets[key]
+	if !ok {
+		mb = &memBucket{tokens: b.Burst, updated: now, b: b}
+		l.buckets[key] = mb
+	}
+	mb.tokens, mb.updated = b.refill(mb.tokens, mb.updated, now), now
+	if mb.tokens < 1 {
+		return b.wait(mb.tokens), nil
+	}
+	mb.tokens--
+	return 0, nil
+}
+
+func (l *memRateLimiter) Prune(ctx context.Context, before time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, mb := range l.buckets {
+		if mb.updated.Before(before) {
+			delete(l.buckets, k)
+		}
+	}
+	return nil
+}
+
+// =================================== Postgres limiter ===================================
+// pgRateLimiter keeps the buckets in the login_bucket table, so that every
+// node of the cluster shares them.
+type pgRateLimiter struct {
+	db *pgxpool.Pool
+}
+
+func NewPgRateLimiter(db *pgxpool.Pool) *pgRateLimiter {
+	return &pgRateLimiter{db: db}
+}
+
+// Allow refills and takes the token in a single statement, the update is
+// skipped when the bucket is empty.
+func (l *pgRateLimiter) Allow(ctx context.Context, key string, b Bucket, now time.Time) (time.Duration, error) {
+	rate := 1 / b.Period.Seconds()
+	var tokens float64
+	err := l.db.QueryRow(ctx,
+		`insert into login_bucket(key, tokens, updated_at) values($1, $2::float8 - 1, $3)
+            on conflict (key) do update
+            set tokens = least($2::float8, login_bucket.tokens + extract(epoch from $3 - login_bucket.updated_at)::float8 * $4) - 1,
+                updated_at = $3
+            where least($2::float8, login_bucket.tokens + extract(epoch from $3 - login_bucket.updated_at)::float8 * $4) >= 1
+            returning tokens`, key, b.Burst, now, rate).Scan(&tokens)
+	if err == nil {
+		return 0, nil
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, err
+	}
+	var updated time.Time
+	if err := l.db.QueryRow(ctx, `select tokens, updated_at from login_bucket where key = $1`, key).Scan(&tokens, &updated); err != nil {
+		return 0, err
+	}
+	return b.wait(b.refill(tokens, updated, now)), nil
+}
+
+func (l *pgRateLimiter) Prune(ctx context.Context, before time.Time) error {
+	_, err := l.db.Exec(ctx, `delete from login_bucket where updated_at < $1`, before)
+	return err
+}
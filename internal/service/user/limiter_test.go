@@ -0,0 +1,109 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBucketRefill(t *testing.T) {
+	b := Bucket{Burst: 10, Period: time.Minute}
+	at := time.Unix(1700000000, 0)
+	tests := []struct {
+		name    string
+		tokens  float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{"no time", 3, 0, 3},
+		{"one period", 3, time.Minute, 4},
+		{"half a period", 0, 30 * time.Second, 0.5},
+		{"capped at the burst", 9, time.Hour, 10},
+		{"from empty", -1, 2 * time.Minute, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := b.refill(tt.tokens, at, at.Add(tt.elapsed)); got != tt.want {
+				t.Fatalf("got %v tokens, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketWait(t *testing.T) {
+	b := Bucket{Burst: 10, Period: time.Minute}
+	tests := []struct {
+		tokens float64
+		want   time.Duration
+	}{
+		{0, time.Minute},
+		{0.5, 30 * time.Second},
+		{0.75, 15 * time.Second},
+		{1, 0},
+	}
+	for _, tt := range tests {
+		if got := b.wait(tt.tokens); got != tt.want {
+			t.Errorf("wait(%v) = %v, want %v", tt.tokens, got, tt.want)
+		}
+	}
+}
+
+func TestMemRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := NewMemRateLimiter()
+	b := Bucket{Burst: 3, Period: time.Minute}
+	now := time.Unix(1700000000, 0)
+	allow := func(key string, at time.Time) time.Duration {
+		t.Helper()
+		wait, err := l.Allow(ctx, key, b, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wait
+	}
+
+	for i := 0; i < 3; i++ {
+		if wait := allow("alice", now); wait != 0 {
+			t.Fatalf("attempt %d: waits %v within the burst", i+1, wait)
+		}
+	}
+	if wait := allow("alice", now); wait != time.Minute {
+		t.Fatalf("past the burst: waits %v, want a minute", wait)
+	}
+	// the buckets are per key
+	if wait := allow("bob", now); wait != 0 {
+		t.Fatalf("another key waits %v", wait)
+	}
+	// waits are rounded up, up to float precision
+	if wait := allow("alice", now.Add(20*time.Second)); wait < 40*time.Second || wait > 40*time.Second+time.Millisecond {
+		t.Fatalf("a third of the period later: waits %v, want 40s", wait)
+	}
+	if wait := allow("alice", now.Add(time.Minute)); wait != 0 {
+		t.Fatalf("a period later: waits %v, want a token", wait)
+	}
+	if wait := allow("alice", now.Add(time.Minute)); wait == 0 {
+		t.Fatal("got two tokens out of one period")
+	}
+}
+
+func TestParseBucket(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Bucket
+		ok   bool
+	}{
+		{"20/30s", Bucket{Burst: 20, Period: 30 * time.Second}, true},
+		{"1/1h", Bucket{Burst: 1, Period: time.Hour}, true},
+		{"20", Bucket{}, false},
+		{"0/30s", Bucket{}, false},
+		{"-1/30s", Bucket{}, false},
+		{"20/0s", Bucket{}, false},
+		{"20/soon", Bucket{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseBucket(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseBucket(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+}
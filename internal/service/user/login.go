@@ -0,0 +1,148 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/brianaung/rtm/internal/auth"
+	"github.com/gofrs/uuid/v5"
+)
+
+// LoginFailure is why a login failed, as recorded in the audit log.
+type LoginFailure string
+
+const (
+	failUnknownUser   LoginFailure = "unknown_user"
+	failWrongPassword LoginFailure = "wrong_password"
+	failLocked        LoginFailure = "locked"
+	failRateLimited   LoginFailure = "rate_limited"
+)
+
+const (
+	// lockoutThreshold is the number of failed logins in a row an account
+	// takes before it is locked.
+	lockoutThreshold = 5
+	// the first lockout lasts lockoutBase, and each failure past the
+	// threshold doubles it up to maxLockout
+	lockoutBase = time.Minute
+	maxLockout  = time.Hour
+	// failures in a row are forgotten failureRetention after the last one,
+	// once the username is not locked anymore
+	failureRetention = 24 * time.Hour
+	// pruneInterval is how often the expired login limits and failures, and
+	// the failed logins past the audit retention, are removed.
+	pruneInterval = 10 * time.Minute
+)
+
+// errBadLogin is the one message of every rejected login, so they do not tell
+// whether the username exists.
+const errBadLogin = "Invalid username or password."
+
+// lockout returns how long a username is locked after failures failed logins
+// in a row, 0 if it is not.
+func lockout(failures int) time.Duration {
+	if failures < lockoutThreshold {
+		return 0
+	}
+	d := lockoutBase
+	for i := lockoutThreshold; i < failures && d < maxLockout; i++ {
+		d *= 2
+	}
+	return min(d, maxLockout)
+}
+
+// allowLogin takes a token from the buckets of the client address, unless
+// they are turned off, and of the username. It returns how long to wait when
+// either is empty.
+func (s *service) allowLogin(ctx context.Context, r *http.Request, username string, now time.Time) (time.Duration, error) {
+	if s.ipBucket.Burst > 0 {
+		wait, err := s.limiter.Allow(ctx, "ip:"+auth.ClientIP(r), s.ipBucket, now)
+		if err != nil || wait > 0 {
+			return wait, err
+		}
+	}
+	return s.limiter.Allow(ctx, "user:"+loginKey(username), usernameBucket, now)
+}
+
+// loginKey is the key of the rate limit and of the failures of the logins to
+// a username, which are counted whatever its case.
+func loginKey(username string) string {
+	return strings.ToLower(username)
+}
+
+// failLogin counts a failed login against a username, whether or not a user
+// has it, and locks it once it reaches the threshold. It returns when the
+// username is locked until, if it is.
+func (s *service) failLogin(ctx context.Context, username string, now time.Time) (*time.Time, error) {
+	n, err := s.users.AddLoginFailure(ctx, loginKey(username), now)
+	if err != nil {
+		return nil, err
+	}
+	d := lockout(n)
+	if d == 0 {
+		return nil, nil
+	}
+	until := now.Add(d)
+	if err := s.users.LockLogin(ctx, loginKey(username), until); err != nil {
+		return nil, err
+	}
+	return &until, nil
+}
+
+// auditLogin records a failed login. u is nil when the username matches no
+// user. The login is rejected either way, so errors are only logged.
+func (s *service) auditLogin(r *http.Request, username string, u *User, reason LoginFailure, now time.Time) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		log.Printf("error: %v", err)
+		return
+	}
+	a := &LoginAttempt{
+		ID:        id,
+		Username:  username,
+		IP:        auth.ClientIP(r),
+		UserAgent: auth.UserAgent(r),
+		Reason:    reason,
+		Time:      now,
+	}
+	if u != nil {
+		a.UserID = &u.ID
+	}
+	if err := s.users.AddLoginAttempt(r.Context(), a); err != nil {
+		log.Printf("error: %v", err)
+	}
+}
+
+// pruneLogins removes the rate limit buckets that are full again, the
+// failures past failureRetention and the audit log entries older than
+// retention. Errors are only logged, the next run tries again.
+func (s *service) pruneLogins(ctx context.Context, retention time.Duration, now time.Time) {
+	if err := s.limiter.Prune(ctx, now.Add(-max(s.ipBucket.full(), usernameBucket.full()))); err != nil {
+		log.Printf("error: %v", err)
+	}
+	if err := s.users.PruneLoginFailures(ctx, now.Add(-failureRetention), now); err != nil {
+		log.Printf("error: %v", err)
+	}
+	if err := s.users.PruneLoginAttempts(ctx, now.Add(-retention)); err != nil {
+		log.Printf("error: %v", err)
+	}
+}
+
+// retryAfter is the message of a login rejected for d. The wait is rounded
+// up, so that trying again when told to is never too early.
+func retryAfter(d time.Duration) string {
+	n, unit := int(math.Ceil(d.Seconds())), "second"
+	if d > time.Minute {
+		n, unit = int(math.Ceil(d.Minutes())), "minute"
+	}
+	n = max(n, 1)
+	if n > 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("Too many failed attempts. Try again in %d %s.", n, unit)
+}
@@ -0,0 +1,201 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianaung/rtm/internal/auth"
+	"github.com/go-chi/chi/v5"
+)
+
+// newTestService is a user service on the in-memory stores, with alice signed
+// up with the password "correct horse".
+func newTestService(t *testing.T) *service {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test secret")
+	t.Setenv("BCRYPT_COST", "4")
+	users := NewMemStore()
+	a := auth.Init(users)
+	hashed, err := a.HashAndSalt("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.AddUser(context.Background(), &User{Username: "alice", Email: "alice@example.com", Password: hashed}); err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(chi.NewRouter(), users, NewMemRateLimiter(), a)
+	s.Routes()
+	return s
+}
+
+func (s *service) login(username string, password string) *httptest.ResponseRecorder {
+	form := url.Values{"username": {username}, "password": {password}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLockout(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{lockoutThreshold - 1, 0},
+		{lockoutThreshold, lockoutBase},
+		{lockoutThreshold + 1, 2 * lockoutBase},
+		{lockoutThreshold + 3, 8 * lockoutBase},
+		{lockoutThreshold + 6, maxLockout},
+		{1000, maxLockout},
+	}
+	for _, tt := range tests {
+		if got := lockout(tt.failures); got != tt.want {
+			t.Errorf("lockout(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "Try again in 1 second."},
+		{300 * time.Millisecond, "Try again in 1 second."},
+		{12 * time.Second, "Try again in 12 seconds."},
+		{time.Minute, "Try again in 60 seconds."},
+		{time.Minute + time.Second, "Try again in 2 minutes."},
+		{4 * time.Minute, "Try again in 4 minutes."},
+		{maxLockout, "Try again in 60 minutes."},
+	}
+	for _, tt := range tests {
+		if got := retryAfter(tt.d); !strings.HasSuffix(got, tt.want) {
+			t.Errorf("retryAfter(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+	}{
+		{"existing user", "alice"},
+		{"unknown user", "mallory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+			for i := 1; i < lockoutThreshold; i++ {
+				if rec := s.login(tt.username, "wrong"); rec.Code != http.StatusUnprocessableEntity {
+					t.Fatalf("failure %d: got %d, want 422", i, rec.Code)
+				}
+			}
+			rec := s.login(tt.username, "wrong")
+			if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+				t.Fatalf("failure %d: got %d, want 429 with Retry-After", lockoutThreshold, rec.Code)
+			}
+			// the lock holds whatever the password and the case of the name
+			if rec := s.login(strings.ToUpper(tt.username), "correct horse"); rec.Code != http.StatusTooManyRequests {
+				t.Fatalf("login while locked: got %d, want 429", rec.Code)
+			}
+		})
+	}
+}
+
+func TestLoginResetsFailures(t *testing.T) {
+	s := newTestService(t)
+	for round := 0; round < 2; round++ {
+		for i := 1; i < lockoutThreshold; i++ {
+			if rec := s.login("alice", "wrong"); rec.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("round %d, failure %d: got %d, want 422", round, i, rec.Code)
+			}
+		}
+		if rec := s.login("alice", "correct horse"); rec.Code != http.StatusOK {
+			t.Fatalf("round %d, login: got %d, want 200", round, rec.Code)
+		}
+	}
+}
+
+func TestUsernamesIgnoreCase(t *testing.T) {
+	s := newTestService(t)
+	if _, err := s.users.AddUser(context.Background(), &User{Username: "Alice", Email: "other@example.com", Password: "unused"}); err != errUsernameTaken {
+		t.Fatalf("got %v, want errUsernameTaken", err)
+	}
+	if rec := s.login("ALICE", "correct horse"); rec.Code != http.StatusOK {
+		t.Fatalf("login: got %d, want 200", rec.Code)
+	}
+}
+
+func TestLoginIPLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		bucket  Bucket
+		limited bool
+	}{
+		{"default", ipBucket, true},
+		{"off", Bucket{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+			s.LimitLoginsPerIP(tt.bucket)
+			limited := false
+			// one failure per username, none of them gets locked
+			for i := 0; i <= int(ipBucket.Burst); i++ {
+				if rec := s.login(fmt.Sprintf("user%d", i), "wrong"); rec.Code == http.StatusTooManyRequests {
+					limited = true
+				}
+			}
+			if limited != tt.limited {
+				t.Fatalf("got limited %v, want %v", limited, tt.limited)
+			}
+		})
+	}
+}
+
+func TestPruneLogins(t *testing.T) {
+	s := newTestService(t)
+	users, limiter := s.users.(*memStore), s.limiter.(*memRateLimiter)
+	ctx := context.Background()
+	for i := 0; i < lockoutThreshold; i++ {
+		s.login("alice", "wrong")
+	}
+	s.login("mallory", "wrong")
+	now := time.Now()
+
+	// alice is still locked an hour later, but the buckets are full again
+	s.pruneLogins(ctx, 90*24*time.Hour, now.Add(time.Hour))
+	if n := len(limiter.buckets); n != 0 {
+		t.Fatalf("got %d buckets, want none", n)
+	}
+	if f, _ := users.GetLoginFailures(ctx, "alice"); f == nil {
+		t.Fatal("locked username was pruned")
+	}
+	if n := len(users.attempts); n != lockoutThreshold+1 {
+		t.Fatalf("got %d attempts, want %d", n, lockoutThreshold+1)
+	}
+
+	s.pruneLogins(ctx, 90*24*time.Hour, now.Add(failureRetention+time.Minute))
+	for _, name := range []string{"alice", "mallory"} {
+		if f, _ := users.GetLoginFailures(ctx, name); f != nil {
+			t.Fatalf("failures of %s were kept: %+v", name, f)
+		}
+	}
+	if n := len(users.attempts); n != lockoutThreshold+1 {
+		t.Fatalf("got %d attempts, want %d", n, lockoutThreshold+1)
+	}
+
+	s.pruneLogins(ctx, 90*24*time.Hour, now.Add(91*24*time.Hour))
+	if n := len(users.attempts); n != 0 {
+		t.Fatalf("got %d attempts, want none", n)
+	}
+}
@@ -0,0 +1,273 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brianaung/rtm/internal/auth"
+	"github.com/gofrs/uuid/v5"
+)
+
+// memStore is an in-memory implementation of UserStore.
+//
+// It is meant for running the server without a database (dev mode) and for
+// unit testing the handlers. Everything is lost when the process exits.
+type memStore struct {
+	mu    sync.RWMutex
+	users map[string]*User    // lowercased username -> user
+	byID  map[uuid.UUID]*User // user id -> user
+	// session id -> session
+	sessions map[uuid.UUID]*auth.Session
+	// username -> failed logins in a row
+	failures map[string]*LoginFailures
+	// the latest failed logins, oldest first
+	attempts []*LoginAttempt
+}
+
+const (
+	// maxMemAttempts bounds the failed logins kept by the in-memory store.
+	maxMemAttempts = 1000
+	// maxMemFailures is the number of usernames with failed logins above
+	// which the ones that are not locked are forgotten.
+	maxMemFailures = 10000
+)
+
+func NewMemStore() *memStore {
+	return &memStore{
+		users:    make(map[string]*User),
+		byID:     make(map[uuid.UUID]*User),
+		sessions: make(map[uuid.UUID]*auth.Session),
+		failures: make(map[string]*LoginFailures),
+	}
+}
+
+func (s *memStore) AddUser(ctx context.Context, u *User) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[strings.ToLower(u.Username)]; ok {
+		return nil, errUsernameTaken
+	}
+	for _, other := range s.byID {
+		if other.Email == u.Email {
+			return nil, errEmailTaken
+		}
+	}
+	u.ID = uuid.Must(uuid.NewV4())
+	user := *u
+	s.users[strings.ToLower(u.Username)] = &user
+	s.byID[u.ID] = &user
+	return u, nil
+}
+
+func (s *memStore) GetUserByName(ctx context.Context, username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[strings.ToLower(username)]
+	if !ok {
+		return nil, nil
+	}
+	user := *u
+	return &user, nil
+}
+
+func (s *memStore) UpdatePassword(ctx context.Context, uid uuid.UUID, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.byID[uid]; ok {
+		u.Password = password
+	}
+	return nil
+}
+
+func (s *memStore) GetLoginFailures(ctx context.Context, username string) (*LoginFailures, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.failures[username]
+	if !ok {
+		return nil, nil
+	}
+	failures := *f
+	return &failures, nil
+}
+
+func (s *memStore) AddLoginFailure(ctx context.Context, username string, at time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.failures) > maxMemFailures {
+		s.pruneLoginFailures(at, at)
+	}
+	f, ok := s.failures[username]
+	if !ok {
+		f = &LoginFailures{Username: username}
+		s.failures[username] = f
+	}
+	f.Failures++
+	f.UpdatedAt = at
+	return f.Failures, nil
+}
+
+func (s *memStore) LockLogin(ctx context.Context, username string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.failures[username]; ok {
+		f.LockedUntil = &until
+	}
+	return nil
+}
+
+func (s *memStore) ResetLoginFailures(ctx context.Context, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failures, username)
+	return nil
+}
+
+func (s *memStore) PruneLoginFailures(ctx context.Context, before time.Time, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLoginFailures(before, now)
+	return nil
+}
+
+// pruneLoginFailures is PruneLoginFailures with the lock held.
+func (s *memStore) pruneLoginFailures(before time.Time, now time.Time) {
+	for k, f := range s.failures {
+		if f.UpdatedAt.Before(before) && (f.LockedUntil == nil || !now.Before(*f.LockedUntil)) {
+			delete(s.failures, k)
+		}
+	}
+}
+
+func (s *memStore) AddLoginAttempt(ctx context.Context, a *LoginAttempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempt := *a
+	s.attempts = append(s.attempts, &attempt)
+	if len(s.attempts) > maxMemAttempts {
+		s.attempts = s.attempts[len(s.attempts)-maxMemAttempts:]
+	}
+	return nil
+}
+
+func (s *memStore) PruneLoginAttempts(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := 0
+	for i < len(s.attempts) && s.attempts[i].Time.Before(before) {
+		i++
+	}
+	s.attempts = s.attempts[i:]
+	return nil
+}
+
+// GetUserIDByName lets the in-memory chat store find the users to start a
+// direct conversation with. It returns uuid.Nil if there is no such user.
+func (s *memStore) GetUserIDByName(ctx context.Context, username string) (uuid.UUID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[strings.ToLower(username)]
+	if !ok {
+		return uuid.Nil, nil
+	}
+	return u.ID, nil
+}
+
+// GetUsernameByID lets the in-memory chat store resolve the usernames it
+// cannot join like the postgres store does.
+func (s *memStore) GetUsernameByID(ctx context.Context, uid uuid.UUID) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.byID[uid]
+	if !ok {
+		return "", nil
+	}
+	return u.Username, nil
+}
+
+func (s *memStore) AddSession(ctx context.Context, ss *auth.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := *ss
+	s.sessions[ss.ID] = &session
+	return nil
+}
+
+func (s *memStore) GetSession(ctx context.Context, sid uuid.UUID) (*auth.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ss, ok := s.sessions[sid]
+	if !ok {
+		return nil, nil
+	}
+	return s.session(ss), nil
+}
+
+func (s *memStore) RotateSession(ctx context.Context, sid uuid.UUID, prev []byte, next []byte, ip string, at time.Time, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss, ok := s.sessions[sid]
+	if !ok || ss.RevokedAt != nil || !bytes.Equal(ss.RefreshHash, prev) {
+		return auth.ErrNoSession
+	}
+	ss.PrevHash, ss.RefreshHash = ss.RefreshHash, next
+	ss.RotatedAt, ss.LastSeenAt, ss.IP, ss.ExpiresAt = at, at, ip, expires
+	return nil
+}
+
+func (s *memStore) TouchSession(ctx context.Context, sid uuid.UUID, ip string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ss, ok := s.sessions[sid]; ok {
+		ss.LastSeenAt, ss.IP = at, ip
+	}
+	return nil
+}
+
+func (s *memStore) RevokeSession(ctx context.Context, uid uuid.UUID, sid uuid.UUID, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss, ok := s.sessions[sid]
+	if !ok || ss.UserID != uid || ss.RevokedAt != nil {
+		return auth.ErrNoSession
+	}
+	ss.RevokedAt = &at
+	return nil
+}
+
+func (s *memStore) RevokeSessions(ctx context.Context, uid uuid.UUID, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ss := range s.sessions {
+		if ss.UserID == uid && ss.RevokedAt == nil {
+			ss.RevokedAt = &at
+		}
+	}
+	return nil
+}
+
+func (s *memStore) GetSessions(ctx context.Context, uid uuid.UUID, now time.Time) ([]*auth.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ss := make([]*auth.Session, 0)
+	for _, session := range s.sessions {
+		if session.UserID == uid && session.RevokedAt == nil && now.Before(session.ExpiresAt) {
+			ss = append(ss, s.session(session))
+		}
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].LastSeenAt.After(ss[j].LastSeenAt) })
+	return ss, nil
+}
+
+// session copies a session with the current name and email of its user, like
+// the join of the postgres store. It must be called with the lock held.
+func (s *memStore) session(ss *auth.Session) *auth.Session {
+	session := *ss
+	if u, ok := s.byID[ss.UserID]; ok {
+		session.Username, session.Email = u.Username, u.Email
+	}
+	return &session
+}
@@ -2,8 +2,13 @@ package user
 
 import (
 	"context"
+	"errors"
+	"time"
 
+	"github.com/brianaung/rtm/internal/auth"
 	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -14,20 +19,212 @@ type User struct {
 	Password string    `json:"password"`
 }
 
-func addUser(ctx context.Context, db *pgxpool.Pool, u *User) (*User, error) {
+// LoginFailures counts the failed logins in a row to a username, see lockout.
+type LoginFailures struct {
+	Username    string     `json:"username"`
+	Failures    int        `json:"failures"`
+	LockedUntil *time.Time `json:"locked_until"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// LoginAttempt is the audit log entry of a failed login. UserID is nil when
+// the username matches no user.
+type LoginAttempt struct {
+	ID        uuid.UUID    `json:"id"`
+	Username  string       `json:"username"`
+	UserID    *uuid.UUID   `json:"user_id"`
+	IP        string       `json:"ip"`
+	UserAgent string       `json:"user_agent"`
+	Reason    LoginFailure `json:"reason"`
+	Time      time.Time    `json:"time"`
+}
+
+// uniqueViolation is the postgres error code of a unique constraint violation.
+const uniqueViolation = "23505"
+
+// pgStore is the postgres backed implementation of UserStore.
+type pgStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPgStore(db *pgxpool.Pool) *pgStore {
+	return &pgStore{db: db}
+}
+
+func (s *pgStore) AddUser(ctx context.Context, u *User) (*User, error) {
 	u.ID = uuid.Must(uuid.NewV4())
-	_, err := db.Exec(ctx, `insert into "user"(id, username, email, password) values($1, $2, $3, $4)`, u.ID, u.Username, u.Email, u.Password)
-	if err != nil {
+	_, err := s.db.Exec(ctx, `insert into "user"(id, username, email, password) values($1, $2, $3, $4)`, u.ID, u.Username, u.Email, u.Password)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		if pgErr.ConstraintName == "user_email_key" {
+			return nil, errEmailTaken
+		}
+		return nil, errUsernameTaken
+	} else if err != nil {
 		return nil, err
 	}
 	return u, nil
 }
 
-func getUserByName(ctx context.Context, db *pgxpool.Pool, username string) (*User, error) {
+func (s *pgStore) GetUserByName(ctx context.Context, username string) (*User, error) {
 	u := &User{}
-	err := db.QueryRow(ctx, `select * from "user" where username = $1`, username).Scan(&u.ID, &u.Username, &u.Email, &u.Password)
-	if err != nil {
+	err := s.db.QueryRow(ctx,
+		`select id, username, email, password from "user" where lower(username) = lower($1)`, username).
+		Scan(&u.ID, &u.Username, &u.Email, &u.Password)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
 		return nil, err
 	}
 	return u, nil
 }
+
+func (s *pgStore) UpdatePassword(ctx context.Context, uid uuid.UUID, password string) error {
+	_, err := s.db.Exec(ctx, `update "user" set password = $2 where id = $1`, uid, password)
+	return err
+}
+
+// ===== Logins =====
+
+func (s *pgStore) GetLoginFailures(ctx context.Context, username string) (*LoginFailures, error) {
+	f := &LoginFailures{Username: username}
+	err := s.db.QueryRow(ctx, `select failures, locked_until, updated_at from login_failure where username = $1`, username).
+		Scan(&f.Failures, &f.LockedUntil, &f.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *pgStore) AddLoginFailure(ctx context.Context, username string, at time.Time) (int, error) {
+	n := 0
+	err := s.db.QueryRow(ctx,
+		`insert into login_failure(username, failures, updated_at) values($1, 1, $2)
+            on conflict (username) do update set failures = login_failure.failures + 1, updated_at = $2
+            returning failures`, username, at).Scan(&n)
+	return n, err
+}
+
+func (s *pgStore) LockLogin(ctx context.Context, username string, until time.Time) error {
+	_, err := s.db.Exec(ctx, `update login_failure set locked_until = $2 where username = $1`, username, until)
+	return err
+}
+
+func (s *pgStore) ResetLoginFailures(ctx context.Context, username string) error {
+	_, err := s.db.Exec(ctx, `delete from login_failure where username = $1`, username)
+	return err
+}
+
+func (s *pgStore) PruneLoginFailures(ctx context.Context, before time.Time, now time.Time) error {
+	_, err := s.db.Exec(ctx,
+		`delete from login_failure where updated_at < $1 and (locked_until is null or locked_until <= $2)`, before, now)
+	return err
+}
+
+func (s *pgStore) AddLoginAttempt(ctx context.Context, a *LoginAttempt) error {
+	_, err := s.db.Exec(ctx,
+		`insert into login_attempt(id, username, user_id, ip, user_agent, reason, time) values($1, $2, $3, $4, $5, $6, $7)`,
+		a.ID, a.Username, a.UserID, a.IP, a.UserAgent, a.Reason, a.Time)
+	return err
+}
+
+func (s *pgStore) PruneLoginAttempts(ctx context.Context, before time.Time) error {
+	_, err := s.db.Exec(ctx, `delete from login_attempt where time < $1`, before)
+	return err
+}
+
+// ===== Sessions =====
+
+func (s *pgStore) AddSession(ctx context.Context, ss *auth.Session) error {
+	_, err := s.db.Exec(ctx,
+		`insert into session(id, user_id, refresh_hash, rotated_at, user_agent, ip, created_at, last_seen_at, expires_at)
+            values($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		ss.ID, ss.UserID, ss.RefreshHash, ss.RotatedAt, ss.UserAgent, ss.IP, ss.CreatedAt, ss.LastSeenAt, ss.ExpiresAt)
+	return err
+}
+
+// sessionColumns are the columns scanned by scanSession.
+const sessionColumns = `session.id, session.user_id, u.username, u.email, session.refresh_hash, session.prev_hash, session.rotated_at,
+            session.user_agent, session.ip, session.created_at, session.last_seen_at, session.expires_at, session.revoked_at`
+
+func scanSession(row pgx.Row) (*auth.Session, error) {
+	ss := &auth.Session{}
+	err := row.Scan(&ss.ID, &ss.UserID, &ss.Username, &ss.Email, &ss.RefreshHash, &ss.PrevHash, &ss.RotatedAt,
+		&ss.UserAgent, &ss.IP, &ss.CreatedAt, &ss.LastSeenAt, &ss.ExpiresAt, &ss.RevokedAt)
+	return ss, err
+}
+
+func (s *pgStore) GetSession(ctx context.Context, sid uuid.UUID) (*auth.Session, error) {
+	ss, err := scanSession(s.db.QueryRow(ctx,
+		`select `+sessionColumns+` from session
+            inner join "user" u on u.id = session.user_id
+            where session.id = $1`, sid))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// RotateSession compares the refresh token in the update itself, so that
+// only one of concurrent refreshes wins.
+func (s *pgStore) RotateSession(ctx context.Context, sid uuid.UUID, prev []byte, next []byte, ip string, at time.Time, expires time.Time) error {
+	tag, err := s.db.Exec(ctx,
+		`update session set prev_hash = refresh_hash, refresh_hash = $3, rotated_at = $5, last_seen_at = $5, ip = $4, expires_at = $6
+            where id = $1 and refresh_hash = $2 and revoked_at is null`, sid, prev, next, ip, at, expires)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return auth.ErrNoSession
+	}
+	return nil
+}
+
+func (s *pgStore) TouchSession(ctx context.Context, sid uuid.UUID, ip string, at time.Time) error {
+	_, err := s.db.Exec(ctx, `update session set last_seen_at = $3, ip = $2 where id = $1`, sid, ip, at)
+	return err
+}
+
+func (s *pgStore) RevokeSession(ctx context.Context, uid uuid.UUID, sid uuid.UUID, at time.Time) error {
+	tag, err := s.db.Exec(ctx,
+		`update session set revoked_at = $3 where id = $2 and user_id = $1 and revoked_at is null`, uid, sid, at)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return auth.ErrNoSession
+	}
+	return nil
+}
+
+func (s *pgStore) RevokeSessions(ctx context.Context, uid uuid.UUID, at time.Time) error {
+	_, err := s.db.Exec(ctx, `update session set revoked_at = $2 where user_id = $1 and revoked_at is null`, uid, at)
+	return err
+}
+
+func (s *pgStore) GetSessions(ctx context.Context, uid uuid.UUID, now time.Time) ([]*auth.Session, error) {
+	rows, err := s.db.Query(ctx,
+		`select `+sessionColumns+` from session
+            inner join "user" u on u.id = session.user_id
+            where session.user_id = $1
+            and session.revoked_at is null
+            and session.expires_at > $2
+            order by session.last_seen_at desc`, uid, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ss := make([]*auth.Session, 0)
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, session)
+	}
+	return ss, rows.Err()
+}
@@ -1,23 +1,50 @@
 package user
 
 import (
+	"context"
+	"time"
+
 	"github.com/brianaung/rtm/internal/auth"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/jwtauth/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type service struct {
 	r        *chi.Mux
-	db       *pgxpool.Pool
+	users    UserStore
+	limiter  RateLimiter
 	userauth *auth.Auth
+	// ipBucket limits the logins per client address, it has no Burst when
+	// they are not limited
+	ipBucket Bucket
 }
 
-func NewService(r *chi.Mux, db *pgxpool.Pool, userauth *auth.Auth) (s *service) {
-	s = &service{r: r, db: db, userauth: userauth}
+func NewService(r *chi.Mux, users UserStore, limiter RateLimiter, userauth *auth.Auth) (s *service) {
+	s = &service{r: r, users: users, limiter: limiter, userauth: userauth, ipBucket: ipBucket}
 	return
 }
 
+// LimitLoginsPerIP replaces the default limit of the logins from one client
+// address, a Bucket with no Burst turns it off. It must be called before the
+// service handles any request.
+func (s *service) LimitLoginsPerIP(b Bucket) {
+	s.ipBucket = b
+}
+
+// PruneLogins starts removing the login rate limits and failures once they
+// expired, and the failed logins older than retention from the audit log,
+// every pruneInterval. It must be called once, after the settings of the
+// service.
+func (s *service) PruneLogins(retention time.Duration) {
+	go func() {
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			s.pruneLogins(context.Background(), retention, now)
+		}
+	}()
+}
+
 func (s *service) Routes() {
 	// public
 	s.r.Group(func(r chi.Router) {
@@ -34,6 +61,9 @@ func (s *service) Routes() {
 		r.Use(jwtauth.Verifier(s.userauth.GetJA()))
 		r.Use(s.userauth.Authenticator())
 
-		r.Get("/logout", s.handleLogout)
+		r.Post("/logout", s.handleLogout)
+		r.Post("/logout/all", s.handleLogoutAll)
+		r.Get("/settings", s.handleSettings)
+		r.Delete("/sessions/{sid}", s.handleRevokeSession)
 	})
 }
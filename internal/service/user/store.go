@@ -0,0 +1,57 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/brianaung/rtm/internal/auth"
+	"github.com/gofrs/uuid/v5"
+)
+
+var (
+	errDuplicate = errors.New("already exists")
+	// AddUser returns these when the username or the email is already used
+	errUsernameTaken = fmt.Errorf("username %w", errDuplicate)
+	errEmailTaken    = fmt.Errorf("email %w", errDuplicate)
+)
+
+// UserStore persists user accounts.
+//
+// Lookups return a nil user with a nil error when nothing matches, so
+// handlers can tell "not found" apart from a failure.
+type UserStore interface {
+	// AddUser returns errUsernameTaken or errEmailTaken if another user has
+	// the same username, whatever its case, or email.
+	AddUser(ctx context.Context, u *User) (*User, error)
+	// GetUserByName matches the username whatever its case.
+	GetUserByName(ctx context.Context, username string) (*User, error)
+	// UpdatePassword replaces the password hash of a user.
+	UpdatePassword(ctx context.Context, uid uuid.UUID, password string) error
+
+	// The failed logins are counted per username tried, whether or not a
+	// user has it, so that the lockout does not tell which accounts exist.
+	// GetLoginFailures returns nil if there are none. AddLoginFailure counts
+	// one more at the time at and returns the number of failed logins in a
+	// row, LockLogin keeps the username from logging in until then, and a
+	// successful login resets both with ResetLoginFailures.
+	GetLoginFailures(ctx context.Context, username string) (*LoginFailures, error)
+	AddLoginFailure(ctx context.Context, username string, at time.Time) (int, error)
+	LockLogin(ctx context.Context, username string, until time.Time) error
+	ResetLoginFailures(ctx context.Context, username string) error
+	// PruneLoginFailures forgets the failures last counted before before,
+	// unless their username is still locked at now.
+	PruneLoginFailures(ctx context.Context, before time.Time, now time.Time) error
+	// AddLoginAttempt records a failed login in the audit log, and
+	// PruneLoginAttempts removes the ones older than before.
+	AddLoginAttempt(ctx context.Context, a *LoginAttempt) error
+	PruneLoginAttempts(ctx context.Context, before time.Time) error
+}
+
+// The user stores also keep the login sessions of the users, see
+// auth.SessionStore.
+var (
+	_ auth.SessionStore = (*pgStore)(nil)
+	_ auth.SessionStore = (*memStore)(nil)
+)
@@ -0,0 +1,112 @@
+package user
+
+import (
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	minUsernameLen = 3
+	maxUsernameLen = 32
+	maxEmailLen    = 254
+	minPasswordLen = 10
+	// maxPasswordLen is in bytes, bcrypt ignores anything longer.
+	maxPasswordLen = 72
+)
+
+// fieldErrors maps the fields of a form to the reason their value was
+// rejected, it is empty when the form is valid.
+type fieldErrors map[string]string
+
+// signupForm is the input of handleSignup.
+type signupForm struct {
+	Username string
+	Email    string
+	Password string
+}
+
+// normalize trims the fields, and lowercases the email so that it is unique
+// whatever its case.
+func (f *signupForm) normalize() {
+	f.Username = strings.TrimSpace(f.Username)
+	f.Email = strings.ToLower(strings.TrimSpace(f.Email))
+}
+
+func (f *signupForm) validate() fieldErrors {
+	errs := fieldErrors{}
+	if msg := validateUsername(f.Username); msg != "" {
+		errs["username"] = msg
+	}
+	if msg := validateEmail(f.Email); msg != "" {
+		errs["email"] = msg
+	}
+	if msg := validatePassword(f.Password, f.Username); msg != "" {
+		errs["password"] = msg
+	}
+	return errs
+}
+
+// validateUsername allows ascii letters, digits, '_', '.' and '-', starting
+// and ending with a letter or a digit so that @mentions of the user parse.
+func validateUsername(username string) string {
+	if len(username) < minUsernameLen || len(username) > maxUsernameLen {
+		return "Username must be between 3 and 32 characters."
+	}
+	for _, r := range username {
+		if !isUsernameRune(r) {
+			return "Username can only contain letters, digits, '_', '.' and '-'."
+		}
+	}
+	if first, last := rune(username[0]), rune(username[len(username)-1]); !isAlnum(first) || !isAlnum(last) {
+		return "Username must start and end with a letter or a digit."
+	}
+	return ""
+}
+
+func isUsernameRune(r rune) bool {
+	return isAlnum(r) || r == '_' || r == '.' || r == '-'
+}
+
+func isAlnum(r rune) bool {
+	return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// validateEmail only accepts bare addresses, without a display name.
+func validateEmail(email string) string {
+	if email == "" {
+		return "Email is required."
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > maxEmailLen || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return "Email is not a valid address."
+	}
+	return ""
+}
+
+// validatePassword requires at least 10 characters, with letters and
+// something else than letters, and not the username.
+func validatePassword(password string, username string) string {
+	if utf8.RuneCountInString(password) < minPasswordLen {
+		return "Password must be at least 10 characters."
+	}
+	if len(password) > maxPasswordLen {
+		return "Password must be at most 72 bytes."
+	}
+	letters, others := false, false
+	for _, r := range password {
+		if unicode.IsLetter(r) {
+			letters = true
+		} else {
+			others = true
+		}
+	}
+	if !letters || !others {
+		return "Password must contain letters and digits or symbols."
+	}
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return "Password must not contain the username."
+	}
+	return ""
+}
@@ -12,20 +12,178 @@ import "bytes"
 
 import "github.com/brianaung/rtm/internal/auth"
 import "github.com/gofrs/uuid/v5"
+import "encoding/json"
 
 // RoomData is used to pass room data into the html templates
 type RoomDisplayData struct {
-	RoomID   uuid.UUID
-	RoomName string
+	RoomID     uuid.UUID
+	RoomName   string
+	Unread     int
+	Visibility string
+	// Direct conversations are named after the other user
+	Direct bool
+	// actions the current user may take on the room
+	CanDelete       bool
+	CanRename       bool
+	CanManageAccess bool
+	CanPin          bool
+	// Anchored is set when the log starts at a message linked to, such as a
+	// search result, instead of the latest message
+	Anchored bool
 }
 
 // MsgData is used to pass the current message log with its metadata to the html templates
 type MsgDisplayData struct {
+	ID       uuid.UUID
 	RoomID   uuid.UUID
 	Username string
 	Msg      string
 	Time     string
 	Mine     bool
+	Edited   bool
+	Deleted  bool
+	// Moderate shows the delete button on messages from others
+	Moderate bool
+	// CanPin shows the pin button
+	CanPin bool
+	// Reply is set on the messages of a thread, Replies on their parent
+	Reply   bool
+	Replies int
+	// Mentioned is set when the message mentions the current user
+	Mentioned  bool
+	Reactions  []ReactionDisplayData
+	Attachment *AttachmentDisplayData
+	Preview    *LinkPreviewDisplayData
+}
+
+// PinDisplayData is a message pinned to a room, shown in its pinned panel.
+type PinDisplayData struct {
+	MessageID uuid.UUID
+	Username  string
+	Msg       string
+	Time      string
+}
+
+// LinkPreviewDisplayData is the summary of the page of the first link of a
+// message.
+type LinkPreviewDisplayData struct {
+	URL         string
+	Title       string
+	Description string
+	SiteName    string
+}
+
+// AttachmentDisplayData is a file attached to a message. Images are shown
+// inline, other files are linked to.
+type AttachmentDisplayData struct {
+	ID       uuid.UUID
+	Filename string
+	Size     string
+	Image    bool
+}
+
+// SearchResultDisplayData is a message found by a search, with the parts of
+// its content matching the query highlighted.
+type SearchResultDisplayData struct {
+	ID       uuid.UUID
+	RoomID   uuid.UUID
+	RoomName string
+	Username string
+	Time     string
+	Snippet  []SnippetPart
+	// ContextID is the message the result is shown next to in the room: the
+	// result itself, or its parent for a reply
+	ContextID uuid.UUID
+}
+
+// MentionDisplayData is a message mentioning the current user, listed in
+// their mentions inbox.
+type MentionDisplayData struct {
+	ID       uuid.UUID
+	RoomID   uuid.UUID
+	RoomName string
+	Username string
+	Msg      string
+	Time     string
+	// ContextID is the message the mention is shown next to in the room,
+	// like for search results
+	ContextID uuid.UUID
+	Unread    bool
+}
+
+// NotificationDisplayData is a notification of the current user. Link is
+// empty when there is nothing to link to, like a deleted room.
+type NotificationDisplayData struct {
+	ID       uuid.UUID
+	Kind     string
+	RoomName string
+	Actor    string
+	Body     string
+	Time     string
+	Link     string
+	Unread   bool
+}
+
+// SessionDisplayData is a device the current user is logged in on. Current is
+// set on the session of the request.
+type SessionDisplayData struct {
+	ID       uuid.UUID
+	Device   string
+	IP       string
+	Created  string
+	LastSeen string
+	Current  bool
+}
+
+// SnippetPart is a piece of a search result snippet.
+type SnippetPart struct {
+	Text  string
+	Match bool
+}
+
+// AuthFormData keeps the values of the login and signup forms when they are
+// rejected, with the reason of each field in error. The password is never
+// sent back.
+type AuthFormData struct {
+	Username string
+	Email    string
+	Errors   map[string]string
+}
+
+// SearchFormData keeps the filters of a search in the search form.
+type SearchFormData struct {
+	Q      string
+	RoomID string
+	Author string
+	From   string
+	To     string
+}
+
+// ReactionDisplayData is the number of users who reacted to a message with an
+// emoji, and whether the current user is one of them.
+type ReactionDisplayData struct {
+	Emoji string
+	Count int
+	Mine  bool
+}
+
+// MemberDisplayData is used to pass the members of a room and whether they are online
+type MemberDisplayData struct {
+	UserID   uuid.UUID
+	RoomID   uuid.UUID
+	Username string
+	Online   bool
+	Role     string
+	// actions the current user may take on the member
+	Kickable     bool
+	RoleEditable bool
+}
+
+// csrfHeaders makes htmx send the csrf token of the page with every request,
+// see auth.CSRF.
+func csrfHeaders(ctx context.Context) string {
+	b, _ := json.Marshal(map[string]string{auth.CSRFHeader: auth.CSRFToken(ctx)})
+	return string(b)
 }
 
 func layout(user *auth.UserContext) templ.Component {
@@ -41,12 +199,28 @@ func layout(user *auth.UserContext) templ.Component {
 			templ_7745c5c3_Var1 = templ.NopComponent
 		}
 		ctx = templ.ClearChildren(ctx)
-		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<!doctype html><html lang=\"en\"><head><meta charset=\"UTF-8\"><meta name=\"viewport\" content=\"width=device-width\"><title>rtm</title><script src=\"https://unpkg.com/htmx.org@1.9.9\" integrity=\"sha384-QFjmbokDn2DjBjq+fM+8LUIVrAgqcNW2s0PjAxHETgRn9l4fvX31ZxDxvwQnyMOX\" crossorigin=\"anonymous\"></script><script src=\"https://unpkg.com/htmx.org/dist/ext/ws.js\"></script><link href=\"/dist/output.css\" rel=\"stylesheet\"></head><body><header class=\"mx-auto container flex justify-between items-center p-4\">")
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<!doctype html><html lang=\"en\"><head><meta charset=\"UTF-8\"><meta name=\"viewport\" content=\"width=device-width\"><meta name=\"csrf-token\" content=\"")
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString(templ.EscapeString(auth.CSRFToken(ctx)))
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("\"><title>rtm</title><script src=\"https://unpkg.com/htmx.org@1.9.9\" integrity=\"sha384-QFjmbokDn2DjBjq+fM+8LUIVrAgqcNW2s0PjAxHETgRn9l4fvX31ZxDxvwQnyMOX\" crossorigin=\"anonymous\"></script><script src=\"https://unpkg.com/htmx.org/dist/ext/ws.js\"></script><script src=\"https://unpkg.com/htmx.org/dist/ext/sse.js\"></script><script>\n\t\t\t\t// Frames sent over the chat websocket are envelopes of the form\n\t\t\t\t// {v, type, id, payload}. ws-send elements set their event type with\n\t\t\t\t// data-ws-event and their form values become the payload.\n\t\t\t\tdocument.addEventListener(\"htmx:wsConfigSend\", function (evt) {\n\t\t\t\t\tvar type = evt.target.dataset.wsEvent;\n\t\t\t\t\tif (!type) {\n\t\t\t\t\t\treturn;\n\t\t\t\t\t}\n\t\t\t\t\tvar elt = document.getElementById(\"ws-error\");\n\t\t\t\t\tif (elt) {\n\t\t\t\t\t\telt.textContent = \"\";\n\t\t\t\t\t}\n\t\t\t\t\tevt.detail.messageBody = JSON.stringify({\n\t\t\t\t\t\tv: 1,\n\t\t\t\t\t\ttype: type,\n\t\t\t\t\t\tid: Date.now().toString(36) + Math.random().toString(36).slice(2),\n\t\t\t\t\t\tpayload: evt.detail.parameters,\n\t\t\t\t\t});\n\t\t\t\t});\n\t\t\t\t// Rejected forms come back with 422 and their errors, or 429 when\n\t\t\t\t// too many were tried, swap them in like a successful response.\n\t\t\t\tdocument.addEventListener(\"htmx:beforeSwap\", function (evt) {\n\t\t\t\t\tif (evt.detail.xhr.status === 422 || evt.detail.xhr.status === 429) {\n\t\t\t\t\t\tevt.detail.shouldSwap = true;\n\t\t\t\t\t\tevt.detail.isError = false;\n\t\t\t\t\t}\n\t\t\t\t});\n\t\t\t\t// Protocol frames are json while html fragments are swapped by htmx.\n\t\t\t\t// Error frames are shown in the #ws-error element of the page.\n\t\t\t\tdocument.addEventListener(\"htmx:wsBeforeMessage\", function (evt) {\n\t\t\t\t\tif (evt.detail.message[0] !== \"{\") {\n\t\t\t\t\t\treturn;\n\t\t\t\t\t}\n\t\t\t\t\tevt.preventDefault();\n\t\t\t\t\tvar frame = JSON.parse(evt.detail.message);\n\t\t\t\t\tvar elt = document.getElementById(\"ws-error\");\n\t\t\t\t\tif (frame.type === \"error\" && elt) {\n\t\t\t\t\t\telt.textContent = frame.payload.message;\n\t\t\t\t\t}\n\t\t\t\t});\n\t\t\t\t// Ack the latest message of the chatroom while the page is visible,\n\t\t\t\t// so that the room is not shown as unread on the dashboard.\n\t\t\t\tvar chatSocket, lastAck;\n\t\t\t\tfunction ackLatest() {\n\t\t\t\t\tvar latest = document.querySelector(\"#log > [id^='msg-']\");\n\t\t\t\t\tif (!chatSocket || !latest || latest.id === lastAck || document.visibilityState !== \"visible\") {\n\t\t\t\t\t\treturn;\n\t\t\t\t\t}\n\t\t\t\t\tlastAck = latest.id;\n\t\t\t\t\tchatSocket.send(JSON.stringify({ v: 1, type: \"read.ack\", payload: { id: latest.id.slice(4) } }));\n\t\t\t\t}\n\t\t\t\tdocument.addEventListener(\"htmx:wsOpen\", function (evt) {\n\t\t\t\t\tchatSocket = evt.detail.socketWrapper;\n\t\t\t\t\tackLatest();\n\t\t\t\t\topenThread();\n\t\t\t\t});\n\t\t\t\tdocument.addEventListener(\"htmx:wsAfterMessage\", ackLatest);\n\t\t\t\tdocument.addEventListener(\"visibilitychange\", ackLatest);\n\t\t\t\t// The socket only pushes the replies of the thread shown in the\n\t\t\t\t// #thread panel, so it is told whenever the panel changes.\n\t\t\t\tfunction openThread() {\n\t\t\t\t\tvar panel = document.querySelector(\"#thread > [data-thread-id]\");\n\t\t\t\t\tif (chatSocket && panel) {\n\t\t\t\t\t\tchatSocket.send(JSON.stringify({ v: 1, type: \"thread.open\", payload: { id: panel.dataset.threadId } }));\n\t\t\t\t\t}\n\t\t\t\t}\n\t\t\t\tfunction closeThread() {\n\t\t\t\t\tdocument.getElementById(\"thread\").innerHTML = \"\";\n\t\t\t\t\tif (chatSocket) {\n\t\t\t\t\t\tchatSocket.send(JSON.stringify({ v: 1, type: \"thread.close\", payload: {} }));\n\t\t\t\t\t}\n\t\t\t\t}\n\t\t\t\t// Attachments are uploaded as soon as they are picked, the message\n\t\t\t\t// sent afterwards refers to them by id.\n\t\t\t\tfunction uploadAttachment(input) {\n\t\t\t\t\tvar name = document.getElementById(\"attachment-name\");\n\t\t\t\t\tvar body = new FormData();\n\t\t\t\t\tbody.append(\"file\", input.files[0]);\n\t\t\t\t\tname.textContent = \"uploading...\";\n\t\t\t\t\tfetch(input.dataset.upload, {\n\t\t\t\t\t\tmethod: \"POST\",\n\t\t\t\t\t\tbody: body,\n\t\t\t\t\t\theaders: { \"X-CSRF-Token\": document.querySelector(\"meta[name=csrf-token]\").content },\n\t\t\t\t\t})\n\t\t\t\t\t\t.then(function (res) {\n\t\t\t\t\t\t\tif (!res.ok) {\n\t\t\t\t\t\t\t\treturn res.text().then(function (text) {\n\t\t\t\t\t\t\t\t\tthrow new Error(text);\n\t\t\t\t\t\t\t\t});\n\t\t\t\t\t\t\t}\n\t\t\t\t\t\t\treturn res.json();\n\t\t\t\t\t\t})\n\t\t\t\t\t\t.then(function (a) {\n\t\t\t\t\t\t\tdocument.getElementById(\"attachment-id\").value = a.id;\n\t\t\t\t\t\t\tname.textContent = a.filename;\n\t\t\t\t\t\t})\n\t\t\t\t\t\t.catch(function (err) {\n\t\t\t\t\t\t\tclearAttachment();\n\t\t\t\t\t\t\tname.textContent = err.message;\n\t\t\t\t\t\t});\n\t\t\t\t}\n\t\t\t\tfunction clearAttachment() {\n\t\t\t\t\tdocument.getElementById(\"attachment-id\").value = \"\";\n\t\t\t\t\tdocument.getElementById(\"attachment-file\").value = \"\";\n\t\t\t\t\tdocument.getElementById(\"attachment-name\").textContent = \"\";\n\t\t\t\t}\n\t\t\t\tdocument.addEventListener(\"htmx:afterSwap\", function (evt) {\n\t\t\t\t\tif (evt.detail.target.id === \"thread\") {\n\t\t\t\t\t\topenThread();\n\t\t\t\t\t}\n\t\t\t\t});\n\t\t\t</script><link href=\"/dist/output.css\" rel=\"stylesheet\"></head><body hx-headers=\"")
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString(templ.EscapeString(csrfHeaders(ctx)))
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("\"><header class=\"mx-auto container flex justify-between items-center p-4\">")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
 		if user != nil {
-			_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<a class=\"font-bold font-2xl hover:underline\" href=\"/dashboard\">HOME</a> <button class=\"rounded border border-black p-1 bg-red-400\" hx-get=\"/logout\" hx-trigger=\"click\" hx-swap=\"none\">Logout</button>")
+			_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<a class=\"font-bold font-2xl hover:underline\" href=\"/dashboard\">HOME</a> <a class=\"ml-auto mr-4 hover:underline\" href=\"/mentions\">Mentions <span id=\"mention-count\" hx-get=\"/mentions/count\" hx-trigger=\"load\" hx-swap=\"outerHTML\"></span></a> <a class=\"mr-4 hover:underline\" href=\"/notifications\">Notifications <span id=\"notification-count\" hx-get=\"/notifications/count\" hx-trigger=\"load\" hx-swap=\"outerHTML\"></span></a> <a class=\"mr-4 hover:underline\" href=\"/search\">Search</a> <a class=\"mr-4 hover:underline\" href=\"/settings\">Settings</a> <button class=\"rounded border border-black p-1 bg-red-400\" hx-post=\"/logout\" hx-trigger=\"click\" hx-swap=\"none\">Logout</button>")
 			if templ_7745c5c3_Err != nil {
 				return templ_7745c5c3_Err
 			}
@@ -59,7 +233,17 @@ func layout(user *auth.UserContext) templ.Component {
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
-		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("</main></body></html>")
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("</main>")
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		if user != nil {
+			_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<div id=\"mention-notice\"></div>")
+			if templ_7745c5c3_Err != nil {
+				return templ_7745c5c3_Err
+			}
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("</body></html>")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
@@ -0,0 +1,230 @@
+package view
+
+import (
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Messages are written in a small subset of Markdown: **bold**, *italics*
+// (or _italics_), `inline code`, ``` code blocks ```, [links](https://...)
+// and bare http(s) links, and @username mentions are highlighted. There is no
+// raw html, the parsed message is rendered by the templates like any other
+// text, so it is escaped as usual.
+
+// mdBlock is a code block, or a line of text.
+type mdBlock struct {
+	Code  bool
+	Text  string // content of a code block
+	Spans []mdSpan
+}
+
+type mdSpanKind int
+
+const (
+	mdText mdSpanKind = iota
+	mdBold
+	mdItalic
+	mdCode
+	mdLink
+	// mdMention is an @username, its text is the username
+	mdMention
+)
+
+type mdSpan struct {
+	Kind mdSpanKind
+	Text string
+	Href string
+}
+
+// parseMarkdown splits a message into blocks. Fences that are not closed are
+// left as text.
+func parseMarkdown(s string) []mdBlock {
+	var blocks []mdBlock
+	lines := strings.Split(s, "\n")
+	for i := 0; i < len(lines); i++ {
+		if strings.HasPrefix(strings.TrimSpace(lines[i]), "```") {
+			end := -1
+			for j := i + 1; j < len(lines); j++ {
+				if strings.TrimSpace(lines[j]) == "```" {
+					end = j
+					break
+				}
+			}
+			if end != -1 {
+				blocks = append(blocks, mdBlock{Code: true, Text: strings.Join(lines[i+1:end], "\n")})
+				i = end
+				continue
+			}
+		}
+		blocks = append(blocks, mdBlock{Spans: parseInline(lines[i])})
+	}
+	return blocks
+}
+
+// parseInline splits a line into spans. Spans do not nest: the content of a
+// bold or italic span is plain text.
+func parseInline(s string) []mdSpan {
+	var (
+		spans []mdSpan
+		text  strings.Builder
+	)
+	flush := func() {
+		if text.Len() > 0 {
+			spans = append(spans, mdSpan{Kind: mdText, Text: text.String()})
+			text.Reset()
+		}
+	}
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		var (
+			span mdSpan
+			n    int
+		)
+		switch {
+		case rest[0] == '`':
+			span, n = delimited(rest, "`", mdCode)
+		case strings.HasPrefix(rest, "**"):
+			span, n = delimited(rest, "**", mdBold)
+		case rest[0] == '*':
+			span, n = delimited(rest, "*", mdItalic)
+		case rest[0] == '_' && wordBoundary(s, i):
+			span, n = delimited(rest, "_", mdItalic)
+			// snake_case words are not italics
+			if r, _ := utf8.DecodeRuneInString(s[i+n:]); n > 0 && wordRune(r) {
+				n = 0
+			}
+		case rest[0] == '[':
+			span, n = inlineLink(rest)
+		case rest[0] == '@' && wordBoundary(s, i):
+			span, n = atMention(rest)
+		case (strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://")) && wordBoundary(s, i):
+			span, n = bareLink(rest)
+		}
+		if n == 0 {
+			r, size := utf8.DecodeRuneInString(rest)
+			text.WriteRune(r)
+			i += size
+			continue
+		}
+		flush()
+		spans = append(spans, span)
+		i += n
+	}
+	flush()
+	return spans
+}
+
+// delimited parses a span enclosed by delim at the start of s, and returns its
+// length in s, or 0 if there is none.
+func delimited(s string, delim string, kind mdSpanKind) (mdSpan, int) {
+	end := strings.Index(s[len(delim):], delim)
+	if end <= 0 {
+		return mdSpan{}, 0
+	}
+	content := s[len(delim) : len(delim)+end]
+	if kind != mdCode && strings.TrimSpace(content) != content {
+		return mdSpan{}, 0
+	}
+	return mdSpan{Kind: kind, Text: content}, 2*len(delim) + end
+}
+
+// inlineLink parses [text](url) at the start of s.
+func inlineLink(s string) (mdSpan, int) {
+	mid := strings.Index(s, "](")
+	if mid <= 1 {
+		return mdSpan{}, 0
+	}
+	end := strings.IndexByte(s[mid+2:], ')')
+	if end <= 0 {
+		return mdSpan{}, 0
+	}
+	href := s[mid+2 : mid+2+end]
+	if !safeLink(href) {
+		return mdSpan{}, 0
+	}
+	return mdSpan{Kind: mdLink, Text: s[1:mid], Href: href}, mid + 3 + end
+}
+
+// bareLink parses a url at the start of s, up to the next space. Trailing
+// punctuation is left out as it most likely ends the sentence.
+func bareLink(s string) (mdSpan, int) {
+	end := strings.IndexFunc(s, unicode.IsSpace)
+	if end == -1 {
+		end = len(s)
+	}
+	href := strings.TrimRight(s[:end], ".,;:!?)'\"")
+	if !safeLink(href) {
+		return mdSpan{}, 0
+	}
+	return mdSpan{Kind: mdLink, Text: href, Href: href}, len(href)
+}
+
+// atMention parses an @username at the start of s. Usernames are made of word
+// runes, dots and dashes, a trailing dot or dash ends the sentence instead.
+func atMention(s string) (mdSpan, int) {
+	end := strings.IndexFunc(s[1:], func(r rune) bool { return !wordRune(r) && r != '.' && r != '-' })
+	if end == -1 {
+		end = len(s) - 1
+	}
+	name := strings.TrimRight(s[1:1+end], ".-")
+	if name == "" {
+		return mdSpan{}, 0
+	}
+	return mdSpan{Kind: mdMention, Text: name}, 1 + len(name)
+}
+
+// safeLink only lets through absolute http(s) and mailto links.
+func safeLink(href string) bool {
+	u, err := url.Parse(href)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return u.Opaque != ""
+	}
+	return false
+}
+
+// wordBoundary reports whether the byte at i is not preceded by a word.
+func wordBoundary(s string, i int) bool {
+	r, _ := utf8.DecodeLastRuneInString(s[:i])
+	return i == 0 || !wordRune(r)
+}
+
+func wordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_'
+}
+
+// FirstLink returns the first http(s) link of a message, as rendered by the
+// templates, or an empty string if there is none.
+func FirstLink(s string) string {
+	for _, b := range parseMarkdown(s) {
+		for _, span := range b.Spans {
+			if span.Kind == mdLink && (strings.HasPrefix(span.Href, "http://") || strings.HasPrefix(span.Href, "https://")) {
+				return span.Href
+			}
+		}
+	}
+	return ""
+}
+
+// MentionedNames returns the usernames mentioned in a message, in order and without
+// duplicates. Mentions in code are left out, like they are not highlighted.
+func MentionedNames(s string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, b := range parseMarkdown(s) {
+		for _, span := range b.Spans {
+			if span.Kind == mdMention && !seen[span.Text] {
+				seen[span.Text] = true
+				names = append(names, span.Text)
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,64 @@
+package view
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSafeLink(t *testing.T) {
+	tests := []struct {
+		href string
+		want bool
+	}{
+		{"https://example.com", true},
+		{"http://example.com/a?b=c#d", true},
+		{"mailto:alice@example.com", true},
+		{"javascript:alert(1)", false},
+		{"JavaScript:alert(1)", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{"vbscript:msgbox", false},
+		{"//example.com", false},
+		{"/relative", false},
+		{"https://", false},
+		{"http:example.com", false},
+		{"mailto:", false},
+		{"", false},
+		{"https://exa mple.com", false},
+	}
+	for _, tt := range tests {
+		if got := safeLink(tt.href); got != tt.want {
+			t.Errorf("safeLink(%q) = %v, want %v", tt.href, got, tt.want)
+		}
+	}
+}
+
+func TestParseInline(t *testing.T) {
+	text := func(s string) mdSpan { return mdSpan{Kind: mdText, Text: s} }
+	tests := []struct {
+		name string
+		in   string
+		want []mdSpan
+	}{
+		{"plain", "hello", []mdSpan{text("hello")}},
+		{"bold", "a **b** c", []mdSpan{text("a "), {Kind: mdBold, Text: "b"}, text(" c")}},
+		{"italics", "*a* _b_", []mdSpan{{Kind: mdItalic, Text: "a"}, text(" "), {Kind: mdItalic, Text: "b"}}},
+		{"code keeps markup", "`**x**`", []mdSpan{{Kind: mdCode, Text: "**x**"}}},
+		{"snake case", "snake_case_word", []mdSpan{text("snake_case_word")}},
+		{"unclosed", "**open", []mdSpan{text("**open")}},
+		{"spaced delimiters", "* not italics *", []mdSpan{text("* not italics *")}},
+		{"link", "[site](https://example.com)", []mdSpan{{Kind: mdLink, Text: "site", Href: "https://example.com"}}},
+		{"unsafe link", "[x](javascript:alert(1))", []mdSpan{text("[x](javascript:alert(1))")}},
+		{"bare link", "see https://example.com.", []mdSpan{text("see "), {Kind: mdLink, Text: "https://example.com", Href: "https://example.com"}, text(".")}},
+		{"link inside a word", "xhttps://example.com", []mdSpan{text("xhttps://example.com")}},
+		{"mention", "hi @bob.", []mdSpan{text("hi "), {Kind: mdMention, Text: "bob"}, text(".")}},
+		{"email is not a mention", "bob@example.com", []mdSpan{text("bob@example.com")}},
+		{"lone at", "@ ", []mdSpan{text("@ ")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseInline(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseInline(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}